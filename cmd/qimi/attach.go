@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/packetstream-llc/qimi/internal/attach"
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/packetstream-llc/qimi/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+var attachCmd = &cobra.Command{
+	Use:   "attach [session]",
+	Short: "Reconnect to a detached exec session",
+	Long: `Connect to the input and output of a command started with qimi exec --detach. Recent
+output is shown first. On a terminal, Ctrl-P Ctrl-Q detaches again and leaves the command
+running. qimi attach exits with the command's exit code when the command ends.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := requireRoot(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		id := args[0]
+
+		store, err := storage.New()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing storage: %v\n", err)
+			os.Exit(1)
+		}
+
+		session, err := store.GetSession(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !session.Detached {
+			fmt.Fprintf(os.Stderr, "Error: session %s was not started with --detach\n", id)
+			os.Exit(1)
+		}
+
+		client, err := attach.Dial(filepath.Join(config.Current().SessionsDir(), id+".sock"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error attaching to session %s: %v\n", id, err)
+			os.Exit(1)
+		}
+		defer client.Close()
+
+		restore := func() {}
+		if client.Terminal && utils.IsTerminal(os.Stdin) {
+			if restore, err = utils.MakeRaw(os.Stdin); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			resize := func() {
+				if rows, cols, err := utils.GetWinsize(os.Stdin); err == nil {
+					client.Resize(rows, cols)
+				}
+			}
+			resize()
+			winch := make(chan os.Signal, 1)
+			signal.Notify(winch, syscall.SIGWINCH)
+			go func() {
+				for range winch {
+					resize()
+				}
+			}()
+		}
+
+		code, err := client.Run(os.Stdin, os.Stdout, os.Stderr)
+		restore()
+
+		if errors.Is(err, attach.ErrDetached) {
+			fmt.Fprintf(os.Stderr, "\nDetached from session %s\n", id)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(attachCmd)
+}
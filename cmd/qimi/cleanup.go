@@ -4,41 +4,77 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/packetstream-llc/qimi/internal/cleanup"
+	"github.com/packetstream-llc/qimi/internal/mount"
 	"github.com/packetstream-llc/qimi/internal/storage"
 	"github.com/spf13/cobra"
 )
 
+var cleanupDryRun bool
+
 var cleanupCmd = &cobra.Command{
 	Use:   "cleanup",
-	Short: "Clean up stale mount entries",
-	Long:  `Remove mount entries that are no longer valid (e.g., after system reboot).`,
+	Short: "Clean up stale mounts and devices",
+	Long: `Repair what crashed commands and reboots left behind: unmount leftover filesystems,
+restore guest files replaced by exec, release orphaned NBD, LVM and LUKS devices,
+remove empty mount directories and drop stale mount entries.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := requireRoot(); err != nil && !cleanupDryRun {
+			fmt.Fprintf(os.Stderr, "Error: %v, or use --dry-run\n", err)
+			os.Exit(1)
+		}
+
 		store, err := storage.New()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error initializing storage: %v\n", err)
 			os.Exit(1)
 		}
 
-		// List mounts before cleanup
-		beforeMounts := store.ListMounts()
+		mounter, err := mount.New()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing mounter: %v\n", err)
+			os.Exit(1)
+		}
 
-		if err := store.CleanupStaleMounts(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error cleaning up stale mounts: %v\n", err)
+		plan, err := cleanup.Build(store, mounter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
-		// List mounts after cleanup
-		afterMounts := store.ListMounts()
+		for _, s := range plan.Skipped {
+			fmt.Printf("Skipping %s\n", s)
+		}
+
+		if len(plan.Actions) == 0 {
+			fmt.Println("Nothing to clean up")
+			return
+		}
 
-		removed := len(beforeMounts) - len(afterMounts)
-		if removed > 0 {
-			fmt.Printf("Cleaned up %d stale mount(s)\n", removed)
-		} else {
-			fmt.Println("No stale mounts found")
+		if cleanupDryRun {
+			fmt.Println("Would:")
+			for _, a := range plan.Actions {
+				fmt.Printf("  - %s\n", a.Description)
+			}
+			return
+		}
+
+		err = plan.Apply(func(a cleanup.Action, err error) {
+			if err != nil {
+				fmt.Printf("  - %s: FAILED: %v\n", a.Description, err)
+			} else {
+				fmt.Printf("  - %s\n", a.Description)
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cleanup finished with errors\n")
+			os.Exit(1)
 		}
+		fmt.Printf("Cleaned up (%d action(s))\n", len(plan.Actions))
 	},
 }
 
 func init() {
+	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "Show what would be cleaned up without changing anything")
 	rootCmd.AddCommand(cleanupCmd)
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/storage"
+)
+
+// checkImageConflict refuses to attach an image that is already attached in a
+// conflicting mode: read-write access needs the image to itself, while any
+// number of read-only mounts may share it
+func checkImageConflict(store *storage.Storage, imagePath string, readOnly bool) error {
+	img, err := storage.ResolveImage(imagePath)
+	if err != nil {
+		return fmt.Errorf("image file not found: %w", err)
+	}
+
+	for _, m := range store.FindByImage(img) {
+		if !store.IsValidMount(m) {
+			continue
+		}
+		if readOnly && m.ReadOnly {
+			continue
+		}
+
+		mode := "read-only"
+		if !m.ReadOnly {
+			mode = "read-write"
+		}
+		return fmt.Errorf("%s is already mounted %s as %s at %s; unmount it first (both mounts would need to be read-only to share the image)", img.RealPath, mode, mountLabel(m), m.MountPoint)
+	}
+
+	if err := nbd.CheckImageLock(img.RealPath); err != nil {
+		return fmt.Errorf("refusing to mount %s: %w", img.RealPath, err)
+	}
+
+	return nil
+}
+
+// mountLabel returns the name of a mount, or its ID when it has none
+func mountLabel(m *storage.MountInfo) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	if m.ID != "" {
+		return m.ID
+	}
+	return m.ImagePath
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osExec "os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/attach"
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/exec"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// detachedSessionEnv passes the session ID from qimi exec --detach to the
+// supervisor it starts
+const detachedSessionEnv = "QIMI_DETACHED_SESSION"
+
+// readyFD is the descriptor the supervisor reports on once the command runs
+const readyFD = 3
+
+// startSupervisor runs qimi exec again in a new process session as the
+// supervisor of a detached command. The supervisor mounts the image with the
+// caller's terminal, so passphrase prompts and errors still reach the user.
+// Once the command runs, the session ID is printed as its handle.
+func startSupervisor() error {
+	id, err := utils.RandomID(8)
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the qimi executable: %w", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := osExec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), detachedSessionEnv+"="+id)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start session supervisor: %w", err)
+	}
+
+	logger.Debug("started supervisor %d for session %s", cmd.Process.Pid, id)
+	if ready, _ := utils.ReadLine(r); string(ready) == "ready" {
+		fmt.Println(id)
+		return cmd.Process.Release()
+	}
+
+	// The supervisor failed before the command started and printed why
+	var exitErr *osExec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	return errors.New("session supervisor exited before starting the command")
+}
+
+// supervisedSession returns the session ID when qimi runs as the supervisor
+// of a detached session
+func supervisedSession() string {
+	id := os.Getenv(detachedSessionEnv)
+	if id == "" {
+		return ""
+	}
+
+	// Neither the command nor daemons started while mounting may inherit these
+	os.Unsetenv(detachedSessionEnv)
+	syscall.CloseOnExec(readyFD)
+	return id
+}
+
+// signalReady tells the waiting qimi exec that the command runs and lets go
+// of its terminal
+func signalReady() {
+	ready := os.NewFile(readyFD, "ready")
+	fmt.Fprintln(ready, "ready")
+	ready.Close()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer devNull.Close()
+	for fd := 0; fd <= 2; fd++ {
+		syscall.Dup3(int(devNull.Fd()), fd, 0)
+	}
+}
+
+// runSupervised runs a command with its stdio served on the session socket
+// instead of the terminal and waits for it. Output is kept while no client
+// is attached, so a later qimi attach sees what it missed.
+func runSupervised(executor *exec.Executor, mountPoint string, command string, args []string, opts exec.Options, sessionID string) error {
+	sessionsDir := config.Current().SessionsDir()
+	if err := os.MkdirAll(sessionsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+
+	chrootCmd, err := executor.Command(mountPoint, command, args, opts)
+	if err != nil {
+		return err
+	}
+
+	var stdin io.WriteCloser
+	var resize func(rows, cols uint16)
+	var master, slave *os.File
+	if tty {
+		master, slave, err = utils.OpenPTY()
+		if err != nil {
+			return fmt.Errorf("failed to allocate a pseudo-TTY: %w", err)
+		}
+		defer master.Close()
+
+		chrootCmd.Stdin = slave
+		chrootCmd.Stdout = slave
+		chrootCmd.Stderr = slave
+		chrootCmd.SysProcAttr.Setsid = true
+		chrootCmd.SysProcAttr.Setctty = true
+		if interactive {
+			// End of input must not close the terminal, the command sees it as a hangup
+			stdin = ptyInput{master}
+		}
+		resize = func(rows, cols uint16) {
+			if err := utils.SetWinsize(master, rows, cols); err != nil {
+				logger.Debug("failed to resize pseudo-TTY: %v", err)
+			}
+		}
+	} else if interactive {
+		if stdin, err = chrootCmd.StdinPipe(); err != nil {
+			return err
+		}
+	}
+
+	server, err := attach.Listen(filepath.Join(sessionsDir, sessionID+".sock"), tty, stdin, resize)
+	if err != nil {
+		if slave != nil {
+			slave.Close()
+		}
+		return fmt.Errorf("failed to create session socket: %w", err)
+	}
+	defer server.Close()
+
+	if !tty {
+		chrootCmd.Stdout = server.Stdout()
+		chrootCmd.Stderr = server.Stderr()
+	}
+
+	logger.Debug("starting detached command execution")
+	err = chrootCmd.Start()
+	if slave != nil {
+		slave.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	copied := make(chan struct{})
+	if tty {
+		go func() {
+			// Reading fails with EIO once the command closed its end of the terminal
+			io.Copy(server.Stdout(), master)
+			close(copied)
+		}()
+	} else {
+		close(copied)
+	}
+
+	go server.Serve()
+	signalReady()
+
+	waitErr := chrootCmd.Wait()
+
+	// Background processes the command left on the terminal must not keep the session open
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+	}
+
+	server.Exit(exitCode(waitErr))
+	return waitErr
+}
+
+// ptyInput writes input to a pseudo-TTY but leaves it open at the end of input
+type ptyInput struct {
+	*os.File
+}
+
+func (ptyInput) Close() error {
+	return nil
+}
+
+// exitCode turns the result of running a command into a shell-style exit code
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *osExec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
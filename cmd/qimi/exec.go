@@ -1,24 +1,51 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	osExec "os/exec"
 
+	"github.com/packetstream-llc/qimi/internal/cgroup"
 	"github.com/packetstream-llc/qimi/internal/exec"
+	"github.com/packetstream-llc/qimi/internal/logger"
 	"github.com/packetstream-llc/qimi/internal/mount"
 	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/process"
+	"github.com/packetstream-llc/qimi/internal/security"
 	"github.com/packetstream-llc/qimi/internal/storage"
-	"github.com/packetstream-llc/qimi/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 var (
-	interactive   bool
-	tty           bool
-	execReadOnly  bool
-	nameservers   []string
-	execPartition string
+	interactive      bool
+	tty              bool
+	execReadOnly     bool
+	nameservers      []string
+	execPartition    string
+	execAll          bool
+	execLV           string
+	execKeyFile      string
+	execSubvol       string
+	execMountOptions []string
+	execNTFSDriver   string
+	execStrict       bool
+	execDetach       bool
+	execNoServices   bool
+	execNetwork      string
+	execPublish      []string
+	execHostname     string
+	execAddHosts     []string
+	execDNSSearch    []string
+	execDNSOptions   []string
+	execMemory       string
+	execCPUs         float64
+	execPIDsLimit    int64
+	execIOWeight     int
+	execHardened     bool
+	execCapAdd       []string
+	execCapDrop      []string
+	execSecurityOpts []string
 )
 
 var execCmd = &cobra.Command{
@@ -27,8 +54,76 @@ var execCmd = &cobra.Command{
 	Long:  `Mount a QEMU image (if not already mounted) and execute a command inside it using chroot.`,
 	Args:  cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if !utils.IsRoot() {
-			return fmt.Errorf("this command requires root privileges. Please run with sudo")
+		if err := requireRoot(); err != nil {
+			return err
+		}
+
+		var publish []exec.PortMapping
+		for _, spec := range execPublish {
+			m, err := exec.ParsePublish(spec)
+			if err != nil {
+				return err
+			}
+			publish = append(publish, m)
+		}
+
+		limits := cgroup.Limits{CPUs: execCPUs, PIDs: execPIDsLimit, IOWeight: execIOWeight}
+		if execMemory != "" {
+			memory, err := cgroup.ParseMemory(execMemory)
+			if err != nil {
+				return err
+			}
+			limits.Memory = memory
+		}
+		if err := limits.Validate(); err != nil {
+			return err
+		}
+
+		if err := exec.CheckRootless(exec.Options{Network: execNetwork, Limits: limits}); err != nil {
+			return err
+		}
+		if err := exec.CheckNetwork(exec.Options{Network: execNetwork, Publish: publish}); err != nil {
+			return err
+		}
+		if err := cgroup.Check(limits); err != nil {
+			return err
+		}
+
+		secOpts := security.Options{Hardened: execHardened, CapAdd: execCapAdd, CapDrop: execCapDrop}
+		for _, opt := range execSecurityOpts {
+			if err := secOpts.ParseSecurityOpt(opt); err != nil {
+				return err
+			}
+		}
+		// Resolved again for every command, this catches bad capabilities and profiles early
+		if _, err := secOpts.Resolve(); err != nil {
+			return err
+		}
+
+		if err := exec.CheckDNS(exec.Options{Nameservers: nameservers, DNSSearch: execDNSSearch, DNSOptions: execDNSOptions}); err != nil {
+			return err
+		}
+		if execHostname != "" {
+			if err := exec.ValidateHostname(execHostname); err != nil {
+				return err
+			}
+		}
+		var extraHosts []exec.HostEntry
+		for _, spec := range execAddHosts {
+			h, err := exec.ParseHost(spec)
+			if err != nil {
+				return err
+			}
+			extraHosts = append(extraHosts, h)
+		}
+
+		// With --detach, qimi exec starts a supervisor running this same command
+		// line and returns, the supervisor does the actual work
+		var detachedID string
+		if execDetach {
+			if detachedID = supervisedSession(); detachedID == "" {
+				return startSupervisor()
+			}
 		}
 
 		target := args[0]
@@ -42,7 +137,7 @@ var execCmd = &cobra.Command{
 
 		mountInfo, err := store.GetMount(target)
 		var mountPoint string
-		var tempMount bool
+		var tempInfo *storage.MountInfo
 		var mounter *mount.Mounter
 
 		if err != nil {
@@ -58,11 +153,28 @@ var execCmd = &cobra.Command{
 					partitionNum = nbd.GetPartitionNumber(execPartition)
 				}
 
-				mountPoint, err = mounter.MountWithPartition(target, execReadOnly, partitionNum)
+				if err := checkImageConflict(store, target, execReadOnly || execStrict); err != nil {
+					return err
+				}
+
+				keyFile, passphrase, prompt := luksKeySource(execKeyFile)
+				tempInfo, err = mounter.MountImage(target, mount.Options{
+					ReadOnly:         execReadOnly,
+					Strict:           execStrict,
+					Partition:        partitionNum,
+					All:              execAll,
+					LV:               execLV,
+					KeyFile:          keyFile,
+					Passphrase:       passphrase,
+					PassphrasePrompt: prompt,
+					Subvol:           execSubvol,
+					MountOptions:     execMountOptions,
+					NTFSDriver:       execNTFSDriver,
+				})
 				if err != nil {
 					return fmt.Errorf("error mounting image: %w", err)
 				}
-				tempMount = true
+				mountPoint = tempInfo.MountPoint
 			} else {
 				return fmt.Errorf("error: %w", err)
 			}
@@ -72,30 +184,118 @@ var execCmd = &cobra.Command{
 
 		executor := exec.New()
 
+		// Interactive users are in charge of what they start, scripts installing
+		// packages should not leave daemons running on the host
+		if !cmd.Flags().Changed("no-services") {
+			execNoServices = !interactive
+		}
+		// Every command is registered as a session. Persistent mounts are shared
+		// between sessions: the first one sets up /proc, /sys, /dev and the
+		// replaced guest files, and the last one tears them down.
+		sessionMount := mountInfo
+		if tempInfo != nil {
+			sessionMount = tempInfo
+		}
+
+		execOpts := exec.Options{
+			Nameservers: nameservers,
+			DNSSearch:   execDNSSearch,
+			DNSOptions:  execDNSOptions,
+			NoServices:  execNoServices,
+			ReadOnly:    sessionMount.ReadOnly,
+			Network:     execNetwork,
+			Publish:     publish,
+			Hostname:    execHostname,
+			ExtraHosts:  extraHosts,
+			Limits:      limits,
+			Security:    secOpts,
+		}
+
+		session, err := newSession(sessionMount, tempInfo != nil, append([]string{command}, commandArgs...))
+		if err != nil {
+			if tempInfo != nil {
+				mounter.Unmount(tempInfo)
+			}
+			return fmt.Errorf("error creating session: %w", err)
+		}
+		if detachedID != "" {
+			session.ID = detachedID
+			session.Detached = true
+			session.TTY = ""
+		}
+
+		var prepareErr error
+		prepared := false
+		err = store.AcquireSession(session, func() error {
+			prepared = true
+			return executor.Prepare(mountPoint, execOpts)
+		})
+		if err != nil {
+			if tempInfo != nil {
+				mounter.Unmount(tempInfo)
+			}
+			return fmt.Errorf("error starting session: %w", err)
+		}
+		if tempInfo != nil {
+			prepareErr = executor.Prepare(mountPoint, execOpts)
+		} else if !prepared {
+			if len(nameservers) > 0 || len(execDNSSearch) > 0 || len(execDNSOptions) > 0 || len(extraHosts) > 0 || execHostname != "" {
+				// The hostname is still set in the command's own UTS namespace, and
+				// commands with a private network get their own resolv.conf
+				logger.Warn("%s is already in use by another session, the guest files for --nameserver, --dns-search, --dns-option, --hostname and --add-host are left as they are", target)
+			}
+			// Services started by this command would run on the host
+			if execNoServices && executor.ServicesAllowed(mountPoint) {
+				prepareErr = fmt.Errorf("%s is already in use by a session that allows services, which this command could start on the host; pass --no-services=false to run it anyway", target)
+			} else if !execNoServices && executor.ServicesDisabled(mountPoint) {
+				logger.Warn("%s is already in use by a session that disabled services, they stay disabled", target)
+			}
+		}
+
 		// Setup cleanup function
+		var integrityErr error
 		cleanup := func() {
-			// Clean up mount namespace first
-			if err := executor.CleanupMountNamespace(mountPoint); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to cleanup mount namespace: %v\n", err)
+			err := store.ReleaseSession(session.ID, func() error {
+				return executor.Teardown(mountPoint)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to end session: %v\n", err)
 			}
-			if err := executor.CleanupBackupFiles(mountPoint); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to cleanup backup files: %v\n", err)
+			if tempInfo == nil {
+				return
 			}
 
-			// If this was a temporary mount, unmount it
-			if tempMount && mounter != nil {
-				if err := mounter.Unmount(mountPoint); err != nil {
-					fmt.Fprintf(os.Stderr, "Warning: failed to unmount: %v\n", err)
-				}
+			// This was a temporary mount, clean up its mount namespace and unmount it
+			if err := executor.Teardown(mountPoint); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to cleanup mount namespace: %v\n", err)
+			}
+			if err := mounter.Unmount(tempInfo); errors.Is(err, mount.ErrImageModified) {
+				integrityErr = err
+			} else if errors.Is(err, mount.ErrMountBusy) {
+				fmt.Fprintf(os.Stderr, "Warning: %v\nProcesses started by the command are still using the image:\n", err)
+				printProcesses(process.FindUsing(mountPoint))
+				fmt.Fprintf(os.Stderr, "Stop them and run qimi cleanup to release the image\n")
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to unmount: %v\n", err)
 			}
 		}
 
 		// Execute the command
-		execErr := executor.Execute(mountPoint, command, commandArgs, interactive, tty, nameservers)
+		execErr := prepareErr
+		if execErr == nil && detachedID != "" {
+			execErr = runSupervised(executor, mountPoint, command, commandArgs, execOpts, detachedID)
+		} else if execErr == nil {
+			execErr = executor.Run(mountPoint, command, commandArgs, interactive, tty, execOpts)
+		}
 
 		// Always cleanup
 		cleanup()
 
+		// A modified image in strict read-only mode always fails the command
+		if integrityErr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", integrityErr)
+		}
+
 		// Return the execution error (cobra will handle the exit code)
 		if execErr != nil {
 			// check if it is exit status
@@ -107,6 +307,11 @@ var execCmd = &cobra.Command{
 				// If the command failed, return the error with exit code
 				return fmt.Errorf("command exited with code %d: %w", exitErr.ExitCode(), execErr)
 			}
+			return execErr
+		}
+
+		if integrityErr != nil {
+			os.Exit(1)
 		}
 
 		return nil
@@ -118,6 +323,29 @@ func init() {
 	execCmd.Flags().BoolVarP(&tty, "tty", "t", false, "Allocate a pseudo-TTY")
 	execCmd.Flags().BoolVar(&execReadOnly, "read-only", false, "Mount the image as read-only")
 	execCmd.Flags().StringSliceVar(&nameservers, "nameserver", nil, "Custom nameservers for resolv.conf (can be specified multiple times)")
+	execCmd.Flags().StringSliceVar(&execDNSSearch, "dns-search", nil, "Search domain for resolv.conf, replacing the host's (can be specified multiple times)")
+	execCmd.Flags().StringSliceVar(&execDNSOptions, "dns-option", nil, "Resolver option for resolv.conf, e.g. ndots:2 (can be specified multiple times)")
 	execCmd.Flags().StringVarP(&execPartition, "partition", "p", "", "Partition to mount (e.g., 1, p2, partition3)")
+	execCmd.Flags().BoolVar(&execAll, "all", false, "Also mount the filesystems listed in the guest's /etc/fstab (/boot, /home, ...)")
+	execCmd.Flags().StringVar(&execLV, "lv", "", "LVM logical volume to mount as vg/lv. If not specified, auto-detect the root volume")
+	execCmd.Flags().StringVar(&execKeyFile, "key-file", "", "Key file for LUKS encrypted partitions (\"-\" reads the key from stdin). If not specified, prompt for a passphrase")
+	execCmd.Flags().StringVar(&execSubvol, "subvol", "", "Btrfs subvolume to mount as root. If not specified, auto-detect the root subvolume")
+	execCmd.Flags().StringSliceVar(&execMountOptions, "mount-opt", nil, "Extra mount options for the root filesystem (can be specified multiple times)")
+	execCmd.Flags().StringVar(&execNTFSDriver, "ntfs-driver", "", "NTFS driver to use (ntfs3 or ntfs-3g). If not specified, use ntfs3 if available")
+	execCmd.Flags().BoolVar(&execNoServices, "no-services", false, "Keep package scripts from starting services: mount a policy-rc.d and no-op systemctl and start-stop-daemon over the guest's (default unless -i is given)")
+	execCmd.Flags().StringVar(&execNetwork, "network", exec.NetworkHost, "Network of the command: host, none (loopback only) or private (own network namespace with NAT through pasta or slirp4netns)")
+	execCmd.Flags().StringSliceVar(&execPublish, "publish", nil, "Forward a host port to the command as [host-ip:]host-port:port[/udp], needs --network private (can be specified multiple times)")
+	execCmd.Flags().StringVar(&execHostname, "hostname", "", "Hostname of the command, set in its own UTS namespace and written to /etc/hostname and /etc/hosts")
+	execCmd.Flags().StringSliceVar(&execAddHosts, "add-host", nil, "Add a name:ip entry to /etc/hosts (can be specified multiple times)")
+	execCmd.Flags().StringVar(&execMemory, "memory", "", "Memory limit of the command, e.g. 512m or 4g (needs cgroup v2)")
+	execCmd.Flags().Float64Var(&execCPUs, "cpus", 0, "Number of CPUs the command may use, e.g. 1.5 (needs cgroup v2)")
+	execCmd.Flags().Int64Var(&execPIDsLimit, "pids-limit", 0, "Maximum number of processes and threads of the command (needs cgroup v2)")
+	execCmd.Flags().IntVar(&execIOWeight, "io-weight", 0, "Relative I/O weight of the command from 1 to 10000, default 100 (needs cgroup v2)")
+	execCmd.Flags().BoolVar(&execHardened, "hardened", false, "Isolate the command with pivot_root, a minimal /dev and read-only /sys, drop capabilities to a default set, set no_new_privs and apply a default seccomp filter")
+	execCmd.Flags().StringSliceVar(&execCapAdd, "cap-add", nil, "Add a capability, e.g. SYS_PTRACE, or ALL (can be specified multiple times)")
+	execCmd.Flags().StringSliceVar(&execCapDrop, "cap-drop", nil, "Drop a capability, e.g. NET_RAW, or ALL (can be specified multiple times)")
+	execCmd.Flags().StringSliceVar(&execSecurityOpts, "security-opt", nil, "Security option: seccomp=PROFILE.json (OCI format), seccomp=unconfined or no-new-privileges[=false] (can be specified multiple times)")
+	execCmd.Flags().BoolVarP(&execDetach, "detach", "d", false, "Run the command in the background and print a session handle for qimi attach")
+	execCmd.Flags().BoolVar(&execStrict, "strict-read-only", false, "Mount read-only and verify that the image file is unchanged afterwards (implies --read-only)")
 	rootCmd.AddCommand(execCmd)
 }
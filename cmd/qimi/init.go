@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/packetstream-llc/qimi/internal/exec"
+	"github.com/spf13/cobra"
+)
+
+// initCmd is the helper exec runs commands that need namespaces through
+var initCmd = &cobra.Command{
+	Use:                exec.InitCommand,
+	Hidden:             true,
+	DisableFlagParsing: true,
+	// The helper runs inside the namespaces of a command, none of the usual checks apply
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := exec.Init(args); err != nil {
+			fmt.Fprintf(os.Stderr, "qimi: %v\n", err)
+			os.Exit(127)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/packetstream-llc/qimi/internal/process"
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var killSignal string
+
+var killCmd = &cobra.Command{
+	Use:   "kill [image-file|name|session]",
+	Short: "Signal the processes running inside an image",
+	Long: `Send a signal (SIGTERM by default) to every process running inside an image, that is
+every process whose root directory is the image's mount point. The image can be a
+persistent mount, or an image mounted temporarily by a running qimi exec.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := requireRoot(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		sig, err := process.ParseSignal(killSignal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		store, err := storage.New()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing storage: %v\n", err)
+			os.Exit(1)
+		}
+
+		mountPoints, err := killMountPoints(store, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var procs []process.Process
+		for _, mp := range mountPoints {
+			procs = append(procs, process.FindByRoot(mp)...)
+		}
+		if len(procs) == 0 {
+			fmt.Printf("No processes running in %s\n", args[0])
+			return
+		}
+
+		failed := process.Signal(procs, sig)
+		for _, p := range procs {
+			if err, ok := failed[p.PID]; ok {
+				fmt.Fprintf(os.Stderr, "Failed to signal %d (%s): %v\n", p.PID, p.Command, err)
+			} else {
+				fmt.Printf("Sent %s to %d (%s)\n", sig, p.PID, p.Command)
+			}
+		}
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// killMountPoints finds the mount points a target refers to: a persistent
+// mount by name, ID or image, or the mounts of running sessions by session
+// ID or image
+func killMountPoints(store *storage.Storage, target string) ([]string, error) {
+	if info, err := store.GetMount(target); err == nil {
+		return []string{info.MountPoint}, nil
+	}
+
+	imagePath, _ := filepath.Abs(target)
+	img, imgErr := storage.ResolveImage(target)
+
+	seen := make(map[string]bool)
+	var mountPoints []string
+	for _, s := range store.ListSessions() {
+		sameImage := s.ImagePath == imagePath
+		if !sameImage && imgErr == nil {
+			if other, err := storage.ResolveImage(s.ImagePath); err == nil {
+				sameImage = other.Dev == img.Dev && other.Inode == img.Inode
+			}
+		}
+		if (s.ID == target || sameImage) && !seen[s.MountPoint] {
+			seen[s.MountPoint] = true
+			mountPoints = append(mountPoints, s.MountPoint)
+		}
+	}
+
+	if len(mountPoints) == 0 {
+		return nil, fmt.Errorf("no mount or running session found for %s", target)
+	}
+	return mountPoints, nil
+}
+
+func init() {
+	killCmd.Flags().StringVarP(&killSignal, "signal", "s", "TERM", "Signal to send, by name (TERM, SIGKILL, ...) or number")
+	rootCmd.AddCommand(killCmd)
+}
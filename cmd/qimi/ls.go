@@ -28,8 +28,12 @@ var lsCmd = &cobra.Command{
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-		fmt.Fprintln(w, "NAME\tIMAGE\tMOUNT POINT\tREAD-ONLY\tSTATUS")
+		fmt.Fprintln(w, "ID\tNAME\tIMAGE\tMOUNT POINT\tREAD-ONLY\tSTATUS")
 		for _, m := range mounts {
+			id := m.ID
+			if id == "" {
+				id = "-"
+			}
 			name := m.Name
 			if name == "" {
 				name = "-"
@@ -42,7 +46,7 @@ var lsCmd = &cobra.Command{
 			if !store.IsValidMount(m) {
 				status = "stale"
 			}
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, m.ImagePath, m.MountPoint, readOnly, status)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", id, name, m.ImagePath, m.MountPoint, readOnly, status)
 		}
 		w.Flush()
 	},
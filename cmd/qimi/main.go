@@ -1,13 +1,20 @@
 package main
 
 import (
+	"errors"
+
+	"github.com/packetstream-llc/qimi/internal/config"
 	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/mount"
 	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 var (
 	logLevel string
+	rootDir  string
+	rootless bool
 )
 
 var rootCmd = &cobra.Command{
@@ -23,18 +30,37 @@ var rootCmd = &cobra.Command{
 			logger.SetLevel(level)
 		}
 
+		if err := config.Load(rootDir, rootless); err != nil {
+			logger.Fatal("%v", err)
+		}
+
 		// Check system dependencies before running any command
-		if err := nbd.CheckSystemDependencies(); err != nil {
-			logger.Fatal("system dependencies not met: %v\n\nRequired dependencies:\n- qemu-nbd (install qemu-utils package)\n- partprobe (install parted package)\n- nbd kernel module (modprobe nbd)", err)
+		if config.Current().Rootless {
+			if err := mount.CheckRootlessDependencies(); err != nil {
+				logger.Fatal("system dependencies not met: %v\n\nRequired dependencies without root:\n- qemu-storage-daemon with FUSE export support (install qemu-system-common or qemu-storage-daemon package)\n- fusermount3 (install fuse3 package)\n- blkid (install util-linux package)\n- fuse2fs (install fuse2fs or e2fsprogs package) or lklfuse (install lkl package) as filesystem driver", err)
+			}
+		} else if err := nbd.CheckSystemDependencies(); err != nil {
+			logger.Fatal("system dependencies not met: %v\n\nRequired dependencies:\n- qemu-nbd (install qemu-utils package)\n- partprobe (install parted package)\n- blkid (install util-linux package)\n- nbd kernel module (modprobe nbd)", err)
 		}
 		return nil
 	},
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "", "Directory for qimi's state, mount points and backups (default $QIMI_ROOT, or "+config.DefaultRoot+" and $XDG_RUNTIME_DIR/qimi in rootless mode)")
+	rootCmd.PersistentFlags().BoolVar(&rootless, "rootless", false, "Work without root, serving images through FUSE (default $"+config.RootlessEnv+")")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Set log level (debug, info, warn, error, fatal)")
 }
 
+// requireRoot fails for users other than root outside of rootless mode, whose
+// mounts are kept apart from root's
+func requireRoot() error {
+	if utils.IsRoot() || config.Current().Rootless {
+		return nil
+	}
+	return errors.New("this command requires root privileges. Please run with sudo, or use --rootless to work without root")
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		logger.Fatal("%v", err)
@@ -8,13 +8,19 @@ import (
 	"github.com/packetstream-llc/qimi/internal/mount"
 	"github.com/packetstream-llc/qimi/internal/nbd"
 	"github.com/packetstream-llc/qimi/internal/storage"
-	"github.com/packetstream-llc/qimi/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 var (
-	readOnly  bool
-	partition string
+	readOnly          bool
+	partition         string
+	mountAll          bool
+	mountLV           string
+	mountKeyFile      string
+	mountSubvol       string
+	mountMountOptions []string
+	mountNTFSDriver   string
+	mountStrict       bool
 )
 
 var mountCmd = &cobra.Command{
@@ -23,8 +29,8 @@ var mountCmd = &cobra.Command{
 	Long:  `Mount a QEMU image file (.qcow2, .qcow2c, .raw) with an optional name.`,
 	Args:  cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
-		if !utils.IsRoot() {
-			fmt.Fprintf(os.Stderr, "Error: This command requires root privileges. Please run with sudo.\n")
+		if err := requireRoot(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
@@ -51,20 +57,33 @@ var mountCmd = &cobra.Command{
 			partitionNum = nbd.GetPartitionNumber(partition)
 		}
 
-		mountPoint, err := mounter.MountWithPartition(imagePath, readOnly, partitionNum)
+		if err := checkImageConflict(store, imagePath, readOnly || mountStrict); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		keyFile, passphrase, prompt := luksKeySource(mountKeyFile)
+		mountInfo, err := mounter.MountImage(imagePath, mount.Options{
+			ReadOnly:         readOnly,
+			Strict:           mountStrict,
+			Partition:        partitionNum,
+			All:              mountAll,
+			LV:               mountLV,
+			KeyFile:          keyFile,
+			Passphrase:       passphrase,
+			PassphrasePrompt: prompt,
+			Subvol:           mountSubvol,
+			MountOptions:     mountMountOptions,
+			NTFSDriver:       mountNTFSDriver,
+		})
 		if err != nil {
 			logger.Fatal("Error mounting image: %v", err)
 		}
 
-		mountInfo := &storage.MountInfo{
-			ImagePath:  imagePath,
-			MountPoint: mountPoint,
-			Name:       name,
-			ReadOnly:   readOnly,
-		}
+		mountInfo.Name = name
 
 		if err := store.AddMount(mountInfo); err != nil {
-			mounter.Unmount(mountPoint)
+			mounter.Unmount(mountInfo)
 			logger.Fatal("Error saving mount info: %v", err)
 		}
 
@@ -72,12 +91,19 @@ var mountCmd = &cobra.Command{
 		if name != "" {
 			fmt.Printf(" as '%s'", name)
 		}
-		fmt.Printf(" at %s\n", mountPoint)
+		fmt.Printf(" at %s\n", mountInfo.MountPoint)
 	},
 }
 
 func init() {
 	mountCmd.Flags().BoolVar(&readOnly, "read-only", false, "Mount the image as read-only")
 	mountCmd.Flags().StringVarP(&partition, "partition", "p", "", "Specify partition number to mount (e.g., 1,2,3). If not specified, auto-detect best partition")
+	mountCmd.Flags().BoolVar(&mountAll, "all", false, "Also mount the filesystems listed in the guest's /etc/fstab (/boot, /home, ...)")
+	mountCmd.Flags().StringVar(&mountLV, "lv", "", "LVM logical volume to mount as vg/lv. If not specified, auto-detect the root volume")
+	mountCmd.Flags().StringVar(&mountKeyFile, "key-file", "", "Key file for LUKS encrypted partitions (\"-\" reads the key from stdin). If not specified, prompt for a passphrase")
+	mountCmd.Flags().StringVar(&mountSubvol, "subvol", "", "Btrfs subvolume to mount as root. If not specified, auto-detect the root subvolume")
+	mountCmd.Flags().StringSliceVar(&mountMountOptions, "mount-opt", nil, "Extra mount options for the root filesystem (can be specified multiple times)")
+	mountCmd.Flags().StringVar(&mountNTFSDriver, "ntfs-driver", "", "NTFS driver to use (ntfs3 or ntfs-3g). If not specified, use ntfs3 if available")
+	mountCmd.Flags().BoolVar(&mountStrict, "strict-read-only", false, "Mount read-only and verify on unmount that the image file is unchanged (implies --read-only)")
 	rootCmd.AddCommand(mountCmd)
 }
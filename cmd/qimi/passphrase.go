@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// luksKeySource returns the key file and passphrase callback for mount.Options,
+// and whether the callback prompts on a terminal. A key file of "-" reads the
+// key from stdin until EOF.
+func luksKeySource(keyFile string) (string, func(device string) ([]byte, error), bool) {
+	if keyFile != "-" {
+		return keyFile, readPassphrase, keyFile == "" && utils.IsTerminal(os.Stdin)
+	}
+
+	var key []byte
+	var keyErr error
+	read := false
+	return "", func(device string) ([]byte, error) {
+		if !read {
+			key, keyErr = io.ReadAll(os.Stdin)
+			read = true
+		}
+		return key, keyErr
+	}, false
+}
+
+// readPassphrase asks for the passphrase of an encrypted device. It prompts on the
+// terminal with echo disabled, or reads a line from stdin if stdin isn't a terminal.
+func readPassphrase(device string) ([]byte, error) {
+	if !utils.IsTerminal(os.Stdin) {
+		return utils.ReadLine(os.Stdin)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", device)
+	passphrase, err := utils.ReadPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
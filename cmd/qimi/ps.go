@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var psJSON bool
+
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "List running exec sessions",
+	Long:  `Show the commands currently running inside images through qimi exec.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := storage.New()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing storage: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Sessions of qimi processes that were killed are dropped here
+		if err := store.PruneSessions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to prune stale sessions: %v\n", err)
+		}
+
+		sessions := store.ListSessions()
+
+		if psJSON {
+			if sessions == nil {
+				sessions = []*storage.Session{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(sessions); err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding sessions: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if len(sessions) == 0 {
+			fmt.Println("No running sessions")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "SESSION\tPID\tMOUNT\tIMAGE\tUSER\tTTY\tSTARTED\tCOMMAND")
+		for _, s := range sessions {
+			mountName := s.Name
+			if s.Temporary {
+				mountName = "(temporary)"
+			} else if mountName == "" {
+				mountName = s.MountID
+			}
+			user := s.User
+			if user == "" {
+				user = fmt.Sprint(s.UID)
+			}
+			tty := s.TTY
+			if s.Detached {
+				tty = "(detached)"
+			} else if tty == "" {
+				tty = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.PID, mountName, s.ImagePath, user, tty,
+				formatAge(time.Since(s.StartedAt)), strings.Join(s.Command, " "))
+		}
+		w.Flush()
+	},
+}
+
+// formatAge prints how long ago a session started, e.g. "42s ago" or "3h ago"
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+func init() {
+	psCmd.Flags().BoolVar(&psJSON, "json", false, "Print the sessions as JSON")
+	rootCmd.AddCommand(psCmd)
+}
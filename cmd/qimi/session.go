@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/process"
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// newSession describes a command about to run in a mount
+func newSession(info *storage.MountInfo, temporary bool, command []string) (*storage.Session, error) {
+	id, err := utils.RandomID(8)
+	if err != nil {
+		return nil, err
+	}
+
+	uid := utils.InvokingUID()
+	session := &storage.Session{
+		ID:         id,
+		MountID:    info.ID,
+		Name:       info.Name,
+		ImagePath:  info.ImagePath,
+		MountPoint: info.MountPoint,
+		Temporary:  temporary,
+		Command:    command,
+		PID:        os.Getpid(),
+		StartedAt:  time.Now(),
+		UID:        uid,
+	}
+	if start, err := process.StartTime(session.PID); err == nil {
+		session.PIDStartTime = start
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		session.User = u.Username
+	}
+	if utils.IsTerminal(os.Stdin) {
+		if tty, err := os.Readlink("/proc/self/fd/0"); err == nil {
+			session.TTY = tty
+		}
+	}
+	return session, nil
+}
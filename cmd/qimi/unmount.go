@@ -1,23 +1,35 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/packetstream-llc/qimi/internal/exec"
+	"github.com/packetstream-llc/qimi/internal/logger"
 	"github.com/packetstream-llc/qimi/internal/mount"
+	"github.com/packetstream-llc/qimi/internal/process"
 	"github.com/packetstream-llc/qimi/internal/storage"
-	"github.com/packetstream-llc/qimi/internal/utils"
 	"github.com/spf13/cobra"
 )
 
+var (
+	unmountForce bool
+	unmountKill  bool
+)
+
+// killTimeout is how long processes get to exit after SIGTERM before they are killed
+const killTimeout = 5 * time.Second
+
 var unmountCmd = &cobra.Command{
 	Use:   "unmount [image-file|name]",
 	Short: "Unmount a QEMU image",
-	Long:  `Unmount a QEMU image by its file path or name.`,
+	Long:  `Unmount a QEMU image by its file path, name or mount ID (see qimi ls).`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if !utils.IsRoot() {
-			fmt.Fprintf(os.Stderr, "Error: This command requires root privileges. Please run with sudo.\n")
+		if err := requireRoot(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
@@ -35,14 +47,60 @@ var unmountCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if sessions := store.MountSessions(mountInfo); len(sessions) > 0 {
+			if !unmountForce {
+				fmt.Fprintf(os.Stderr, "Error: %s is in use by %d exec session(s) (PID", target, len(sessions))
+				for _, s := range sessions {
+					fmt.Fprintf(os.Stderr, " %d", s.PID)
+				}
+				fmt.Fprintf(os.Stderr, "), wait for them to finish or use --force\n")
+				os.Exit(1)
+			}
+			logger.Warn("unmounting %s while %d exec session(s) are still running", target, len(sessions))
+		}
+
 		mounter, err := mount.New()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error initializing mounter: %v\n", err)
 			os.Exit(1)
 		}
 
-		if err := mounter.Unmount(mountInfo.MountPoint); err != nil {
-			fmt.Fprintf(os.Stderr, "Error unmounting: %v\n", err)
+		// Daemons started inside the image, e.g. by package scripts, keep the filesystem busy
+		if procs := process.FindUsing(mountInfo.MountPoint); len(procs) > 0 {
+			if !unmountKill {
+				fmt.Fprintf(os.Stderr, "Error: %s is busy, %d process(es) are using it:\n", target, len(procs))
+				printProcesses(procs)
+				fmt.Fprintf(os.Stderr, "Stop them or use --kill to terminate them\n")
+				os.Exit(1)
+			}
+
+			fmt.Printf("Terminating %d process(es) using %s:\n", len(procs), target)
+			printProcesses(procs)
+			if remaining := process.Terminate(procs, killTimeout); len(remaining) > 0 {
+				fmt.Fprintf(os.Stderr, "Error: %d process(es) did not exit:\n", len(remaining))
+				printProcesses(remaining)
+				os.Exit(1)
+			}
+		}
+
+		// Sessions that were killed or forced out leave /proc, /sys, /dev and replaced guest files behind
+		if err := exec.New().Teardown(mountInfo.MountPoint); err != nil {
+			logger.Warn("failed to cleanup mount namespace: %v", err)
+		}
+
+		// A modified image is reported after the mount is gone, so the entry is still removed
+		unmountErr := mounter.Unmount(mountInfo)
+		if errors.Is(unmountErr, mount.ErrMountBusy) {
+			fmt.Fprintf(os.Stderr, "Error unmounting: %v\n", unmountErr)
+			if procs := process.FindUsing(mountInfo.MountPoint); len(procs) > 0 {
+				fmt.Fprintf(os.Stderr, "Processes using it:\n")
+				printProcesses(procs)
+				fmt.Fprintf(os.Stderr, "Stop them or use --kill to terminate them\n")
+			}
+			os.Exit(1)
+		}
+		if unmountErr != nil && !errors.Is(unmountErr, mount.ErrImageModified) {
+			fmt.Fprintf(os.Stderr, "Error unmounting: %v\n", unmountErr)
 			os.Exit(1)
 		}
 
@@ -51,10 +109,24 @@ var unmountCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if unmountErr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", unmountErr)
+			os.Exit(1)
+		}
+
 		fmt.Printf("Successfully unmounted %s\n", target)
 	},
 }
 
+// printProcesses lists processes and how they use a mount on stderr
+func printProcesses(procs []process.Process) {
+	for _, p := range procs {
+		fmt.Fprintf(os.Stderr, "  %d %s (%s)\n", p.PID, p.Command, p.Reason)
+	}
+}
+
 func init() {
+	unmountCmd.Flags().BoolVar(&unmountForce, "force", false, "Unmount even while exec sessions are using the mount")
+	unmountCmd.Flags().BoolVar(&unmountKill, "kill", false, "Terminate processes using the mount (SIGTERM, then SIGKILL) before unmounting")
 	rootCmd.AddCommand(unmountCmd)
 }
@@ -0,0 +1,146 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrDetached is returned by Run when the user detached with the detach keys
+var ErrDetached = errors.New("detached from session")
+
+// DetachKeys end an attachment to a session with a terminal without stopping it
+var DetachKeys = []byte{0x10, 0x11} // Ctrl-P Ctrl-Q
+
+// Client is an attachment to a detached session
+type Client struct {
+	conn net.Conn
+	// Terminal is set when the session's command runs on a terminal
+	Terminal bool
+	// Interactive is set when the session's command reads input
+	Interactive bool
+	writeMu     sync.Mutex
+}
+
+// Dial attaches to the session whose socket is at path
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, payload, err := readFrame(conn)
+	if err != nil || typ != frameHello || len(payload) != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("session did not answer: %v", err)
+	}
+
+	return &Client{
+		conn:        conn,
+		Terminal:    payload[0]&flagTerminal != 0,
+		Interactive: payload[0]&flagInteractive != 0,
+	}, nil
+}
+
+func (c *Client) send(typ byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeFrame(c.conn, typ, payload)
+}
+
+// Resize tells the session the size of the client's terminal
+func (c *Client) Resize(rows, cols uint16) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload, rows)
+	binary.BigEndian.PutUint16(payload[2:], cols)
+	return c.send(frameResize, payload)
+}
+
+// Run relays stdio until the session's command exits and returns its exit
+// code. Input is only read from stdin for sessions with a terminal or
+// interactive sessions. On a terminal the detach keys end the attachment
+// with ErrDetached and leave the command running.
+func (c *Client) Run(stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	detached := make(chan struct{})
+	if c.Terminal || c.Interactive {
+		go c.forwardInput(stdin, detached)
+	}
+
+	for {
+		typ, payload, err := readFrame(c.conn)
+		if err != nil {
+			select {
+			case <-detached:
+				return 0, ErrDetached
+			default:
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return 0, errors.New("session ended without reporting an exit code")
+			}
+			return 0, err
+		}
+
+		switch typ {
+		case frameStdout:
+			stdout.Write(payload)
+		case frameStderr:
+			stderr.Write(payload)
+		case frameExit:
+			if len(payload) != 4 {
+				return 0, errors.New("invalid exit frame")
+			}
+			return int(int32(binary.BigEndian.Uint32(payload))), nil
+		}
+	}
+}
+
+// forwardInput sends stdin to the session, watching for the detach keys on
+// a terminal. It closes the connection when the user detaches.
+func (c *Client) forwardInput(stdin io.Reader, detached chan struct{}) {
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			data := append(pending, buf[:n]...)
+			pending = nil
+
+			if c.Terminal {
+				if i := bytes.Index(data, DetachKeys); i >= 0 {
+					if i > 0 && c.Interactive {
+						c.send(frameStdin, data[:i])
+					}
+					close(detached)
+					c.conn.Close()
+					return
+				}
+				// Hold back a trailing first detach key until the next read
+				if data[len(data)-1] == DetachKeys[0] {
+					pending = []byte{DetachKeys[0]}
+					data = data[:len(data)-1]
+				}
+			}
+
+			if len(data) > 0 && c.Interactive {
+				if c.send(frameStdin, data) != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			if c.Interactive {
+				c.send(frameCloseStdin, nil)
+			}
+			return
+		}
+	}
+}
+
+// Close ends the attachment without affecting the session
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
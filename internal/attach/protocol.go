@@ -0,0 +1,58 @@
+package attach
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Frames exchanged between a session supervisor and an attached client. Every
+// frame is a type byte and a big-endian uint32 payload length followed by the
+// payload.
+const (
+	// frameHello is sent by the supervisor on connect, its payload holds the session flags
+	frameHello byte = iota + 1
+	frameStdin
+	frameStdout
+	frameStderr
+	// frameCloseStdin tells the supervisor the client reached the end of its input
+	frameCloseStdin
+	// frameResize carries the client's terminal size as two uint16, rows then columns
+	frameResize
+	// frameExit carries the command's exit code as an int32
+	frameExit
+)
+
+// Session flags of the hello frame
+const (
+	flagTerminal byte = 1 << iota
+	flagInteractive
+)
+
+// maxPayload bounds the frames a peer may send
+const maxPayload = 1 << 20
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	header := make([]byte, 5, 5+len(payload))
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxPayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, maxPayload)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
@@ -0,0 +1,210 @@
+package attach
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// historySize is how much recent output is replayed to a client that attaches
+const historySize = 64 * 1024
+
+// Server is the supervisor side of a detached session. It keeps the recent
+// output of the command and relays stdio to at most one attached client.
+type Server struct {
+	listener    net.Listener
+	path        string
+	flags       byte
+	resize      func(rows, cols uint16)
+	mu          sync.Mutex
+	client      net.Conn
+	history     []byte
+	stdinMu     sync.Mutex
+	stdin       io.WriteCloser
+	stdinClosed bool
+}
+
+// Listen creates the socket of a session at path. stdin receives the input of
+// attached clients and may be nil if the session is not interactive, resize
+// is called with the client's terminal size and may be nil if the session has
+// no terminal.
+func Listen(path string, terminal bool, stdin io.WriteCloser, resize func(rows, cols uint16)) (*Server, error) {
+	// A socket left behind by a supervisor that was killed would make listening fail
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &Server{listener: listener, path: path, stdin: stdin, resize: resize}
+	if terminal {
+		s.flags |= flagTerminal
+	}
+	if stdin != nil {
+		s.flags |= flagInteractive
+	}
+	return s, nil
+}
+
+// Serve accepts clients until the server is closed. A new client replaces
+// the one attached before it.
+func (s *Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("failed to accept session client: %v", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	s.mu.Lock()
+	if s.client != nil {
+		logger.Debug("replacing attached client")
+		s.client.Close()
+	}
+	// The output the client missed is replayed before anything new is relayed
+	err := writeFrame(conn, frameHello, []byte{s.flags})
+	if err == nil && len(s.history) > 0 {
+		err = writeFrame(conn, frameStdout, s.history)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.client = conn
+	s.mu.Unlock()
+
+	defer s.detach(conn)
+
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case frameStdin:
+			s.writeStdin(payload)
+		case frameCloseStdin:
+			s.closeStdin()
+		case frameResize:
+			if s.resize != nil && len(payload) == 4 {
+				s.resize(binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]))
+			}
+		default:
+			logger.Debug("ignoring unexpected frame type %d from client", typ)
+		}
+	}
+}
+
+// writeStdin passes input to the command. It has its own lock, so a command
+// that does not read its input cannot stop output from being relayed.
+func (s *Server) writeStdin(p []byte) {
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+
+	if s.stdin == nil || s.stdinClosed {
+		return
+	}
+	if _, err := s.stdin.Write(p); err != nil {
+		logger.Debug("failed to write to session stdin: %v", err)
+	}
+}
+
+func (s *Server) closeStdin() {
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+
+	if s.stdin != nil && !s.stdinClosed {
+		s.stdinClosed = true
+		s.stdin.Close()
+	}
+}
+
+func (s *Server) detach(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn.Close()
+	if s.client == conn {
+		s.client = nil
+	}
+}
+
+// Stdout returns a writer for the command's standard output
+func (s *Server) Stdout() io.Writer {
+	return &output{server: s, typ: frameStdout}
+}
+
+// Stderr returns a writer for the command's standard error
+func (s *Server) Stderr() io.Writer {
+	return &output{server: s, typ: frameStderr}
+}
+
+type output struct {
+	server *Server
+	typ    byte
+}
+
+// Write never fails, output nobody is attached for only goes into the history
+func (o *output) Write(p []byte) (int, error) {
+	s := o.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = append(s.history, p...)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+
+	if s.client != nil {
+		if err := writeFrame(s.client, o.typ, p); err != nil {
+			logger.Debug("client went away: %v", err)
+			s.client.Close()
+			s.client = nil
+		}
+	}
+	return len(p), nil
+}
+
+// Exit reports the command's exit code to the attached client and closes the server
+func (s *Server) Exit(code int) {
+	s.mu.Lock()
+	if s.client != nil {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(int32(code)))
+		writeFrame(s.client, frameExit, payload)
+	}
+	s.mu.Unlock()
+
+	s.Close()
+}
+
+// Close stops accepting clients, disconnects the attached one and removes the socket
+func (s *Server) Close() {
+	s.listener.Close()
+	os.Remove(s.path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
@@ -0,0 +1,71 @@
+package btrfs
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TopLevelID is the ID of the top-level subvolume (FS_TREE)
+const TopLevelID = 5
+
+// Subvolume is a btrfs subvolume
+type Subvolume struct {
+	ID int
+	// Path is relative to the top-level subvolume
+	Path string
+}
+
+// subvolumeLine matches the output of `btrfs subvolume list` and `btrfs subvolume get-default`
+var subvolumeLine = regexp.MustCompile(`^ID (\d+) .*path (.+)$`)
+
+// Available reports whether btrfs-progs is installed
+func Available() bool {
+	_, err := exec.LookPath("btrfs")
+	return err == nil
+}
+
+// List returns the subvolumes of the btrfs filesystem mounted at mountPoint
+func List(mountPoint string) ([]Subvolume, error) {
+	output, err := exec.Command("btrfs", "subvolume", "list", mountPoint).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subvolumes of %s: %w", mountPoint, err)
+	}
+
+	var subvolumes []Subvolume
+	for _, line := range strings.Split(string(output), "\n") {
+		if sv, ok := parseSubvolume(line); ok {
+			subvolumes = append(subvolumes, sv)
+		}
+	}
+	return subvolumes, nil
+}
+
+// Default returns the default subvolume of the btrfs filesystem mounted at mountPoint.
+// The top-level subvolume is returned with an empty path.
+func Default(mountPoint string) (Subvolume, error) {
+	output, err := exec.Command("btrfs", "subvolume", "get-default", mountPoint).Output()
+	if err != nil {
+		return Subvolume{}, fmt.Errorf("failed to get default subvolume of %s: %w", mountPoint, err)
+	}
+
+	line := strings.TrimSpace(string(output))
+	if sv, ok := parseSubvolume(line); ok {
+		return sv, nil
+	}
+	if strings.HasPrefix(line, fmt.Sprintf("ID %d ", TopLevelID)) {
+		return Subvolume{ID: TopLevelID}, nil
+	}
+	return Subvolume{}, fmt.Errorf("unexpected output from btrfs subvolume get-default: %s", line)
+}
+
+func parseSubvolume(line string) (Subvolume, bool) {
+	m := subvolumeLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return Subvolume{}, false
+	}
+	id, _ := strconv.Atoi(m[1])
+	return Subvolume{ID: id, Path: strings.TrimPrefix(m[2], "<FS_TREE>/")}, true
+}
@@ -0,0 +1,504 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/mountinfo"
+)
+
+// parentName is the cgroup below the cgroup of qimi that holds the cgroups of commands
+const parentName = "qimi"
+
+// cpuPeriod is the period of the CPU bandwidth limit in microseconds
+const cpuPeriod = 100000
+
+// Limits are the resource limits of a command, zero means unlimited
+type Limits struct {
+	// Memory is the memory limit in bytes
+	Memory int64
+	// CPUs is the number of CPUs the command may use, like 1.5
+	CPUs float64
+	// PIDs is the maximum number of processes and threads
+	PIDs int64
+	// IOWeight is the relative I/O weight from 1 to 10000, 100 is the default
+	IOWeight int
+}
+
+// IsZero reports whether no limit is set
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Validate checks that the limits are in range
+func (l Limits) Validate() error {
+	if l.Memory < 0 {
+		return errors.New("memory limit must not be negative")
+	}
+	if l.CPUs < 0 {
+		return errors.New("CPU limit must not be negative")
+	}
+	if l.CPUs > 0 && l.CPUs*cpuPeriod < 1000 {
+		return errors.New("CPU limit must be at least 0.01")
+	}
+	if l.PIDs < 0 {
+		return errors.New("process limit must not be negative")
+	}
+	if l.IOWeight != 0 && (l.IOWeight < 1 || l.IOWeight > 10000) {
+		return errors.New("I/O weight must be between 1 and 10000")
+	}
+	return nil
+}
+
+// controllers returns the cgroup controllers the limits need
+func (l Limits) controllers() []string {
+	var controllers []string
+	if l.Memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.PIDs > 0 {
+		controllers = append(controllers, "pids")
+	}
+	if l.IOWeight > 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+// ParseMemory parses a memory size in bytes or with a k, m, g or t suffix,
+// like 512m or 2G
+func ParseMemory(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	multiplier := int64(1)
+	if value != "" {
+		if i := strings.IndexByte("kmgt", value[len(value)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			value = value[:len(value)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// Root returns where the cgroup2 hierarchy is mounted
+func Root() (string, error) {
+	entries, err := mountinfo.Read()
+	if err != nil {
+		return "", err
+	}
+
+	root := ""
+	for _, e := range entries {
+		if e.FSType != "cgroup2" {
+			continue
+		}
+		if e.MountPoint == "/sys/fs/cgroup" {
+			return e.MountPoint, nil
+		}
+		if root == "" {
+			root = e.MountPoint
+		}
+	}
+	if root == "" {
+		return "", errors.New("cgroup v2 is not mounted")
+	}
+	return root, nil
+}
+
+// Own returns the cgroup qimi runs in, as read from /proc/self/cgroup. On
+// systemd hosts this is the unit qimi was started in, which is only fit for
+// limits when it is delegated to qimi.
+func Own() (string, error) {
+	root, err := Root()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The cgroup2 hierarchy is the one with ID 0 and no controllers
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(root, path), nil
+		}
+	}
+	return "", errors.New("qimi is not in a cgroup v2 hierarchy")
+}
+
+// Check reports whether the limits can be enforced on this host
+func Check(limits Limits) error {
+	if limits.IsZero() {
+		return nil
+	}
+	own, err := Own()
+	if err != nil {
+		return fmt.Errorf("resource limits need cgroup v2: %w", err)
+	}
+	available, err := readControllers(filepath.Join(own, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	for _, controller := range limits.controllers() {
+		if !slices.Contains(available, controller) {
+			return fmt.Errorf("the %s controller is not available in cgroup %s", controller, own)
+		}
+	}
+	return nil
+}
+
+// Cgroup is the cgroup a command runs in
+type Cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// New creates a cgroup for a command with the given limits, below the cgroup
+// qimi runs in. Memory accounting is turned on when the kernel offers it,
+// even without a limit.
+func New(name string, limits Limits) (*Cgroup, error) {
+	own, err := Own()
+	if err != nil {
+		return nil, err
+	}
+
+	parent := filepath.Join(own, parentName)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+	}
+
+	available, err := readControllers(filepath.Join(own, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	needed := limits.controllers()
+	for _, controller := range needed {
+		if !slices.Contains(available, controller) {
+			return nil, fmt.Errorf("the %s controller is not available in cgroup %s", controller, own)
+		}
+	}
+	if !slices.Contains(needed, "memory") && slices.Contains(available, "memory") {
+		needed = append(needed, "memory")
+	}
+
+	// Commands run below the parent, which itself never holds processes, so
+	// controllers can be turned on for it. The cgroup of qimi can only pass
+	// them on once qimi has moved out of it.
+	for _, controller := range needed {
+		for _, dir := range []string{own, parent} {
+			err := enableController(dir, controller)
+			if errors.Is(err, syscall.EBUSY) && dir == own {
+				if err = leave(own, name); err == nil {
+					err = enableController(dir, controller)
+				}
+			}
+			if err != nil {
+				if slices.Contains(limits.controllers(), controller) {
+					return nil, fmt.Errorf("failed to enable the %s controller in %s: %w", controller, dir, err)
+				}
+				logger.Debug("failed to enable %s controller in %s: %v", controller, dir, err)
+				break
+			}
+		}
+	}
+
+	path := filepath.Join(parent, name)
+	logger.Debug("creating cgroup %s", path)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", path, err)
+	}
+	c := &Cgroup{path: path}
+
+	if err := c.setLimits(limits); err != nil {
+		c.Remove()
+		return nil, err
+	}
+
+	if c.dir, err = os.Open(path); err != nil {
+		c.Remove()
+		return nil, err
+	}
+	return c, nil
+}
+
+// leave moves qimi out of its own cgroup into a leaf below the parent, which
+// a cgroup must be free of processes for its children to get controllers.
+// That is only done when qimi has the cgroup to itself, as with a delegated
+// systemd scope, since other processes are not qimi's to move.
+func leave(own, name string) error {
+	procs, err := readControllers(filepath.Join(own, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	if len(procs) != 1 || procs[0] != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("cgroup %s holds other processes than qimi, run qimi in a cgroup of its own, like with systemd-run --scope -p Delegate=yes", own)
+	}
+
+	leaf := filepath.Join(own, parentName, name+".qimi")
+	logger.Debug("moving qimi into cgroup %s", leaf)
+	if err := os.Mkdir(leaf, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %w", leaf, err)
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		os.Remove(leaf)
+		return fmt.Errorf("failed to move qimi into cgroup %s: %w", leaf, err)
+	}
+	return nil
+}
+
+func readControllers(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// enableController makes a controller available to the children of dir
+func enableController(dir string, controller string) error {
+	enabled, err := readControllers(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	if slices.Contains(enabled, controller) {
+		return nil
+	}
+	logger.Debug("enabling %s controller in %s", controller, dir)
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+}
+
+func (c *Cgroup) setLimits(limits Limits) error {
+	var settings [][2]string
+	if limits.Memory > 0 {
+		settings = append(settings, [2]string{"memory.max", strconv.FormatInt(limits.Memory, 10)})
+		// Swapping out would only make a runaway command slower, not stop it
+		if _, err := os.Stat(filepath.Join(c.path, "memory.swap.max")); err == nil {
+			settings = append(settings, [2]string{"memory.swap.max", "0"})
+		}
+	}
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriod)
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)})
+	}
+	if limits.PIDs > 0 {
+		settings = append(settings, [2]string{"pids.max", strconv.FormatInt(limits.PIDs, 10)})
+	}
+	if limits.IOWeight > 0 {
+		settings = append(settings, [2]string{"io.weight", fmt.Sprintf("default %d", limits.IOWeight)})
+	}
+
+	for _, s := range settings {
+		logger.Debug("setting %s to %s in %s", s[0], s[1], c.path)
+		if err := os.WriteFile(filepath.Join(c.path, s[0]), []byte(s[1]), 0644); err != nil {
+			return fmt.Errorf("failed to set %s: %w", s[0], err)
+		}
+	}
+	return nil
+}
+
+// Path returns the directory of the cgroup
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// FD returns a descriptor of the cgroup directory, to start processes in it
+// with SysProcAttr.CgroupFD
+func (c *Cgroup) FD() int {
+	return int(c.dir.Fd())
+}
+
+// Usage is the resource usage of the processes of a cgroup
+type Usage struct {
+	// MemoryPeak is the highest memory usage in bytes, 0 without memory accounting
+	MemoryPeak int64
+	// OOMKills counts the processes killed for exceeding the memory limit
+	OOMKills int64
+	// CPUUser and CPUSystem are the CPU time spent in user and kernel mode
+	CPUUser   time.Duration
+	CPUSystem time.Duration
+}
+
+func (u Usage) String() string {
+	cpu := (u.CPUUser + u.CPUSystem).Round(time.Millisecond)
+	s := fmt.Sprintf("CPU time %s (user %s, system %s)", cpu, u.CPUUser.Round(time.Millisecond), u.CPUSystem.Round(time.Millisecond))
+	if u.MemoryPeak > 0 {
+		s = fmt.Sprintf("peak memory %s, %s", formatBytes(u.MemoryPeak), s)
+	}
+	return s
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Usage returns the resource usage of the cgroup so far
+func (c *Cgroup) Usage() (Usage, error) {
+	var u Usage
+
+	cpu, err := readKeyed(filepath.Join(c.path, "cpu.stat"))
+	if err != nil {
+		return u, err
+	}
+	u.CPUUser = time.Duration(cpu["user_usec"]) * time.Microsecond
+	u.CPUSystem = time.Duration(cpu["system_usec"]) * time.Microsecond
+
+	// Only there with the memory controller, memory.peak since Linux 5.19
+	if data, err := os.ReadFile(filepath.Join(c.path, "memory.peak")); err == nil {
+		u.MemoryPeak, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if events, err := readKeyed(filepath.Join(c.path, "memory.events")); err == nil {
+		u.OOMKills = events["oom_kill"]
+	}
+	return u, nil
+}
+
+// readKeyed reads a cgroup file of "key value" lines
+func readKeyed(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[fields[0]] = n
+		}
+	}
+	return values, scanner.Err()
+}
+
+// Kill kills every process in the cgroup and waits for them to exit
+func (c *Cgroup) Kill(timeout time.Duration) error {
+	logger.Debug("killing processes in cgroup %s", c.path)
+	if err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644); err != nil {
+		// cgroup.kill needs Linux 5.14, signal the processes one by one before that
+		logger.Debug("cgroup.kill failed, killing processes one by one: %v", err)
+		if err := c.killProcs(); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		populated, err := c.populated()
+		if err != nil || !populated {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("processes in cgroup %s did not exit", c.path)
+		}
+		// Processes forked while others were killed are caught on the next round
+		c.killProcs()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *Cgroup) killProcs() error {
+	data, err := os.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// populated reports whether processes are left in the cgroup
+func (c *Cgroup) populated() (bool, error) {
+	return populated(c.path)
+}
+
+func populated(path string) (bool, error) {
+	events, err := readKeyed(filepath.Join(path, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	return events["populated"] == 1, nil
+}
+
+// Remove removes the cgroup, which must have no processes left
+func (c *Cgroup) Remove() error {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	logger.Debug("removing cgroup %s", c.path)
+	// The kernel may still be tearing down the last processes
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %s: %w", c.path, err)
+}
+
+// Stale returns the cgroups of commands that no longer have processes,
+// left behind by qimi processes that crashed. qimi creates them below the
+// cgroup it runs in, which differs between runs, so the whole hierarchy is
+// searched.
+func Stale() []string {
+	root, err := Root()
+	if err != nil {
+		return nil
+	}
+
+	var stale []string
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || d.Name() != parentName {
+			return nil
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return filepath.SkipDir
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			child := filepath.Join(path, e.Name())
+			if busy, err := populated(child); err == nil && !busy {
+				stale = append(stale, child)
+			}
+		}
+		// Cgroups of commands may have their own, which are not qimi's
+		return filepath.SkipDir
+	})
+	return stale
+}
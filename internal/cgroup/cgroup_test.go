@@ -0,0 +1,94 @@
+package cgroup
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"1048576", 1 << 20},
+		{"512k", 512 << 10},
+		{"512m", 512 << 20},
+		{"2G", 2 << 30},
+		{"2gb", 2 << 30},
+		{"1.5g", 3 << 29},
+		{"1t", 1 << 40},
+		{" 64M ", 64 << 20},
+	}
+	for _, tt := range tests {
+		got, err := ParseMemory(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "m", "0", "-1g", "lots", "5x", "1p"} {
+		if got, err := ParseMemory(in); err == nil {
+			t.Errorf("ParseMemory(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []Limits{
+		{},
+		{Memory: 1 << 20, CPUs: 0.01, PIDs: 1, IOWeight: 1},
+		{CPUs: 64, IOWeight: 10000},
+	}
+	for _, l := range valid {
+		if err := l.Validate(); err != nil {
+			t.Errorf("%+v: %v", l, err)
+		}
+	}
+
+	invalid := []Limits{
+		{Memory: -1},
+		{CPUs: -1},
+		{CPUs: 0.005},
+		{PIDs: -1},
+		{IOWeight: -1},
+		{IOWeight: 10001},
+	}
+	for _, l := range invalid {
+		if err := l.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", l)
+		}
+	}
+}
+
+func TestControllers(t *testing.T) {
+	if got := (Limits{}).controllers(); len(got) != 0 {
+		t.Errorf("no limits: got controllers %v", got)
+	}
+	got := Limits{Memory: 1 << 20, PIDs: 10}.controllers()
+	if want := []string{"memory", "pids"}; !slices.Equal(got, want) {
+		t.Errorf("got controllers %v, want %v", got, want)
+	}
+	got = Limits{Memory: 1, CPUs: 1, PIDs: 1, IOWeight: 1}.controllers()
+	if want := []string{"memory", "cpu", "pids", "io"}; !slices.Equal(got, want) {
+		t.Errorf("got controllers %v, want %v", got, want)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{512 << 20, "512.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.in); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
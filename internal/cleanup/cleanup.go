@@ -0,0 +1,556 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/cgroup"
+	"github.com/packetstream-llc/qimi/internal/config"
+	qimiexec "github.com/packetstream-llc/qimi/internal/exec"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/mount"
+	"github.com/packetstream-llc/qimi/internal/mountinfo"
+	"github.com/packetstream-llc/qimi/internal/process"
+	"github.com/packetstream-llc/qimi/internal/storage"
+)
+
+// Action is a single repair step of a cleanup plan
+type Action struct {
+	Description string
+	apply       func() error
+}
+
+// Plan lists the repairs needed to bring the host back in line with the state
+type Plan struct {
+	Actions []Action
+	// Skipped explains what looked stale but was left alone
+	Skipped []string
+}
+
+// Apply runs the actions in order. A failed action does not stop the ones
+// after it; report is called after every action.
+func (p *Plan) Apply(report func(a Action, err error)) error {
+	var errs []error
+	for _, a := range p.Actions {
+		err := a.apply()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Description, err))
+		}
+		if report != nil {
+			report(a, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type builder struct {
+	plan     *Plan
+	store    *storage.Storage
+	mounter  *mount.Mounter
+	executor *qimiexec.Executor
+	mounts   []mountinfo.Entry
+	// handled holds the mount directories that are either in use or planned for removal
+	handled map[string]bool
+	// inUse holds the NBD devices of active mounts, which must never be disconnected
+	inUse map[string]bool
+}
+
+// Build works out what is left over from crashed commands and reboots by
+// comparing the state with /proc/self/mountinfo, the NBD devices in sysfs and
+// the runtime directory, as well as the legacy one of older versions.
+// Nothing is changed until the plan is applied.
+func Build(store *storage.Storage, mounter *mount.Mounter) (*Plan, error) {
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	b := &builder{
+		plan:     &Plan{},
+		store:    store,
+		mounter:  mounter,
+		executor: qimiexec.New(),
+		mounts:   mounts,
+		handled:  make(map[string]bool),
+		inUse:    make(map[string]bool),
+	}
+
+	infos := store.ListMounts()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].MountPoint < infos[j].MountPoint })
+
+	var stale []*storage.MountInfo
+	inState := make(map[string]bool)
+	for _, info := range infos {
+		inState[info.MountPoint] = true
+		if store.IsValidMount(info) {
+			b.inUse[info.Device] = true
+			b.handled[info.MountPoint] = true
+			b.checkActive(info)
+		} else {
+			stale = append(stale, info)
+		}
+	}
+
+	// Devices of running temporary mounts must be known before anything is torn down
+	orphans := b.unknownMountDirs(inState)
+
+	for _, info := range stale {
+		b.teardown(info, true)
+	}
+	for _, dir := range orphans {
+		if record, err := b.mounter.Record(dir); err == nil {
+			b.teardown(record, false)
+		} else {
+			b.teardownOrphan(dir)
+		}
+	}
+
+	// Rootless mounts are served through FUSE, not NBD
+	if !config.Current().Rootless {
+		b.checkDevices(infos)
+	}
+	b.checkBackups()
+	b.checkMetadata()
+	b.checkSessionSockets()
+	// Without root, commands run without cgroups
+	if !config.Current().Rootless {
+		b.checkCgroups()
+	}
+
+	return b.plan, nil
+}
+
+func (b *builder) add(description string, apply func() error) {
+	logger.Debug("cleanup plan: %s", description)
+	b.plan.Actions = append(b.plan.Actions, Action{Description: description, apply: apply})
+}
+
+func (b *builder) skip(format string, args ...any) {
+	b.plan.Skipped = append(b.plan.Skipped, fmt.Sprintf(format, args...))
+}
+
+// checkActive looks for the /proc, /sys, /dev, /tmp, resolv.conf and no-op script mounts
+// and the replaced guest files an exec that crashed left behind in an active mount
+func (b *builder) checkActive(info *storage.MountInfo) {
+	mp := info.MountPoint
+
+	var leftovers []string
+	for _, ns := range qimiexec.MountNamespaces {
+		if target := filepath.Join(mp, ns.Target()); mountinfo.IsMounted(b.mounts, target) {
+			leftovers = append(leftovers, target)
+		}
+	}
+	for _, target := range b.executor.FileMounts(mp) {
+		if mountinfo.IsMounted(b.mounts, target) {
+			leftovers = append(leftovers, target)
+		}
+	}
+	hasBackup := b.executor.HasBackup(mp)
+	if len(leftovers) == 0 && !hasBackup {
+		return
+	}
+
+	if sessions := b.store.MountSessions(info); len(sessions) > 0 {
+		logger.Debug("%d exec session(s) using %s, leaving its exec mounts alone", len(sessions), mp)
+		return
+	}
+	if procs := process.FindByRoot(mp); len(procs) > 0 {
+		logger.Debug("%d process(es) running in %s, leaving its exec mounts alone", len(procs), mp)
+		return
+	}
+
+	if len(leftovers) > 0 {
+		b.add(fmt.Sprintf("unmount leftover %s", strings.Join(leftovers, ", ")), func() error {
+			return b.executor.CleanupMountNamespace(mp)
+		})
+	}
+	if hasBackup {
+		b.add(fmt.Sprintf("restore guest files replaced by exec in %s", mp), func() error {
+			return b.executor.RestoreFiles(mp)
+		})
+	}
+}
+
+// teardown plans the removal of everything belonging to a mount that is no
+// longer usable: its filesystems, devices, files and, for stale state
+// entries, the entry itself
+func (b *builder) teardown(info *storage.MountInfo, inState bool) {
+	mp := info.MountPoint
+	b.handled[mp] = true
+
+	if procs := process.FindUsing(mp); len(procs) > 0 {
+		b.skip("%s: %d process(es) still using it, e.g. %d (%s, %s)", mp, len(procs), procs[0].PID, procs[0].Command, procs[0].Reason)
+		return
+	}
+
+	b.unmountTree(mp)
+
+	if info.Rootless {
+		if exported(info) {
+			b.add(fmt.Sprintf("release %s", describeDevices(info)), func() error {
+				return b.mounter.ReleaseDevices(info)
+			})
+		}
+	} else if attached(info.Device) {
+		if b.inUse[info.Device] {
+			b.skip("%s: %s now belongs to another mount, not disconnecting it", mp, info.Device)
+		} else {
+			b.inUse[info.Device] = true
+			b.add(fmt.Sprintf("release %s", describeDevices(info)), func() error {
+				return b.mounter.ReleaseDevices(info)
+			})
+		}
+	}
+
+	b.removeMountDir(mp)
+
+	if inState {
+		key := info.ID
+		if key == "" {
+			key = info.MountPoint
+		}
+		b.add(fmt.Sprintf("remove stale state entry %s", label(info)), func() error {
+			return b.store.RemoveMount(key)
+		})
+	}
+}
+
+// teardownOrphan handles a mount directory with no state entry and no
+// record, whose devices can only be found through the mount table and sysfs
+func (b *builder) teardownOrphan(mp string) {
+	b.handled[mp] = true
+
+	if procs := process.FindUsing(mp); len(procs) > 0 {
+		b.skip("%s: %d process(es) still using it, e.g. %d (%s, %s)", mp, len(procs), procs[0].PID, procs[0].Command, procs[0].Reason)
+		return
+	}
+
+	devices := make(map[string]bool)
+	for _, e := range mountinfo.Under(b.mounts, mp) {
+		if dev := nbdOf(e.Source); dev != "" {
+			devices[dev] = true
+		}
+	}
+
+	b.unmountTree(mp)
+
+	for dev := range devices {
+		if !attached(dev) || b.inUse[dev] {
+			continue
+		}
+		b.releaseOrphan(dev, "")
+	}
+
+	b.removeMountDir(mp)
+}
+
+// checkDevices finds NBD devices a command that crashed before recording
+// them left connected: their qemu-nbd still runs, but no state entry, mount
+// record or running session refers to them
+func (b *builder) checkDevices(infos []*storage.MountInfo) {
+	referenced := make(map[string]bool)
+	for _, info := range infos {
+		referenced[info.Device] = true
+	}
+	for _, record := range b.mounter.Records() {
+		// Records of dead processes whose mount directory is gone are removed
+		// with the other orphaned metadata
+		if b.handled[record.MountPoint] || process.Alive(record.PID) {
+			referenced[record.Device] = true
+		}
+	}
+	for _, session := range b.store.ListSessions() {
+		if record, err := b.mounter.Record(session.MountPoint); err == nil {
+			referenced[record.Device] = true
+		}
+	}
+
+	// Devices mounted outside of the mount directories were not set up by qimi
+	mounted := make(map[string]bool)
+	for _, e := range b.mounts {
+		if strings.HasPrefix(e.Source, "/dev/") {
+			if dev := nbdOf(e.Source); dev != "" {
+				mounted[dev] = true
+			}
+		}
+	}
+
+	connected := connectedDevices()
+	devices := make([]string, 0, len(connected))
+	for dev := range connected {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+
+	for _, dev := range devices {
+		if b.inUse[dev] || referenced[dev] {
+			continue
+		}
+		if mounted[dev] {
+			b.skip("%s: connected by process %d and mounted, but unknown to qimi, not disconnecting it", dev, connected[dev])
+			continue
+		}
+		b.releaseOrphan(dev, fmt.Sprintf("qemu-nbd PID %d, unknown to qimi", connected[dev]))
+	}
+}
+
+// releaseOrphan plans removing the device mapper devices on an NBD device
+// that no mount records and disconnecting it
+func (b *builder) releaseOrphan(dev, note string) {
+	b.inUse[dev] = true
+	holders := deviceMapperHolders(dev)
+	description := "disconnect " + dev
+	if len(holders) > 0 {
+		description = fmt.Sprintf("remove %s and disconnect %s", strings.Join(holders, ", "), dev)
+	}
+	if note != "" {
+		description += " (" + note + ")"
+	}
+	b.add(description, func() error {
+		return releaseOrphanDevice(dev, holders)
+	})
+}
+
+// unmountTree restores the guest files exec replaced and plans unmounting
+// everything at and below a mount directory
+func (b *builder) unmountTree(mp string) {
+	under := mountinfo.Under(b.mounts, mp)
+	if len(under) == 0 {
+		return
+	}
+
+	// The backups can only be put back while the guest filesystem is still mounted
+	if mountinfo.IsMounted(b.mounts, mp) && b.executor.HasBackup(mp) {
+		b.add(fmt.Sprintf("restore guest files replaced by exec in %s", mp), func() error {
+			return b.executor.RestoreFiles(mp)
+		})
+	}
+
+	targets := make([]string, 0, len(under))
+	for _, e := range under {
+		targets = append(targets, e.MountPoint)
+	}
+	b.add(fmt.Sprintf("unmount %d filesystem(s) at and below %s", len(targets), mp), func() error {
+		return unmountAll(mp, targets)
+	})
+}
+
+// removeMountDir plans removing a mount directory with its backups and metadata
+func (b *builder) removeMountDir(mp string) {
+	metadata, _ := filepath.Glob(filepath.Join(config.Current().MetadataDir(), filepath.Base(mp)+".*"))
+	if _, err := os.Stat(mp); os.IsNotExist(err) && len(metadata) == 0 && !b.executor.HasBackup(mp) {
+		return
+	}
+
+	b.add(fmt.Sprintf("remove %s and its backups and metadata", mp), func() error {
+		b.executor.CleanupBackupFiles(mp)
+		b.mounter.RemoveMetadata(mp)
+		if err := os.Remove(mp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// unknownMountDirs finds mount directories that are not in the state:
+// temporary mounts of exec, leftovers of failed or crashed commands and
+// those of older versions in the legacy mount directory. Those of running
+// processes are marked in use, the rest are returned.
+func (b *builder) unknownMountDirs(inState map[string]bool) []string {
+	dirs := make(map[string]bool)
+	for _, mountDir := range []string{config.Current().MountDir(), config.Current().LegacyMountDir()} {
+		if mountDir == "" {
+			continue
+		}
+		if entries, err := os.ReadDir(mountDir); err == nil {
+			for _, e := range entries {
+				if e.IsDir() {
+					dirs[filepath.Join(mountDir, e.Name())] = true
+				}
+			}
+		}
+		for _, e := range mountinfo.Under(b.mounts, mountDir) {
+			rel := strings.TrimPrefix(e.MountPoint, mountDir+"/")
+			if rel == e.MountPoint || rel == "" {
+				continue
+			}
+			dirs[filepath.Join(mountDir, strings.SplitN(rel, "/", 2)[0])] = true
+		}
+	}
+
+	var orphans []string
+	for dir := range dirs {
+		if inState[dir] {
+			continue
+		}
+
+		if record, err := b.mounter.Record(dir); err == nil && record.PID != os.Getpid() && process.Alive(record.PID) {
+			logger.Debug("%s belongs to running process %d, leaving it alone", dir, record.PID)
+			b.handled[dir] = true
+			b.inUse[record.Device] = true
+			continue
+		}
+		orphans = append(orphans, dir)
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// checkBackups removes backups of guest files whose mount directory is
+// gone, including those older versions left in the legacy files directory
+func (b *builder) checkBackups() {
+	known := make(map[string]bool)
+	for dir := range b.handled {
+		for _, path := range b.executor.BackupPaths(dir) {
+			known[path] = true
+		}
+	}
+
+	for _, filesDir := range []string{config.Current().FilesDir(), config.Current().LegacyFilesDir()} {
+		if filesDir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(filesDir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			path := filepath.Join(filesDir, e.Name())
+			if known[path] {
+				continue
+			}
+			b.add(fmt.Sprintf("remove orphaned backup %s", path), func() error {
+				return os.Remove(path)
+			})
+		}
+	}
+}
+
+// checkMetadata removes metadata files whose mount directory is gone
+func (b *builder) checkMetadata() {
+	metadataDir := config.Current().MetadataDir()
+	entries, err := os.ReadDir(metadataDir)
+	if err != nil {
+		return
+	}
+
+	mountDir := config.Current().MountDir()
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Name(), ".")
+		if b.handled[filepath.Join(mountDir, id)] {
+			continue
+		}
+		path := filepath.Join(metadataDir, e.Name())
+		b.add(fmt.Sprintf("remove orphaned metadata %s", path), func() error {
+			return os.Remove(path)
+		})
+	}
+}
+
+// checkSessionSockets removes the sockets of detached sessions whose
+// supervisor was killed
+func (b *builder) checkSessionSockets() {
+	sessionsDir := config.Current().SessionsDir()
+	entries, err := os.ReadDir(sessionsDir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".sock")
+		if _, err := b.store.GetSession(id); err == nil {
+			continue
+		}
+		path := filepath.Join(sessionsDir, e.Name())
+		b.add(fmt.Sprintf("remove stale session socket %s", path), func() error {
+			return os.Remove(path)
+		})
+	}
+}
+
+// checkCgroups removes the cgroups of commands whose qimi process crashed
+// before it could remove them
+func (b *builder) checkCgroups() {
+	for _, path := range cgroup.Stale() {
+		b.add(fmt.Sprintf("remove stale cgroup %s", path), func() error {
+			return os.Remove(path)
+		})
+	}
+}
+
+// unmountAll unmounts targets in order, falling back to lazy unmounts. The tree
+// is made private first so unmounting the /dev bind cannot propagate to the host.
+func unmountAll(mp string, targets []string) error {
+	if config.Current().Rootless {
+		return unmountFUSE(targets)
+	}
+
+	if out, err := exec.Command("mount", "--make-rprivate", mp).CombinedOutput(); err != nil {
+		logger.Debug("failed to make %s rprivate: %v: %s", mp, err, strings.TrimSpace(string(out)))
+	}
+
+	var failed []string
+	for _, target := range targets {
+		if err := exec.Command("umount", target).Run(); err == nil {
+			continue
+		}
+		if out, err := exec.Command("umount", "-l", target).CombinedOutput(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", target, strings.TrimSpace(string(out))))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// unmountFUSE unmounts the FUSE filesystems of rootless mounts. Without
+// root, exec mounts nothing else on the host.
+func unmountFUSE(targets []string) error {
+	var failed []string
+	for _, target := range targets {
+		if out, err := mount.UnmountFUSE(target); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", target, strings.TrimSpace(string(out))))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to unmount %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// describeDevices lists the devices of a mount for the plan
+func describeDevices(info *storage.MountInfo) string {
+	var parts []string
+	if info.Device != "" {
+		parts = append(parts, info.Device)
+	}
+	for _, e := range info.Extras(storage.ExtraTypeExport) {
+		parts = append(parts, fmt.Sprintf("%s (PID %d)", e.Name, e.PID))
+	}
+	for _, e := range info.Extras(storage.ExtraTypeLUKS) {
+		parts = append(parts, "LUKS mapping "+e.Name)
+	}
+	for _, e := range info.Extras(storage.ExtraTypeLVM) {
+		parts = append(parts, "volume group "+e.Name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// label names a state entry for the plan
+func label(info *storage.MountInfo) string {
+	if info.Name != "" {
+		return info.Name
+	}
+	if info.ID != "" {
+		return info.ID
+	}
+	return info.ImagePath
+}
@@ -0,0 +1,138 @@
+package cleanup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/luks"
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/process"
+	"github.com/packetstream-llc/qimi/internal/storage"
+)
+
+// nbdDeviceRe matches NBD devices and their partitions, e.g. nbd0 or nbd0p2
+var nbdDeviceRe = regexp.MustCompile(`^(nbd\d+)(p\d+)?$`)
+
+// attached reports whether a qemu-nbd process is serving an NBD device
+func attached(device string) bool {
+	if device == "" {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "pid"))
+	return err == nil && strings.TrimSpace(string(data)) != ""
+}
+
+// connectedDevices returns the NBD devices whose client process is running,
+// with its PID
+func connectedDevices() map[string]int {
+	paths, _ := filepath.Glob("/sys/block/nbd*/pid")
+	devices := make(map[string]int)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || !process.Alive(pid) {
+			continue
+		}
+		devices["/dev/"+filepath.Base(filepath.Dir(path))] = pid
+	}
+	return devices
+}
+
+// exported reports whether anything is left of the FUSE exports of a rootless
+// mount: a running qemu-storage-daemon or the file its export was mounted on
+func exported(info *storage.MountInfo) bool {
+	for _, e := range info.Extras(storage.ExtraTypeExport) {
+		// A dead export can't even be stat'ed
+		if _, err := os.Lstat(e.Target); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// nbdOf returns the NBD device a block device lives on, following device
+// mapper devices (LVM, LUKS) down to their slaves
+func nbdOf(device string) string {
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(path)
+	if m := nbdDeviceRe.FindStringSubmatch(name); m != nil {
+		return "/dev/" + m[1]
+	}
+
+	slaves, _ := os.ReadDir(filepath.Join("/sys/class/block", name, "slaves"))
+	for _, s := range slaves {
+		if dev := nbdOf("/dev/" + s.Name()); dev != "" {
+			return dev
+		}
+	}
+	return ""
+}
+
+// deviceMapperHolders returns the names of the device mapper devices stacked
+// on an NBD device or its partitions, topmost first, so they can be removed in order
+func deviceMapperHolders(device string) []string {
+	base := filepath.Base(device)
+	blocks := []string{base}
+	if entries, err := os.ReadDir(filepath.Join("/sys/block", base)); err == nil {
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), base+"p") {
+				blocks = append(blocks, e.Name())
+			}
+		}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(block string)
+	walk = func(block string) {
+		holders, _ := os.ReadDir(filepath.Join("/sys/class/block", block, "holders"))
+		for _, h := range holders {
+			if seen[h.Name()] {
+				continue
+			}
+			seen[h.Name()] = true
+			walk(h.Name())
+			if data, err := os.ReadFile(filepath.Join("/sys/class/block", h.Name(), "dm", "name")); err == nil {
+				names = append(names, strings.TrimSpace(string(data)))
+			}
+		}
+	}
+	for _, block := range blocks {
+		walk(block)
+	}
+	return names
+}
+
+// releaseOrphanDevice removes the device mapper devices on an NBD device that
+// no mount records and disconnects it. Without a record, volume groups that
+// were imported under a temporary name cannot be renamed back.
+func releaseOrphanDevice(device string, holders []string) error {
+	for _, name := range holders {
+		var out []byte
+		var err error
+		if strings.HasPrefix(name, "qimi-") && luks.Available() {
+			out, err = exec.Command("cryptsetup", "close", name).CombinedOutput()
+		} else {
+			out, err = exec.Command("dmsetup", "remove", name).CombinedOutput()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if err := nbd.DisconnectDevice(device); err != nil {
+		return fmt.Errorf("failed to disconnect %s: %w", device, err)
+	}
+	return nil
+}
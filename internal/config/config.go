@@ -0,0 +1,191 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultRoot keeps qimi's state on /run, which is a tmpfs that systemd-tmpfiles
+// does not age and that, like the mounts themselves, does not survive a reboot
+const DefaultRoot = "/run/qimi"
+
+// DefaultFile is read when QIMI_CONFIG is not set
+const DefaultFile = "/etc/qimi/config.json"
+
+// rootlessFile is read instead of DefaultFile in rootless mode, below $XDG_CONFIG_HOME
+const rootlessFile = "qimi/config.json"
+
+// LegacyRoot is where versions before the root became configurable kept everything
+const LegacyRoot = "/tmp/qimi"
+
+// RootlessEnv turns on rootless mode like the --rootless flag
+const RootlessEnv = "QIMI_ROOTLESS"
+
+// Config holds the directories qimi keeps its state and runtime files in
+type Config struct {
+	// Root is the default for both StateDir and RuntimeDir
+	Root string `json:"root"`
+	// StateDir holds the state file and its lock
+	StateDir string `json:"state_dir"`
+	// RuntimeDir holds mount points, mount metadata, file backups and session sockets
+	RuntimeDir string `json:"runtime_dir"`
+	// Rootless is set when qimi runs without root: images are served through
+	// FUSE and commands run in a user namespace. It has to be asked for, so
+	// that a user who forgot sudo isn't shown an empty set of mounts.
+	Rootless bool `json:"-"`
+}
+
+var current = &Config{Root: DefaultRoot, StateDir: DefaultRoot, RuntimeDir: DefaultRoot}
+
+// Current returns the active configuration
+func Current() *Config {
+	return current
+}
+
+// Load reads the configuration file and applies overrides, in increasing
+// precedence: the config file, QIMI_ROOT and the --root flag (root). A root
+// given on the command line or in the environment overrides the state and
+// runtime directories of the config file too.
+// In rootless mode, chosen with the --rootless flag (rootless) or QIMI_ROOTLESS,
+// the config file is $XDG_CONFIG_HOME/qimi/config.json and the default root
+// is $XDG_RUNTIME_DIR/qimi.
+func Load(root string, rootless bool) error {
+	if env := os.Getenv(RootlessEnv); env != "" && !rootless {
+		var err error
+		if rootless, err = strconv.ParseBool(env); err != nil {
+			return fmt.Errorf("invalid %s value %q", RootlessEnv, env)
+		}
+	}
+	if rootless && os.Getuid() == 0 {
+		return errors.New("rootless mode is for running qimi without root")
+	}
+	c := &Config{Rootless: rootless}
+
+	path := os.Getenv("QIMI_CONFIG")
+	if path == "" {
+		path = DefaultFile
+		if c.Rootless {
+			path = rootlessConfigFile()
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && os.Getenv("QIMI_CONFIG") == "") {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	if root == "" {
+		root = os.Getenv("QIMI_ROOT")
+	}
+	if root != "" {
+		c = &Config{Root: root, Rootless: c.Rootless}
+	}
+	if c.Root == "" && c.Rootless {
+		runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+		if runtimeDir == "" {
+			return errors.New("XDG_RUNTIME_DIR is not set, use --root or QIMI_ROOT to choose a directory for qimi's files")
+		}
+		c.Root = filepath.Join(runtimeDir, "qimi")
+	}
+	if c.Root == "" {
+		c.Root = DefaultRoot
+	}
+	if c.StateDir == "" {
+		c.StateDir = c.Root
+	}
+	if c.RuntimeDir == "" {
+		c.RuntimeDir = c.Root
+	}
+
+	for _, dir := range []*string{&c.Root, &c.StateDir, &c.RuntimeDir} {
+		if !filepath.IsAbs(*dir) {
+			return fmt.Errorf("qimi directories must be absolute paths: %s", *dir)
+		}
+		*dir = filepath.Clean(*dir)
+		if *dir == "/" {
+			return errors.New("qimi directories must not be /")
+		}
+	}
+
+	current = c
+	return nil
+}
+
+// rootlessConfigFile returns the config file of the user running qimi
+func rootlessConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, rootlessFile)
+}
+
+// StatePath returns the path of the state file
+func (c *Config) StatePath() string {
+	return filepath.Join(c.StateDir, "state.json")
+}
+
+// MountDir returns the directory mount points are created in
+func (c *Config) MountDir() string {
+	return filepath.Join(c.RuntimeDir, "mounts")
+}
+
+// MetadataDir returns the directory for per-mount side files
+func (c *Config) MetadataDir() string {
+	return filepath.Join(c.RuntimeDir, "metadata")
+}
+
+// FilesDir returns the directory for backups of files replaced inside images
+func (c *Config) FilesDir() string {
+	return filepath.Join(c.RuntimeDir, "files")
+}
+
+// SessionsDir returns the directory for the sockets of detached exec sessions
+func (c *Config) SessionsDir() string {
+	return filepath.Join(c.RuntimeDir, "sessions")
+}
+
+// IsMountPoint reports whether path is a mount point qimi created, that is a
+// directory below the mount directory, or below the legacy one for mounts
+// imported from older versions
+func (c *Config) IsMountPoint(path string) bool {
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, c.MountDir()+"/") {
+		return true
+	}
+	legacy := c.LegacyMountDir()
+	return legacy != "" && strings.HasPrefix(path, legacy+"/")
+}
+
+// LegacyMountDir returns the directory versions before the root became
+// configurable created mount points in, or "" if it is not in use besides MountDir
+func (c *Config) LegacyMountDir() string {
+	return c.legacyDir("mounts")
+}
+
+// LegacyFilesDir returns the directory versions before the root became
+// configurable kept resolv.conf backups in, or "" if it is not in use besides FilesDir
+func (c *Config) LegacyFilesDir() string {
+	return c.legacyDir("files")
+}
+
+func (c *Config) legacyDir(name string) string {
+	// The legacy directories belong to root
+	if c.Rootless || filepath.Clean(c.RuntimeDir) == LegacyRoot {
+		return ""
+	}
+	return filepath.Join(LegacyRoot, name)
+}
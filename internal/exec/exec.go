@@ -1,15 +1,16 @@
 package exec
 
 import (
-	"crypto/md5"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"syscall"
 
+	"github.com/packetstream-llc/qimi/internal/cgroup"
+	"github.com/packetstream-llc/qimi/internal/config"
 	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/security"
 )
 
 type Executor struct{}
@@ -28,14 +29,72 @@ var MountNamespaces = []MountNamespace{
 	{source: "tmpfs", target: "/tmp", fstype: "tmpfs", flags: 0},
 }
 
+// Target returns where the filesystem is mounted inside the guest
+func (n MountNamespace) Target() string {
+	return n.target
+}
+
+// Options control how a guest is set up for commands and how they run
+type Options struct {
+	// Nameservers replace the host's nameservers in the guest's resolv.conf
+	Nameservers []string
+	// DNSSearch replaces the search domains in the guest's resolv.conf
+	DNSSearch []string
+	// DNSOptions are added to the options in the guest's resolv.conf
+	DNSOptions []string
+	// NoServices stops package scripts from starting services, see disableServices
+	NoServices bool
+	// ReadOnly is set when the guest is mounted read-only, so files can only
+	// be mounted over, not written
+	ReadOnly bool
+	// Network is the network mode of commands, NetworkHost if empty
+	Network string
+	// Publish forwards host ports to commands with a private network
+	Publish []PortMapping
+	// Hostname is set in a UTS namespace of the command and written to the
+	// guest's /etc/hostname and /etc/hosts
+	Hostname string
+	// ExtraHosts are added to the guest's /etc/hosts
+	ExtraHosts []HostEntry
+	// Limits are the resource limits of commands, enforced through cgroup v2
+	Limits cgroup.Limits
+	// Security restricts the privileges of commands
+	Security security.Options
+}
+
+// needsInit reports whether commands need namespaces or privileges set up by
+// the init helper. Without root, every command does.
+func (o Options) needsInit() bool {
+	return o.Network == NetworkNone || o.Network == NetworkPrivate || o.Hostname != "" || !o.Security.IsZero() || config.Current().Rootless
+}
+
 func New() *Executor {
 	return &Executor{}
 }
 
-func (e *Executor) Execute(mountPoint string, command string, args []string, interactive, tty bool, nameservers []string) error {
-	logger.Debug("starting execution: command=%s, args=%v, interactive=%t, tty=%t", command, args, interactive, tty)
+func (e *Executor) Execute(mountPoint string, command string, args []string, interactive, tty bool, opts Options) error {
+	if err := e.Prepare(mountPoint, opts); err != nil {
+		return err
+	}
+
+	// Ensure cleanup happens even if command fails
+	defer func() {
+		logger.Debug("restoring replaced files")
+		e.RestoreFiles(mountPoint)
+	}()
+
+	return e.Run(mountPoint, command, args, interactive, tty, opts)
+}
+
+// Prepare mounts /proc, /sys, /dev and /tmp into the guest, mounts a
+// resolv.conf over its own, sets up its hosts and hostname files and, with
+// NoServices, keeps services from starting.
+// Filesystems that are already mounted are left as they are, so sessions
+// sharing a mount can all call it. Without root, the mounts are left to the
+// init helper of each command.
+func (e *Executor) Prepare(mountPoint string, opts Options) error {
 	logger.Debug("mount point: %s", mountPoint)
-	logger.Debug("nameservers: %v", nameservers)
+	logger.Debug("nameservers: %v", opts.Nameservers)
 
 	if _, err := os.Stat(mountPoint); err != nil {
 		logger.Error("mount point validation failed: %s", mountPoint)
@@ -43,30 +102,54 @@ func (e *Executor) Execute(mountPoint string, command string, args []string, int
 	}
 	logger.Debug("mount point validation successful")
 
-	logger.Debug("setting up mount namespace")
-	if err := e.setupMountNamespace(mountPoint); err != nil {
-		logger.Error("mount namespace setup failed: %v", err)
-		return fmt.Errorf("failed to setup mount namespace: %w", err)
+	if config.Current().Rootless {
+		logger.Debug("rootless: the init helper mounts /proc, /sys, /dev and /tmp in the command's mount namespace")
+	} else {
+		logger.Debug("setting up mount namespace")
+		if err := e.setupMountNamespace(mountPoint); err != nil {
+			logger.Error("mount namespace setup failed: %v", err)
+			return fmt.Errorf("failed to setup mount namespace: %w", err)
+		}
+		logger.Debug("mount namespace setup completed")
 	}
-	logger.Debug("mount namespace setup completed")
 
-	// Backup and setup resolv.conf
 	logger.Debug("setting up resolv.conf")
-	if err := e.backupAndSetupResolvConf(mountPoint, nameservers); err != nil {
+	// Commands with a private network get their own, see privateResolvConf
+	if content, err := resolvConf(opts.Nameservers, opts.DNSSearch, opts.DNSOptions); err != nil {
+		logger.Warn("failed to setup resolv.conf: %v", err)
+	} else if err := e.setupResolvConf(mountPoint, content); err != nil {
 		logger.Warn("failed to setup resolv.conf: %v", err)
 	} else {
 		logger.Debug("resolv.conf setup completed")
 	}
 
-	// Ensure cleanup happens even if command fails
-	defer func() {
-		logger.Debug("restoring resolv.conf")
-		e.restoreResolvConf(mountPoint)
-	}()
+	if opts.Hostname != "" || len(opts.ExtraHosts) > 0 {
+		logger.Debug("setting up hosts")
+		if err := e.setupHosts(mountPoint, opts.Hostname, opts.ExtraHosts); err != nil {
+			logger.Warn("failed to setup /etc/hosts: %v", err)
+		}
+	}
 
-	fullCmd := append([]string{mountPoint, command}, args...)
-	logger.Debug("executing command in chroot: chroot %s", strings.Join(fullCmd, " "))
-	chrootCmd := exec.Command("chroot", fullCmd...)
+	if opts.NoServices {
+		logger.Debug("disabling services")
+		if err := e.disableServices(mountPoint, opts.ReadOnly); err != nil {
+			// Services starting on the host are worse than a failed command
+			e.RestoreFiles(mountPoint)
+			return fmt.Errorf("failed to disable services: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Run runs a command chrooted into a prepared mount point
+func (e *Executor) Run(mountPoint string, command string, args []string, interactive, tty bool, opts Options) error {
+	logger.Debug("starting execution: command=%s, args=%v, interactive=%t, tty=%t, network=%s", command, args, interactive, tty, opts.Network)
+
+	chrootCmd, err := e.Command(mountPoint, command, args, opts)
+	if err != nil {
+		return err
+	}
 
 	if interactive {
 		logger.Debug("enabling interactive mode (stdin)")
@@ -78,7 +161,7 @@ func (e *Executor) Execute(mountPoint string, command string, args []string, int
 	chrootCmd.Stderr = os.Stderr
 
 	logger.Debug("starting command execution")
-	err := chrootCmd.Run()
+	err = chrootCmd.Run()
 	if err != nil {
 		logger.Error("command execution failed: %v", err)
 	} else {
@@ -87,6 +170,26 @@ func (e *Executor) Execute(mountPoint string, command string, args []string, int
 	return err
 }
 
+// Command returns the command that runs command chrooted into a prepared
+// mount point, for callers that connect its stdio themselves
+func (e *Executor) Command(mountPoint string, command string, args []string, opts Options) (*Cmd, error) {
+	fullCmd := append([]string{mountPoint, command}, args...)
+	logger.Debug("executing command in chroot: chroot %s", strings.Join(fullCmd, " "))
+
+	c := &Cmd{Cmd: exec.Command("chroot", fullCmd...), opts: opts}
+	if c.Cmd.Err != nil {
+		return nil, c.Cmd.Err
+	}
+	c.Cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	if opts.needsInit() {
+		if err := c.wrap(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
 func (e *Executor) setupMountNamespace(mountPoint string) error {
 	logger.Debug("setting up mount namespaces for %d filesystems", len(MountNamespaces))
 
@@ -99,6 +202,11 @@ func (e *Executor) setupMountNamespace(mountPoint string) error {
 			continue
 		}
 
+		if e.isMounted(target) {
+			logger.Debug("already mounted, skipping: %s", target)
+			continue
+		}
+
 		var cmd *exec.Cmd
 		switch m.fstype {
 		case "bind":
@@ -123,208 +231,6 @@ func (e *Executor) setupMountNamespace(mountPoint string) error {
 	return nil
 }
 
-func (e *Executor) getBackupPath(mountPoint string) string {
-	// Create a unique backup filename based on mount point hash
-	hash := md5.Sum([]byte(mountPoint))
-	backupName := fmt.Sprintf("resolv_conf_backup_%x", hash[:8])
-	return filepath.Join("/tmp/qimi/files", backupName)
-}
-
-func (e *Executor) getBackupSymlinkPath(mountPoint string) string {
-	// Create a unique backup filename for symlink info
-	hash := md5.Sum([]byte(mountPoint))
-	backupName := fmt.Sprintf("resolv_conf_symlink_%x", hash[:8])
-	return filepath.Join("/tmp/qimi/files", backupName)
-}
-
-func (e *Executor) backupAndSetupResolvConf(mountPoint string, nameservers []string) error {
-	target := mountPoint + "/etc/resolv.conf"
-	etcDir := mountPoint + "/etc"
-	backupPath := e.getBackupPath(mountPoint)
-	symlinkBackupPath := e.getBackupSymlinkPath(mountPoint)
-
-	logger.Debug("resolv.conf setup: target=%s", target)
-	logger.Debug("backup paths: content=%s, symlink=%s", backupPath, symlinkBackupPath)
-
-	// Ensure backup directory exists
-	logger.Debug("creating backup directory: /tmp/qimi/files")
-	if err := os.MkdirAll("/tmp/qimi/files", 0755); err != nil {
-		logger.Error("failed to create backup directory: %v", err)
-		return err
-	}
-
-	// Check if /etc directory exists
-	logger.Debug("checking /etc directory: %s", etcDir)
-	if _, err := os.Stat(etcDir); os.IsNotExist(err) {
-		logger.Debug("/etc directory doesn't exist, creating it")
-		if err := os.MkdirAll(etcDir, 0755); err != nil {
-			logger.Error("failed to create /etc directory: %v", err)
-			return fmt.Errorf("failed to create /etc directory: %w", err)
-		}
-	} else {
-		logger.Debug("/etc directory exists")
-	}
-
-	// Only backup if we haven't already (first time for this mount point)
-	logger.Debug("checking if backup already exists: %s", backupPath)
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		logger.Debug("no existing backup, creating new backup")
-
-		// Check if target exists
-		if info, err := os.Lstat(target); err == nil {
-			if info.Mode()&os.ModeSymlink != 0 {
-				// It's a symlink, backup where it was pointing
-				symlinkTarget, err := os.Readlink(target)
-				if err != nil {
-					logger.Error("failed to read symlink target: %v", err)
-					return err
-				}
-				logger.Debug("backing up symlink target: %s -> %s", target, symlinkTarget)
-				if err := os.WriteFile(symlinkBackupPath, []byte(symlinkTarget), 0644); err != nil {
-					logger.Error("failed to write symlink backup: %v", err)
-					return err
-				}
-				logger.Debug("symlink backup created successfully")
-			} else {
-				// Regular file, backup the contents
-				logger.Debug("backing up regular file contents: %s", target)
-				if data, err := os.ReadFile(target); err == nil {
-					if err := os.WriteFile(backupPath, data, 0644); err != nil {
-						logger.Error("failed to write content backup: %v", err)
-						return err
-					}
-					logger.Debug("content backup created successfully (%d bytes)", len(data))
-				} else {
-					logger.Warn("failed to read file for backup: %v", err)
-				}
-			}
-		} else if os.IsNotExist(err) {
-			// Create empty backup file to indicate there was no original
-			logger.Debug("original file doesn't exist, creating empty backup marker")
-			if err := os.WriteFile(backupPath, []byte{}, 0644); err != nil {
-				logger.Error("failed to create empty backup marker: %v", err)
-				return err
-			}
-		} else {
-			// Some other error (permission denied, etc.)
-			logger.Error("error accessing original file: %v", err)
-			return err
-		}
-	} else {
-		logger.Debug("backup already exists, skipping backup creation")
-	}
-
-	var resolvContent []byte
-
-	if len(nameservers) > 0 {
-		logger.Debug("using custom nameservers: %v", nameservers)
-		// Validate nameservers and create custom resolv.conf
-		var validNameservers []string
-		for _, ns := range nameservers {
-			if ip := net.ParseIP(ns); ip != nil {
-				validNameservers = append(validNameservers, ns)
-				logger.Debug("nameserver validated: %s", ns)
-			} else {
-				logger.Error("invalid nameserver IP address: %s", ns)
-				return fmt.Errorf("invalid nameserver IP address: %s", ns)
-			}
-		}
-
-		// Create custom resolv.conf content
-		var resolvLines []string
-		for _, ns := range validNameservers {
-			resolvLines = append(resolvLines, fmt.Sprintf("nameserver %s", ns))
-		}
-		resolvContent = []byte(strings.Join(resolvLines, "\n") + "\n")
-		logger.Debug("generated custom resolv.conf content (%d bytes)", len(resolvContent))
-	} else {
-		logger.Debug("using host resolv.conf")
-		// Read host resolv.conf, following symlinks
-		var err error
-		realPath, err := filepath.EvalSymlinks("/etc/resolv.conf")
-		if err != nil {
-			logger.Debug("symlink resolution failed, falling back to direct read: %v", err)
-			// Fallback to direct read if symlink resolution fails
-			resolvContent, err = os.ReadFile("/etc/resolv.conf")
-		} else {
-			logger.Debug("resolved symlink: /etc/resolv.conf -> %s", realPath)
-			resolvContent, err = os.ReadFile(realPath)
-		}
-		if err != nil {
-			logger.Error("failed to read host resolv.conf: %v", err)
-			return err
-		}
-		logger.Debug("read host resolv.conf content (%d bytes)", len(resolvContent))
-	}
-
-	// Remove the existing file/symlink before writing new content
-	// This is important because if it's a symlink pointing to a non-existent file,
-	// we can't write to it directly
-	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
-		logger.Debug("failed to remove existing resolv.conf: %v (continuing anyway)", err)
-	} else if err == nil {
-		logger.Debug("removed existing resolv.conf/symlink successfully")
-	}
-
-	// Write resolv.conf to chroot
-	logger.Debug("writing resolv.conf to chroot: %s (%d bytes)", target, len(resolvContent))
-
-	if err := os.WriteFile(target, resolvContent, 0644); err != nil {
-		logger.Error("failed to write resolv.conf: %v", err)
-		return err
-	}
-	logger.Debug("resolv.conf written successfully")
-	return nil
-}
-
-func (e *Executor) restoreResolvConf(mountPoint string) error {
-	target := mountPoint + "/etc/resolv.conf"
-	backupPath := e.getBackupPath(mountPoint)
-	symlinkBackupPath := e.getBackupSymlinkPath(mountPoint)
-
-	logger.Debug("restoring resolv.conf: target=%s", target)
-	logger.Debug("backup paths: content=%s, symlink=%s", backupPath, symlinkBackupPath)
-
-	// Check if there was a symlink backup
-	if symlinkTarget, err := os.ReadFile(symlinkBackupPath); err == nil && len(symlinkTarget) > 0 {
-		logger.Debug("found symlink backup, restoring symlink: %s -> %s", target, string(symlinkTarget))
-		// Remove current file and recreate symlink
-		os.Remove(target)
-		if err := os.Symlink(string(symlinkTarget), target); err != nil {
-			logger.Error("failed to restore symlink: %v", err)
-			return err
-		}
-		logger.Debug("symlink restored successfully")
-		return nil
-	}
-
-	// Read regular backup
-	logger.Debug("checking for regular file backup")
-	backup, err := os.ReadFile(backupPath)
-	if err != nil {
-		logger.Debug("no backup found, removing current file: %v", err)
-		// If no backup exists, just remove the current file
-		os.Remove(target)
-		return nil
-	}
-
-	if len(backup) == 0 {
-		logger.Debug("empty backup found (original didn't exist), removing current file")
-		// Empty backup means there was no original file
-		os.Remove(target)
-		return nil
-	}
-
-	// Restore original resolv.conf
-	logger.Debug("restoring original file content (%d bytes)", len(backup))
-	if err := os.WriteFile(target, backup, 0644); err != nil {
-		logger.Error("failed to restore file content: %v", err)
-		return err
-	}
-	logger.Debug("file content restored successfully")
-	return nil
-}
-
 func (e *Executor) CleanupMountNamespace(mountPoint string) error {
 	logger.Debug("starting mount namespace cleanup: %s", mountPoint)
 
@@ -335,14 +241,19 @@ func (e *Executor) CleanupMountNamespace(mountPoint string) error {
 		return err
 	}
 
-	// Additional safety check - mount point should be an absolute path under /tmp or similar
-	if !strings.HasPrefix(mountPoint, "/tmp/") && !strings.HasPrefix(mountPoint, "/mnt/") {
+	// Additional safety check - mount point should be one qimi created below its runtime directory
+	if !config.Current().IsMountPoint(mountPoint) {
 		err := fmt.Errorf("unsafe mount point for cleanup: %s. THIS PROBABLY IS A BUG!!", mountPoint)
 		logger.Error("%v", err)
 		return err
 	}
 	logger.Debug("mount point validation passed")
 
+	// resolv.conf can be mounted inside one of the filesystems below
+	if err := e.cleanupFileMounts(mountPoint); err != nil {
+		logger.Warn("failed to unmount resolv.conf and the no-op scripts: %v", err)
+	}
+
 	// Ensure mountPoint ends with proper path separator for safe concatenation
 	if !strings.HasSuffix(mountPoint, "/") {
 		mountPoint = mountPoint + "/"
@@ -426,11 +337,14 @@ func (e *Executor) isMounted(path string) bool {
 	return false
 }
 
-// CleanupBackupFiles removes backup files for a mount point
-func (e *Executor) CleanupBackupFiles(mountPoint string) error {
-	backupPath := e.getBackupPath(mountPoint)
-	symlinkBackupPath := e.getBackupSymlinkPath(mountPoint)
-	os.Remove(backupPath)
-	os.Remove(symlinkBackupPath)
-	return nil
+// Teardown undoes Prepare: it unmounts /proc, /sys, /dev, /tmp and
+// resolv.conf from the guest and puts back the files it replaced
+func (e *Executor) Teardown(mountPoint string) error {
+	err := e.CleanupMountNamespace(mountPoint)
+
+	// Only files with a backup are restored, restoring without one would remove the guest's file
+	if restoreErr := e.RestoreFiles(mountPoint); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	return err
 }
@@ -0,0 +1,428 @@
+package exec
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// guestFile is a file exec may replace inside the guest while commands run.
+// The original is backed up in the files directory and put back afterwards.
+type guestFile struct {
+	// name identifies the file's backups
+	name string
+	// candidates are the places the file lives in different guests, the
+	// first one that exists is used
+	candidates []string
+	// legacy is set for the files older versions backed up in the legacy
+	// files directory already
+	legacy bool
+}
+
+// guestFiles lists every file exec may replace, so they can all be restored
+var guestFiles = []guestFile{
+	{name: "resolv.conf", candidates: []string{"/etc/resolv.conf"}, legacy: true},
+	{name: "hosts", candidates: []string{"/etc/hosts"}},
+	{name: "hostname", candidates: []string{"/etc/hostname"}},
+	{name: "policy-rc.d", candidates: []string{"/usr/sbin/policy-rc.d"}},
+	{name: "systemctl", candidates: []string{"/usr/bin/systemctl", "/bin/systemctl"}},
+	{name: "start-stop-daemon", candidates: []string{"/usr/sbin/start-stop-daemon", "/sbin/start-stop-daemon"}},
+}
+
+// lookupGuestFile returns the guest file with the given name
+func lookupGuestFile(name string) guestFile {
+	for _, f := range guestFiles {
+		if f.name == name {
+			return f
+		}
+	}
+	panic("unknown guest file " + name)
+}
+
+// hostPath returns where the file is on the host. Directories are resolved
+// inside the guest, so guest symlinks cannot point the path at host files;
+// the file itself is not resolved, so a symlink can be backed up as one.
+func (f guestFile) hostPath(mountPoint string) (string, error) {
+	var first string
+	for _, candidate := range f.candidates {
+		dir, err := utils.SecureJoin(mountPoint, filepath.Dir(candidate))
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(dir, filepath.Base(candidate))
+		if first == "" {
+			first = path
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return path, nil
+		}
+	}
+	return first, nil
+}
+
+// backupPaths returns the paths of the content and symlink backups of the
+// file for a mount point. Backups older versions left in the legacy files
+// directory are used as long as there are no others.
+func (f guestFile) backupPaths(mountPoint string) (string, string) {
+	key := strings.ReplaceAll(f.name, ".", "_")
+	backupPath, symlinkBackupPath := mountFile(mountPoint, key+"_backup"), mountFile(mountPoint, key+"_symlink")
+	if exists(backupPath) || exists(symlinkBackupPath) {
+		return backupPath, symlinkBackupPath
+	}
+	if legacyBackup, legacySymlink := f.legacyBackupPaths(mountPoint); exists(legacyBackup) || exists(legacySymlink) {
+		return legacyBackup, legacySymlink
+	}
+	return backupPath, symlinkBackupPath
+}
+
+// legacyBackupPaths returns where older versions kept the backups of the
+// file for a mount point, or empty paths if they didn't
+func (f guestFile) legacyBackupPaths(mountPoint string) (string, string) {
+	dir := config.Current().LegacyFilesDir()
+	if !f.legacy || dir == "" {
+		return "", ""
+	}
+	key := strings.ReplaceAll(f.name, ".", "_")
+	hash := md5.Sum([]byte(mountPoint))
+	return filepath.Join(dir, fmt.Sprintf("%s_backup_%x", key, hash[:8])), filepath.Join(dir, fmt.Sprintf("%s_symlink_%x", key, hash[:8]))
+}
+
+// exists reports whether a file exists
+func exists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// mountFile returns the path of a file kept for a mount point in the files directory
+func mountFile(mountPoint string, name string) string {
+	// Create unique filenames based on mount point hash
+	hash := md5.Sum([]byte(mountPoint))
+	return filepath.Join(config.Current().FilesDir(), fmt.Sprintf("%s_%x", name, hash[:8]))
+}
+
+// overridePath returns where the file bound over the guest file is kept
+func (f guestFile) overridePath(mountPoint string) string {
+	return mountFile(mountPoint, strings.ReplaceAll(f.name, ".", "_")+"_override")
+}
+
+func (f guestFile) hasBackup(mountPoint string) bool {
+	backupPath, symlinkBackupPath := f.backupPaths(mountPoint)
+	return exists(backupPath) || exists(symlinkBackupPath)
+}
+
+// replaceFile backs up a guest file, unless a backup exists already, and
+// replaces it with content
+func (e *Executor) replaceFile(mountPoint string, f guestFile, content []byte, mode os.FileMode) error {
+	target, err := f.hostPath(mountPoint)
+	if err != nil {
+		return err
+	}
+	backupPath, symlinkBackupPath := f.backupPaths(mountPoint)
+
+	logger.Debug("%s setup: target=%s", f.name, target)
+	logger.Debug("backup paths: content=%s, symlink=%s", backupPath, symlinkBackupPath)
+
+	// Ensure backup directory exists
+	filesDir := config.Current().FilesDir()
+	logger.Debug("creating backup directory: %s", filesDir)
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		logger.Error("failed to create backup directory: %v", err)
+		return err
+	}
+
+	// Only backup if we haven't already (first time for this mount point)
+	logger.Debug("checking if backup already exists: %s", backupPath)
+	if !f.hasBackup(mountPoint) {
+		logger.Debug("no existing backup, creating new backup")
+
+		// Check if target exists
+		if info, err := os.Lstat(target); err == nil {
+			if info.Mode()&os.ModeSymlink != 0 {
+				// It's a symlink, backup where it was pointing
+				symlinkTarget, err := os.Readlink(target)
+				if err != nil {
+					logger.Error("failed to read symlink target: %v", err)
+					return err
+				}
+				logger.Debug("backing up symlink target: %s -> %s", target, symlinkTarget)
+				if err := os.WriteFile(symlinkBackupPath, []byte(symlinkTarget), 0644); err != nil {
+					logger.Error("failed to write symlink backup: %v", err)
+					return err
+				}
+				logger.Debug("symlink backup created successfully")
+			} else {
+				// Regular file, backup the contents with their permissions
+				logger.Debug("backing up regular file contents: %s", target)
+				data, err := os.ReadFile(target)
+				if err != nil {
+					logger.Error("failed to read file for backup: %v", err)
+					return err
+				}
+				if err := writeFileMode(backupPath, data, info.Mode().Perm()); err != nil {
+					logger.Error("failed to write content backup: %v", err)
+					return err
+				}
+				logger.Debug("content backup created successfully (%d bytes)", len(data))
+			}
+		} else if os.IsNotExist(err) {
+			// Create empty backup file to indicate there was no original
+			logger.Debug("original file doesn't exist, creating empty backup marker")
+			if err := os.WriteFile(backupPath, []byte{}, 0644); err != nil {
+				logger.Error("failed to create empty backup marker: %v", err)
+				return err
+			}
+		} else {
+			// Some other error (permission denied, etc.)
+			logger.Error("error accessing original file: %v", err)
+			return err
+		}
+	} else {
+		logger.Debug("backup already exists, skipping backup creation")
+	}
+
+	// Remove the existing file/symlink before writing new content
+	// This is important because if it's a symlink pointing to a non-existent file,
+	// we can't write to it directly
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		logger.Debug("failed to remove existing %s: %v (continuing anyway)", f.name, err)
+	} else if err == nil {
+		logger.Debug("removed existing %s successfully", f.name)
+	}
+
+	logger.Debug("writing %s to chroot: %s (%d bytes)", f.name, target, len(content))
+	if err := writeFileMode(target, content, mode); err != nil {
+		logger.Error("failed to write %s: %v", f.name, err)
+		return err
+	}
+	logger.Debug("%s written successfully", f.name)
+	return nil
+}
+
+// originalContent returns the guest's own version of a file, which is in
+// the backup once the file was replaced. Symlinks are followed inside the
+// guest. It returns nil if the guest has no such file.
+func (e *Executor) originalContent(mountPoint string, f guestFile) ([]byte, error) {
+	backupPath, symlinkBackupPath := f.backupPaths(mountPoint)
+	if data, err := os.ReadFile(backupPath); err == nil {
+		return data, nil
+	}
+
+	path, err := f.hostPath(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	guestPath := strings.TrimPrefix(path, mountPoint)
+	if target, err := os.ReadFile(symlinkBackupPath); err == nil && len(target) > 0 {
+		// The symlink itself was replaced, follow the one in the backup
+		guestPath = string(target)
+		if !filepath.IsAbs(guestPath) {
+			guestPath = filepath.Join(filepath.Dir(strings.TrimPrefix(path, mountPoint)), guestPath)
+		}
+	}
+
+	resolved, err := utils.SecureJoin(mountPoint, guestPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(resolved)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// restoreFile puts back a guest file from its backup. Without a backup, or
+// with an empty one, the guest had no such file and the replacement is removed.
+func (e *Executor) restoreFile(mountPoint string, f guestFile) error {
+	target, err := f.hostPath(mountPoint)
+	if err != nil {
+		return err
+	}
+	backupPath, symlinkBackupPath := f.backupPaths(mountPoint)
+
+	logger.Debug("restoring %s: target=%s", f.name, target)
+	logger.Debug("backup paths: content=%s, symlink=%s", backupPath, symlinkBackupPath)
+
+	// Check if there was a symlink backup
+	if symlinkTarget, err := os.ReadFile(symlinkBackupPath); err == nil && len(symlinkTarget) > 0 {
+		logger.Debug("found symlink backup, restoring symlink: %s -> %s", target, string(symlinkTarget))
+		// Remove current file and recreate symlink
+		os.Remove(target)
+		if err := os.Symlink(string(symlinkTarget), target); err != nil {
+			logger.Error("failed to restore symlink: %v", err)
+			return err
+		}
+		logger.Debug("symlink restored successfully")
+		return nil
+	}
+
+	// Read regular backup
+	logger.Debug("checking for regular file backup")
+	backup, err := os.ReadFile(backupPath)
+	if err != nil {
+		logger.Debug("no backup found, removing current file: %v", err)
+		// If no backup exists, just remove the current file
+		os.Remove(target)
+		return nil
+	}
+
+	if len(backup) == 0 {
+		logger.Debug("empty backup found (original didn't exist), removing current file")
+		// Empty backup means there was no original file
+		os.Remove(target)
+		return nil
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(backupPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Restore original file
+	logger.Debug("restoring original file content (%d bytes)", len(backup))
+	os.Remove(target)
+	if err := writeFileMode(target, backup, mode); err != nil {
+		logger.Error("failed to restore file content: %v", err)
+		return err
+	}
+	logger.Debug("file content restored successfully")
+	return nil
+}
+
+// writeFileMode writes a file with exactly the given permissions, which
+// os.WriteFile only applies to new files and subject to the umask
+func writeFileMode(path string, data []byte, mode os.FileMode) error {
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// mountLists name the files that record the mounts Prepare made over guest
+// files, so they are unmounted with the other exec mounts even after a crash
+var mountLists = []string{"resolv_conf_mounts", "services_mounts"}
+
+// recordMount remembers a mount made over a guest file in one of mountLists
+func (e *Executor) recordMount(mountPoint string, list string, target string) error {
+	f, err := os.OpenFile(mountFile(mountPoint, list), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, target)
+	return err
+}
+
+// FileMounts returns the mounts made over guest files in a mount point, like
+// the one for resolv.conf, in the order they were made
+func (e *Executor) FileMounts(mountPoint string) []string {
+	var targets []string
+	prefix := filepath.Clean(mountPoint) + "/"
+	for _, list := range mountLists {
+		data, err := os.ReadFile(mountFile(mountPoint, list))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			// Never unmount anything outside of the guest
+			if strings.HasPrefix(line, prefix) {
+				targets = append(targets, line)
+			}
+		}
+	}
+	return targets
+}
+
+// cleanupFileMounts unmounts what was mounted over guest files and removes
+// the generated files
+func (e *Executor) cleanupFileMounts(mountPoint string) error {
+	var errs []error
+	targets := e.FileMounts(mountPoint)
+	for i := len(targets) - 1; i >= 0; i-- {
+		if !e.isMounted(targets[i]) {
+			continue
+		}
+		logger.Debug("unmounting: %s", targets[i])
+		if err := exec.Command("umount", targets[i]).Run(); err != nil {
+			if err := exec.Command("umount", "-l", targets[i]).Run(); err != nil {
+				errs = append(errs, fmt.Errorf("failed to unmount %s: %w", targets[i], err))
+				continue
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, list := range mountLists {
+		os.Remove(mountFile(mountPoint, list))
+	}
+	os.Remove(mountFile(mountPoint, "resolv_conf"))
+	for _, f := range guestFiles {
+		os.Remove(f.overridePath(mountPoint))
+	}
+	return nil
+}
+
+// RestoreFiles puts back every guest file that has a backup and removes the backups
+func (e *Executor) RestoreFiles(mountPoint string) error {
+	var firstErr error
+	for _, f := range guestFiles {
+		if !f.hasBackup(mountPoint) {
+			continue
+		}
+		if err := e.restoreFile(mountPoint, f); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to restore %s: %w", f.name, err)
+			}
+			continue
+		}
+		backupPath, symlinkBackupPath := f.backupPaths(mountPoint)
+		os.Remove(backupPath)
+		os.Remove(symlinkBackupPath)
+	}
+	return firstErr
+}
+
+// BackupPaths returns the paths backups of the guest's files and the
+// generated resolv.conf and scripts for a mount point are kept at
+func (e *Executor) BackupPaths(mountPoint string) []string {
+	var paths []string
+	for _, f := range guestFiles {
+		key := strings.ReplaceAll(f.name, ".", "_")
+		paths = append(paths, mountFile(mountPoint, key+"_backup"), mountFile(mountPoint, key+"_symlink"), f.overridePath(mountPoint))
+		if legacyBackup, legacySymlink := f.legacyBackupPaths(mountPoint); legacyBackup != "" {
+			paths = append(paths, legacyBackup, legacySymlink)
+		}
+	}
+	return append(paths, mountFile(mountPoint, "resolv_conf"), mountFile(mountPoint, "resolv_conf_mounts"), mountFile(mountPoint, "services_mounts"))
+}
+
+// HasBackup reports whether backups of guest files exist for a mount point
+func (e *Executor) HasBackup(mountPoint string) bool {
+	for _, f := range guestFiles {
+		if f.hasBackup(mountPoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanupBackupFiles removes backup files for a mount point
+func (e *Executor) CleanupBackupFiles(mountPoint string) error {
+	for _, path := range e.BackupPaths(mountPoint) {
+		os.Remove(path)
+	}
+	return nil
+}
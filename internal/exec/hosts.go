@@ -0,0 +1,97 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultHosts is used for guests without an /etc/hosts
+const defaultHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+`
+
+// HostEntry is a name and address added to the guest's /etc/hosts
+type HostEntry struct {
+	Name string
+	IP   string
+}
+
+// ParseHost parses a host entry given as name:ip
+func ParseHost(spec string) (HostEntry, error) {
+	name, ip, ok := strings.Cut(spec, ":")
+	if !ok || name == "" {
+		return HostEntry{}, fmt.Errorf("invalid host %s, use name:ip", spec)
+	}
+	if net.ParseIP(ip) == nil {
+		return HostEntry{}, fmt.Errorf("invalid IP address in %s", spec)
+	}
+	if err := ValidateHostname(name); err != nil {
+		return HostEntry{}, err
+	}
+	return HostEntry{Name: name, IP: ip}, nil
+}
+
+// ValidateHostname checks that name can be used as a hostname
+func ValidateHostname(name string) error {
+	// The kernel limits hostnames to 64 bytes
+	if name == "" || len(name) > 64 || validateDomain(name) != nil {
+		return fmt.Errorf("invalid hostname %q: must be 1 to 64 letters, digits, dots and dashes", name)
+	}
+	return nil
+}
+
+// validateDomain checks that name is a valid DNS name
+func validateDomain(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid length")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid label %q", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid character %q", c)
+			}
+		}
+	}
+	return nil
+}
+
+// setupHosts writes an /etc/hosts that extends the guest's own with the
+// hostname and the extra hosts, and an /etc/hostname if a hostname is given
+func (e *Executor) setupHosts(mountPoint string, hostname string, extraHosts []HostEntry) error {
+	hostsFile := lookupGuestFile("hosts")
+	original, err := e.originalContent(mountPoint, hostsFile)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(original)) == 0 {
+		original = []byte(defaultHosts)
+	}
+
+	var b bytes.Buffer
+	b.Write(original)
+	if !bytes.HasSuffix(original, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	b.WriteString("# Added by qimi exec, removed when the command ends\n")
+	if hostname != "" {
+		// Debian's convention, so the name resolves without a network
+		fmt.Fprintf(&b, "127.0.1.1\t%s\n", hostname)
+	}
+	for _, h := range extraHosts {
+		fmt.Fprintf(&b, "%s\t%s\n", h.IP, h.Name)
+	}
+
+	if err := e.replaceFile(mountPoint, hostsFile, b.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if hostname == "" {
+		return nil
+	}
+	return e.replaceFile(mountPoint, lookupGuestFile("hostname"), []byte(hostname+"\n"), 0644)
+}
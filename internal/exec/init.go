@@ -0,0 +1,323 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/cgroup"
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/security"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// InitCommand is the hidden qimi command that finishes setting up the
+// namespaces and privileges of a command before running it, see Init
+const InitCommand = "__init"
+
+// cgroupKillTimeout is how long the processes of a command get to die once it exited
+const cgroupKillTimeout = 5 * time.Second
+
+// initFD is the descriptor the init helper reads its initConfig from. It
+// arrives once Start has set up everything outside of the command.
+const initFD = 3
+
+// initConfig tells the init helper what to set up inside the new namespaces
+type initConfig struct {
+	// Root is the mount point the helper chroots into
+	Root     string           `json:"root"`
+	Loopback bool             `json:"loopback,omitempty"`
+	Hostname string           `json:"hostname,omitempty"`
+	Security *security.Config `json:"security,omitempty"`
+	// Rootless makes the helper mount /proc, /sys, /dev, /tmp, ResolvConf
+	// and Overrides into Root itself, in the command's user namespace
+	Rootless bool `json:"rootless,omitempty"`
+	// ResolvConf is mounted over the guest's in the command's mount
+	// namespace, without root or for a private network
+	ResolvConf string `json:"resolv_conf,omitempty"`
+	// Overrides maps guest files to the files mounted over them
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// Isolate gives hardened commands a mount namespace of their own, see
+	// isolate, and makes the helper pivot into Root instead of chrooting
+	Isolate bool `json:"isolate,omitempty"`
+}
+
+// Cmd is a command chrooted into a prepared mount point. Commands that need
+// namespaces or restricted privileges start through the init helper, which
+// waits until Start has set up what has to be done from outside, like the
+// NAT of a private network.
+// With cgroup v2, commands run in a cgroup of their own, which enforces
+// their resource limits and takes down every process they left once they exit.
+type Cmd struct {
+	*exec.Cmd
+	opts   Options
+	init   *initConfig
+	ready  *os.File
+	nat    *nat
+	cgroup *cgroup.Cgroup
+	// resolvConf is the resolv.conf of a command with a private network
+	resolvConf string
+}
+
+// Start starts the command in its cgroup and sets up its namespaces
+func (c *Cmd) Start() error {
+	if err := c.createCgroup(); err != nil {
+		return err
+	}
+	if err := c.start(); err != nil {
+		c.removeCgroup()
+		c.removeResolvConf()
+		return err
+	}
+	return nil
+}
+
+// createCgroup creates the cgroup the command starts in. Without resource
+// limits, commands run without one where cgroup v2 is not usable.
+func (c *Cmd) createCgroup() error {
+	if config.Current().Rootless {
+		logger.Debug("running the command without a cgroup, creating one needs root")
+		return nil
+	}
+	id, err := utils.RandomID(8)
+	if err != nil {
+		return err
+	}
+	cg, err := cgroup.New(id, c.opts.Limits)
+	if err != nil {
+		if !c.opts.Limits.IsZero() {
+			return fmt.Errorf("failed to set up resource limits: %w", err)
+		}
+		logger.Debug("running the command without a cgroup: %v", err)
+		return nil
+	}
+
+	c.cgroup = cg
+	c.Cmd.SysProcAttr.UseCgroupFD = true
+	c.Cmd.SysProcAttr.CgroupFD = cg.FD()
+	return nil
+}
+
+// removeCgroup kills what is left of the command, reports its resource usage
+// and removes its cgroup
+func (c *Cmd) removeCgroup() {
+	if c.cgroup == nil {
+		return
+	}
+	if err := c.cgroup.Kill(cgroupKillTimeout); err != nil {
+		logger.Warn("failed to kill the processes of the command: %v", err)
+	}
+
+	if usage, err := c.cgroup.Usage(); err == nil {
+		if c.opts.Limits.IsZero() {
+			logger.Debug("resource usage: %s", usage)
+		} else {
+			logger.Info("resource usage: %s", usage)
+		}
+		if usage.OOMKills > 0 {
+			logger.Warn("%d process(es) were killed for exceeding the memory limit", usage.OOMKills)
+		}
+	}
+
+	if err := c.cgroup.Remove(); err != nil {
+		logger.Warn("%v", err)
+	}
+	c.cgroup = nil
+}
+
+func (c *Cmd) start() error {
+	if c.init == nil {
+		return c.Cmd.Start()
+	}
+
+	if c.opts.Network == NetworkPrivate {
+		resolvConf, err := privateResolvConf(c.opts)
+		if err != nil {
+			logger.Warn("failed to setup resolv.conf: %v", err)
+		} else {
+			c.resolvConf = resolvConf
+			c.init.ResolvConf = resolvConf
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	c.Cmd.ExtraFiles = []*os.File{r}
+	err = c.Cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	c.ready = w
+
+	if c.opts.Network == NetworkPrivate {
+		if c.nat, err = startNAT(c.Process.Pid, c.opts.Publish); err != nil {
+			// Closing the pipe without a configuration makes the helper exit without running the command
+			w.Close()
+			c.Cmd.Wait()
+			return fmt.Errorf("failed to set up private network: %w", err)
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(c.init)
+	w.Close()
+	return err
+}
+
+// Wait waits for the command to exit, kills the processes it left behind and
+// stops its networking
+func (c *Cmd) Wait() error {
+	err := c.Cmd.Wait()
+	c.removeCgroup()
+	c.removeResolvConf()
+	if c.nat != nil {
+		c.nat.stop()
+	}
+	return err
+}
+
+// removeResolvConf removes the resolv.conf of a command with a private
+// network, which stays mounted in its mount namespace as long as needed
+func (c *Cmd) removeResolvConf() {
+	if c.resolvConf != "" {
+		os.Remove(c.resolvConf)
+		c.resolvConf = ""
+	}
+}
+
+// Run starts the command and waits for it
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// wrap makes the command start through the init helper, which chroots
+// itself instead of chroot(1), so privileges can be dropped afterwards
+func (c *Cmd) wrap() error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the qimi executable: %w", err)
+	}
+
+	sec, err := c.opts.Security.Resolve()
+	if err != nil {
+		return err
+	}
+
+	// The chroot(1) arguments are the mount point and the command line
+	c.init = &initConfig{Root: c.Cmd.Args[1], Security: sec}
+	c.Cmd.Args = append([]string{self, InitCommand}, c.Cmd.Args[2:]...)
+	c.Cmd.Path = self
+
+	if c.opts.Network == NetworkNone || c.opts.Network == NetworkPrivate {
+		c.Cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+		c.init.Loopback = true
+	}
+	if c.opts.Network == NetworkPrivate {
+		// For the resolv.conf of the private network
+		c.Cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if c.opts.Security.Hardened {
+		c.Cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNS
+		c.init.Isolate = true
+	}
+	if c.opts.Hostname != "" {
+		c.Cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUTS
+		c.init.Hostname = c.opts.Hostname
+	}
+	if config.Current().Rootless {
+		c.rootless()
+	}
+	return nil
+}
+
+// Init runs as the init helper inside the new namespaces of a command: it
+// waits for its configuration from Start, sets up the namespaces, chroots
+// or pivots into the guest, restricts its privileges and replaces itself
+// with the command in args
+func Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+
+	// Capabilities, no_new_privs and seccomp filters belong to a thread, the
+	// one that executes the command
+	runtime.LockOSThread()
+
+	var config initConfig
+	ready := os.NewFile(initFD, "ready")
+	err := json.NewDecoder(ready).Decode(&config)
+	ready.Close()
+	if err != nil {
+		return errors.New("setup of the command failed")
+	}
+
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+
+	if config.Loopback {
+		if err := setLinkUp("lo"); err != nil {
+			return fmt.Errorf("failed to bring up loopback: %w", err)
+		}
+	}
+
+	if config.Rootless {
+		if err := setupRootlessMounts(config.Root, config.ResolvConf, config.Overrides); err != nil {
+			return err
+		}
+	} else if config.ResolvConf != "" || config.Isolate {
+		// The mounts must not reach the host or the other sessions of the guest
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("failed to make mounts private: %w", err)
+		}
+		if config.ResolvConf != "" {
+			if err := mountResolvConf(config.Root, config.ResolvConf); err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.Isolate {
+		if err := isolate(config.Root); err != nil {
+			return err
+		}
+	} else {
+		if err := syscall.Chroot(config.Root); err != nil {
+			return fmt.Errorf("failed to chroot to %s: %w", config.Root, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	// Looked up before a seccomp filter may get in the way
+	path, err := exec.LookPath(args[0])
+	if err != nil && !errors.Is(err, exec.ErrDot) {
+		return fmt.Errorf("failed to run command '%s': %w", args[0], err)
+	}
+
+	if config.Security != nil {
+		if err := config.Security.Apply(); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Exec(path, args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to run command '%s': %w", args[0], err)
+	}
+	return nil
+}
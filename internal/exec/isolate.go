@@ -0,0 +1,194 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// devices are the host devices hardened commands get in their /dev
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// devLinks are the symlinks of a minimal /dev
+var devLinks = [][2]string{
+	{"pts/ptmx", "ptmx"},
+	{"/proc/self/fd", "fd"},
+	{"/proc/self/fd/0", "stdin"},
+	{"/proc/self/fd/1", "stdout"},
+	{"/proc/self/fd/2", "stderr"},
+}
+
+// readOnlyPaths are made read-only for hardened commands, like Docker does
+var readOnlyPaths = []string{"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/sys"}
+
+// maskedPaths are hidden from hardened commands: files behind /dev/null,
+// directories behind an empty read-only tmpfs
+var maskedPaths = []string{
+	"/proc/acpi", "/proc/asound", "/proc/interrupts", "/proc/kcore", "/proc/keys",
+	"/proc/kmsg", "/proc/latency_stats", "/proc/sched_debug", "/proc/scsi",
+	"/proc/sysrq-trigger", "/proc/timer_list", "/proc/timer_stats",
+	"/sys/devices/virtual/powercap", "/sys/firmware",
+}
+
+// isolate confines a hardened command to the guest from inside its own
+// mount namespace, whose mounts must be private already: it gets a minimal
+// /dev instead of the host's, a read-only /proc/sys and /sys, masked kernel
+// interfaces, and the guest becomes its root through pivot_root, which
+// unlike chroot leaves no way back to the host's filesystem.
+func isolate(root string) error {
+	// pivot_root needs a mount point, and the copy keeps the mounts below
+	// root on the host as they are
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", root, err)
+	}
+
+	if err := setupDev(root); err != nil {
+		return err
+	}
+
+	for _, path := range readOnlyPaths {
+		if err := remountReadOnly(root, path); err != nil {
+			return err
+		}
+	}
+	for _, path := range maskedPaths {
+		if err := mask(root, path); err != nil {
+			return err
+		}
+	}
+
+	return pivotRoot(root)
+}
+
+// setupDev mounts a tmpfs over the guest's /dev with the host's devices
+// bound into it, and a devpts instance of its own
+func setupDev(root string) error {
+	dev, err := utils.SecureJoin(root, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=0755,size=65536k"); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at /dev: %w", err)
+	}
+
+	for _, name := range devices {
+		target := filepath.Join(dev, name)
+		if err := os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount(filepath.Join("/dev", name), target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind /dev/%s: %w", name, err)
+		}
+	}
+
+	pts := filepath.Join(dev, "pts")
+	if err := os.Mkdir(pts, 0755); err != nil {
+		return err
+	}
+	err = syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620,gid=5")
+	if errors.Is(err, syscall.EINVAL) {
+		// The tty group isn't mapped into the user namespace of rootless commands
+		err = syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount devpts: %w", err)
+	}
+
+	shm := filepath.Join(dev, "shm")
+	if err := os.Mkdir(shm, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777,size=65536k"); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at /dev/shm: %w", err)
+	}
+
+	for _, link := range devLinks {
+		if err := os.Symlink(link[0], filepath.Join(dev, link[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remountReadOnly makes a guest path read-only in the command's mount
+// namespace, if it exists
+func remountReadOnly(root, path string) error {
+	target, err := utils.SecureJoin(root, path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); err != nil {
+		return nil
+	}
+
+	if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", path, err)
+	}
+	// A remount must keep the flags a user namespace locked
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	if err := syscall.Mount(target, target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// mask hides a guest path in the command's mount namespace, if it exists
+func mask(root, path string) error {
+	target, err := utils.SecureJoin(root, path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil
+	}
+
+	if info.IsDir() {
+		err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY, "size=0")
+	} else {
+		err = syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mask %s: %w", path, err)
+	}
+	return nil
+}
+
+// pivotRoot makes root the root directory of the command's mount namespace
+// and detaches the host's
+func pivotRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	// The old root is stacked below the new one and unmounted right away
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		if !errors.Is(err, syscall.EINVAL) {
+			return fmt.Errorf("failed to pivot into %s: %w", root, err)
+		}
+		// An initramfs root can't be pivoted away from, move the guest over it
+		logger.Debug("pivot_root failed, moving %s to / instead: %v", root, err)
+		if err := syscall.Mount(".", "/", "", syscall.MS_MOVE, ""); err != nil {
+			return fmt.Errorf("failed to move %s to /: %w", root, err)
+		}
+		if err := syscall.Chroot("."); err != nil {
+			return err
+		}
+		return os.Chdir("/")
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach the host's root: %w", err)
+	}
+	return os.Chdir("/")
+}
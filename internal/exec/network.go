@@ -0,0 +1,317 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// Network modes of commands
+const (
+	// NetworkHost shares the host's network namespace
+	NetworkHost = "host"
+	// NetworkNone gives the command a network namespace with only loopback
+	NetworkNone = "none"
+	// NetworkPrivate gives the command its own network namespace with
+	// user-mode NAT to the outside, through pasta or slirp4netns
+	NetworkPrivate = "private"
+)
+
+// Addresses the guest reaches the host's resolver at in private mode
+const (
+	pastaDNS = "169.254.1.1"
+	slirpDNS = "10.0.2.3"
+)
+
+// PortMapping forwards a host port to a port of a command with a private network
+type PortMapping struct {
+	Proto     string
+	HostIP    string
+	HostPort  int
+	GuestPort int
+}
+
+// ParsePublish parses a port mapping given as [host-ip:]host-port:guest-port[/tcp|udp]
+// or as a single port used on both sides
+func ParsePublish(spec string) (PortMapping, error) {
+	m := PortMapping{Proto: "tcp"}
+
+	ports := spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		ports, m.Proto = spec[:i], spec[i+1:]
+		if m.Proto != "tcp" && m.Proto != "udp" {
+			return m, fmt.Errorf("invalid protocol in %s, use tcp or udp", spec)
+		}
+	}
+
+	parts := strings.Split(ports, ":")
+	switch len(parts) {
+	case 1:
+		parts = []string{parts[0], parts[0]}
+	case 2:
+	case 3:
+		if net.ParseIP(parts[0]) == nil {
+			return m, fmt.Errorf("invalid host address in %s", spec)
+		}
+		m.HostIP = parts[0]
+		parts = parts[1:]
+	default:
+		return m, fmt.Errorf("invalid port mapping %s", spec)
+	}
+
+	var err error
+	if m.HostPort, err = parsePort(parts[0]); err != nil {
+		return m, fmt.Errorf("invalid host port in %s: %w", spec, err)
+	}
+	if m.GuestPort, err = parsePort(parts[1]); err != nil {
+		return m, fmt.Errorf("invalid port in %s: %w", spec, err)
+	}
+	return m, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number", s)
+	}
+	return port, nil
+}
+
+// CheckNetwork validates the network options and that the tools they need are installed
+func CheckNetwork(opts Options) error {
+	switch opts.Network {
+	case "", NetworkHost, NetworkNone:
+		if len(opts.Publish) > 0 {
+			return errors.New("publishing ports needs --network private")
+		}
+		return nil
+	case NetworkPrivate:
+		if natTool() == "" {
+			return errors.New("--network private needs pasta (passt package) or slirp4netns")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid network mode %s, use host, none or private", opts.Network)
+	}
+}
+
+// natTool returns the user-mode networking tool for private networks, pasta if installed
+func natTool() string {
+	for _, tool := range []string{"pasta", "slirp4netns"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// natNameserver returns the address the NAT tool answers DNS queries on
+func natNameserver() string {
+	if filepath.Base(natTool()) == "pasta" {
+		return pastaDNS
+	}
+	return slirpDNS
+}
+
+// nat is the user-mode networking of a command with a private network
+type nat struct {
+	// cmd is the slirp4netns process
+	cmd *exec.Cmd
+	// pid is the pasta process, which daemonizes once the network is up
+	pid int
+	// dir holds the pid file or API socket
+	dir string
+}
+
+// startNAT connects the network namespace of process pid to the outside
+func startNAT(pid int, publish []PortMapping) (*nat, error) {
+	dir, err := os.MkdirTemp("", "qimi-net-")
+	if err != nil {
+		return nil, err
+	}
+	n := &nat{dir: dir}
+
+	tool := natTool()
+	if filepath.Base(tool) == "pasta" {
+		err = n.startPasta(tool, pid, publish)
+	} else {
+		err = n.startSlirp(tool, pid, publish)
+	}
+	if err != nil {
+		n.stop()
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *nat) startPasta(tool string, pid int, publish []PortMapping) error {
+	pidFile := filepath.Join(n.dir, "pasta.pid")
+	args := []string{
+		"--config-net", "--quiet",
+		"--netns", fmt.Sprintf("/proc/%d/ns/net", pid),
+		"--pid", pidFile,
+		// Keep the host's own addresses out of reach
+		"--no-map-gw",
+		"--dns-forward", pastaDNS,
+		"-T", "none", "-U", "none",
+	}
+	forwards := map[string][]string{"tcp": nil, "udp": nil}
+	for _, m := range publish {
+		spec := fmt.Sprintf("%d:%d", m.HostPort, m.GuestPort)
+		if m.HostIP != "" {
+			spec = m.HostIP + "/" + spec
+		}
+		forwards[m.Proto] = append(forwards[m.Proto], spec)
+	}
+	for _, f := range []struct{ proto, flag string }{{"tcp", "-t"}, {"udp", "-u"}} {
+		if len(forwards[f.proto]) == 0 {
+			args = append(args, f.flag, "none")
+		}
+		for _, spec := range forwards[f.proto] {
+			args = append(args, f.flag, spec)
+		}
+	}
+
+	// pasta returns once the network is configured and keeps running in the background
+	logger.Debug("starting pasta: %s %s", tool, strings.Join(args, " "))
+	if output, err := exec.Command(tool, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("pasta failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read pasta pid file: %w", err)
+	}
+	n.pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	return nil
+}
+
+func (n *nat) startSlirp(tool string, pid int, publish []PortMapping) error {
+	apiSocket := filepath.Join(n.dir, "slirp.sock")
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	args := []string{
+		"--configure", "--mtu=65520",
+		// Keep the host's own addresses out of reach
+		"--disable-host-loopback",
+		"--ready-fd=3",
+		"--api-socket", apiSocket,
+		strconv.Itoa(pid), "tap0",
+	}
+	logger.Debug("starting slirp4netns: %s %s", tool, strings.Join(args, " "))
+	n.cmd = exec.Command(tool, args...)
+	n.cmd.ExtraFiles = []*os.File{w}
+	err = n.cmd.Start()
+	w.Close()
+	if err != nil {
+		n.cmd = nil
+		return fmt.Errorf("failed to start slirp4netns: %w", err)
+	}
+
+	// slirp4netns writes to the ready descriptor once tap0 is configured
+	r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("slirp4netns did not start: %w", err)
+	}
+
+	for _, m := range publish {
+		if err := slirpForward(apiSocket, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slirpForward adds a port forwarding through the slirp4netns API socket
+func slirpForward(apiSocket string, m PortMapping) error {
+	conn, err := net.Dial("unix", apiSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to slirp4netns: %w", err)
+	}
+	defer conn.Close()
+
+	hostAddr := m.HostIP
+	if hostAddr == "" {
+		hostAddr = "0.0.0.0"
+	}
+	request := map[string]any{
+		"execute": "add_hostfwd",
+		"arguments": map[string]any{
+			"proto":      m.Proto,
+			"host_addr":  hostAddr,
+			"host_port":  m.HostPort,
+			"guest_port": m.GuestPort,
+		},
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return err
+	}
+	conn.(*net.UnixConn).CloseWrite()
+
+	var response struct {
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("invalid answer from slirp4netns: %w", err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("failed to publish port %d: %s", m.HostPort, response.Error.Desc)
+	}
+	return nil
+}
+
+// stop ends the user-mode networking
+func (n *nat) stop() {
+	if n.cmd != nil {
+		n.cmd.Process.Kill()
+		n.cmd.Wait()
+	}
+	if n.pid > 0 {
+		syscall.Kill(n.pid, syscall.SIGTERM)
+	}
+	os.RemoveAll(n.dir)
+}
+
+// ifreqFlags is struct ifreq with the interface flags member
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// setLinkUp brings up a network interface of the current network namespace
+func setLinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req ifreqFlags
+	copy(req.Name[:], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	req.Flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
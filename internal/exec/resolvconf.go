@@ -0,0 +1,246 @@
+package exec
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// CheckDNS validates the nameservers, search domains and resolver options
+func CheckDNS(opts Options) error {
+	for _, ns := range opts.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver IP address: %s", ns)
+		}
+	}
+	for _, domain := range opts.DNSSearch {
+		if err := validateDomain(strings.TrimSuffix(domain, ".")); err != nil {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	for _, option := range opts.DNSOptions {
+		if option == "" || strings.ContainsAny(option, " \t\n") {
+			return fmt.Errorf("invalid resolver option %q", option)
+		}
+	}
+	return nil
+}
+
+// setupResolvConf gives the guest the resolv.conf for opts without changing
+// the image: the generated file is bind-mounted over the guest's, or over
+// the file its symlink points to, like systemd-resolved's stub. A missing
+// file under /run gets a tmpfs there to mount over, as on a booted guest.
+// Only when there is nothing to mount over is the guest's file replaced.
+// Without root, the init helper of each command does the mounting.
+func (e *Executor) setupResolvConf(mountPoint string, content []byte) error {
+	generated := mountFile(mountPoint, "resolv_conf")
+	logger.Debug("writing resolv.conf for the guest: %s (%d bytes)", generated, len(content))
+	if err := os.MkdirAll(config.Current().FilesDir(), 0755); err != nil {
+		return err
+	}
+	// Written in place, so a mount over the guest's file shows the new content
+	if err := writeFileMode(generated, content, 0644); err != nil {
+		return err
+	}
+
+	target, err := utils.SecureJoin(mountPoint, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	guestTarget := strings.TrimPrefix(target, filepath.Clean(mountPoint))
+	logger.Debug("resolv.conf target in the guest: %s", guestTarget)
+
+	if e.isMounted(target) {
+		logger.Debug("resolv.conf is already mounted over: %s", target)
+		return nil
+	}
+
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", guestTarget)
+	case config.Current().Rootless && (err == nil || os.IsNotExist(err) && strings.HasPrefix(guestTarget, "/run/")):
+		logger.Debug("rootless: the init helper mounts resolv.conf in the command's mount namespace")
+		return nil
+	case os.IsNotExist(err) && strings.HasPrefix(guestTarget, "/run/"):
+		if err := e.mountRun(mountPoint); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, nil, 0644); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		logger.Debug("no resolv.conf to mount over, replacing the guest's")
+		etcDir, err := utils.SecureJoin(mountPoint, "/etc")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(etcDir, 0755); err != nil {
+			return fmt.Errorf("failed to create /etc directory: %w", err)
+		}
+		return e.replaceFile(mountPoint, lookupGuestFile("resolv.conf"), content, 0644)
+	case err != nil:
+		return err
+	}
+
+	logger.Debug("bind mounting %s over %s", generated, target)
+	if output, err := exec.Command("mount", "--bind", generated, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount resolv.conf: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return e.recordMount(mountPoint, "resolv_conf_mounts", target)
+}
+
+// mountRun mounts a tmpfs over the guest's /run
+func (e *Executor) mountRun(mountPoint string) error {
+	run, err := utils.SecureJoin(mountPoint, "/run")
+	if err != nil {
+		return err
+	}
+	if e.isMounted(run) {
+		return nil
+	}
+	if err := os.MkdirAll(run, 0755); err != nil {
+		return err
+	}
+
+	logger.Debug("mounting tmpfs at %s", run)
+	if output, err := exec.Command("mount", "-t", "tmpfs", "-o", "mode=0755", "tmpfs", run).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at /run: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return e.recordMount(mountPoint, "resolv_conf_mounts", run)
+}
+
+// mountResolvConf binds a generated resolv.conf over the guest's from inside
+// the mount namespace of a command, like setupResolvConf does on the host
+func mountResolvConf(root, generated string) error {
+	target, err := utils.SecureJoin(root, "/etc/resolv.conf")
+	if err != nil {
+		return err
+	}
+	guestTarget := strings.TrimPrefix(target, filepath.Clean(root))
+
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		// Prepare replaced the file, unless it belongs on /run
+		if !strings.HasPrefix(guestTarget, "/run/") {
+			return nil
+		}
+		run, err := utils.SecureJoin(root, "/run")
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", run, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+			return fmt.Errorf("failed to mount tmpfs at /run: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount(generated, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount resolv.conf: %w", err)
+	}
+	return nil
+}
+
+// privateResolvConf writes the resolv.conf of a command with a private
+// network, which can't reach resolvers on the host's loopback, like
+// systemd-resolved's stub. The init helper mounts it in the command's own
+// mount namespace, as sessions on the host network may share the guest.
+func privateResolvConf(opts Options) (string, error) {
+	nameservers := opts.Nameservers
+	if len(nameservers) == 0 {
+		nameservers = []string{natNameserver()}
+	}
+	content, err := resolvConf(nameservers, opts.DNSSearch, opts.DNSOptions)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(config.Current().FilesDir(), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(config.Current().FilesDir(), "resolv_conf_private_")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// resolvConf returns the resolv.conf for the guest: one listing the given
+// nameservers, or the host's, with the given search domains and options
+func resolvConf(nameservers []string, search []string, options []string) ([]byte, error) {
+	var lines []string
+	if len(nameservers) > 0 {
+		logger.Debug("using custom nameservers: %v", nameservers)
+		for _, ns := range nameservers {
+			if ip := net.ParseIP(ns); ip == nil {
+				logger.Error("invalid nameserver IP address: %s", ns)
+				return nil, fmt.Errorf("invalid nameserver IP address: %s", ns)
+			}
+			lines = append(lines, fmt.Sprintf("nameserver %s", ns))
+		}
+	} else {
+		logger.Debug("using host resolv.conf")
+		// Read host resolv.conf, following symlinks
+		var hostContent []byte
+		realPath, err := filepath.EvalSymlinks("/etc/resolv.conf")
+		if err != nil {
+			logger.Debug("symlink resolution failed, falling back to direct read: %v", err)
+			// Fallback to direct read if symlink resolution fails
+			hostContent, err = os.ReadFile("/etc/resolv.conf")
+		} else {
+			logger.Debug("resolved symlink: /etc/resolv.conf -> %s", realPath)
+			hostContent, err = os.ReadFile(realPath)
+		}
+		if err != nil {
+			logger.Error("failed to read host resolv.conf: %v", err)
+			return nil, err
+		}
+		logger.Debug("read host resolv.conf content (%d bytes)", len(hostContent))
+		lines = strings.Split(strings.TrimRight(string(hostContent), "\n"), "\n")
+	}
+
+	if len(search) > 0 {
+		// The last search or domain line wins, drop the host's
+		kept := lines[:0]
+		for _, line := range lines {
+			if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		lines = append(kept, "search "+strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		lines = append(lines, "options "+strings.Join(options, " "))
+	}
+
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	logger.Debug("generated resolv.conf content (%d bytes)", len(content))
+	return content, nil
+}
@@ -0,0 +1,113 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// CheckRootless rejects options that need root when qimi runs without it
+func CheckRootless(opts Options) error {
+	if !config.Current().Rootless {
+		return nil
+	}
+	if opts.Network == NetworkPrivate {
+		return errors.New("--network private needs root, use --network host or none")
+	}
+	if !opts.Limits.IsZero() {
+		return errors.New("resource limits need root, qimi can't create cgroups without it")
+	}
+	return nil
+}
+
+// rootless makes the command start in a user namespace, in which the user
+// running qimi is root, with a mount namespace of its own for the mounts
+// Prepare makes on the host with root
+func (c *Cmd) rootless() {
+	c.Cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	c.Cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	c.Cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	// Without newgidmap, a single gid is only mapped once setgroups is denied
+	c.Cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+
+	c.init.Rootless = true
+	if generated := mountFile(c.init.Root, "resolv_conf"); fileExists(generated) {
+		c.init.ResolvConf = generated
+	}
+	for _, name := range serviceFiles {
+		f := lookupGuestFile(name)
+		generated := f.overridePath(c.init.Root)
+		if !fileExists(generated) {
+			continue
+		}
+		if target, err := overrideTarget(c.init.Root, f); err == nil && target != "" {
+			if c.init.Overrides == nil {
+				c.init.Overrides = make(map[string]string)
+			}
+			c.init.Overrides[strings.TrimPrefix(target, filepath.Clean(c.init.Root))] = generated
+		}
+	}
+}
+
+// setupRootlessMounts mounts /proc, /sys, /dev, /tmp, resolv.conf and the
+// overridden guest files into the guest from inside the command's user and
+// mount namespaces. The user namespace can't mount a fresh proc or sysfs, so
+// the host's are bound.
+func setupRootlessMounts(root, resolvConf string, overrides map[string]string) error {
+	// Nothing mounted here may reach the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	for _, m := range MountNamespaces {
+		target, err := utils.SecureJoin(root, m.target)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			logger.Debug("failed to create directory %s: %v, skipping", target, err)
+			continue
+		}
+
+		switch m.fstype {
+		case "tmpfs":
+			err = syscall.Mount(m.source, target, m.fstype, syscall.MS_NOSUID|syscall.MS_NODEV, "")
+		case "rbind", "bind":
+			err = syscall.Mount(m.source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		default:
+			err = syscall.Mount(m.target, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+
+	if resolvConf != "" {
+		if err := mountResolvConf(root, resolvConf); err != nil {
+			logger.Warn("failed to setup resolv.conf: %v", err)
+		}
+	}
+
+	for guestPath, generated := range overrides {
+		target, err := utils.SecureJoin(root, guestPath)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount(generated, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to mount over %s: %w", guestPath, err)
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
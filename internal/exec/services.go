@@ -0,0 +1,157 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// policyRCD makes invoke-rc.d, which Debian package scripts start services
+// with, refuse every action (see README.policy-rc.d in init-system-helpers)
+const policyRCD = `#!/bin/sh
+# Installed by qimi exec, removed when the command ends
+exit 101
+`
+
+// noopScript replaces the tools package scripts start services with directly
+const noopScript = `#!/bin/sh
+# Installed by qimi exec, the original is restored when the command ends
+echo "qimi: not running %s $*, services are disabled during qimi exec" >&2
+exit 0
+`
+
+// serviceFiles are the guest files disableServices overrides
+var serviceFiles = []string{"policy-rc.d", "systemctl", "start-stop-daemon"}
+
+// disableServices keeps package scripts from starting daemons, which would
+// run on the host and keep the mount busy: it installs a policy-rc.d that
+// denies everything and replaces systemctl and start-stop-daemon with no-ops.
+// Like resolv.conf, the scripts are bind-mounted over the guest's files, so
+// read-only guests work too; a missing policy-rc.d has nothing to mount over
+// and is written to the guest, unless the guest is read-only.
+func (e *Executor) disableServices(mountPoint string, readOnly bool) error {
+	for _, name := range serviceFiles {
+		f := lookupGuestFile(name)
+		path, err := f.hostPath(mountPoint)
+		if err != nil {
+			return err
+		}
+
+		content := []byte(fmt.Sprintf(noopScript, name))
+		if name == "policy-rc.d" {
+			// Guests without /usr/sbin don't use invoke-rc.d
+			if _, err := os.Stat(filepath.Dir(path)); err != nil {
+				continue
+			}
+			content = []byte(policyRCD)
+		} else if _, err := os.Lstat(path); err != nil {
+			logger.Debug("%s not found in guest, nothing to replace", name)
+			continue
+		}
+
+		target, err := overrideTarget(mountPoint, f)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			if readOnly {
+				logger.Debug("%s not found in read-only guest, nothing to mount over", name)
+				continue
+			}
+			if err := e.replaceFile(mountPoint, f, content, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.overrideFile(mountPoint, f, target, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServicesAllowed reports whether package scripts in a guest can start
+// services, because it has the tools for that and disableServices didn't
+// override them
+func (e *Executor) ServicesAllowed(mountPoint string) bool {
+	for _, name := range serviceFiles {
+		f := lookupGuestFile(name)
+		path, err := f.hostPath(mountPoint)
+		if err != nil {
+			continue
+		}
+		if name == "policy-rc.d" {
+			path = filepath.Dir(path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if !exists(f.overridePath(mountPoint)) && !f.hasBackup(mountPoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServicesDisabled reports whether disableServices overrode any of the
+// guest's tools to start services
+func (e *Executor) ServicesDisabled(mountPoint string) bool {
+	for _, name := range serviceFiles {
+		f := lookupGuestFile(name)
+		if exists(f.overridePath(mountPoint)) || f.hasBackup(mountPoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideTarget returns the regular file a guest file is, or links to
+// inside the guest, or "" if there is none
+func overrideTarget(mountPoint string, f guestFile) (string, error) {
+	path, err := f.hostPath(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	target, err := utils.SecureJoin(mountPoint, strings.TrimPrefix(path, filepath.Clean(mountPoint)))
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(target); err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	return target, nil
+}
+
+// overrideFile writes content next to the backups of a mount point and
+// bind-mounts it over target. Without root, the init helper of each command
+// does the mounting.
+func (e *Executor) overrideFile(mountPoint string, f guestFile, target string, content []byte) error {
+	generated := f.overridePath(mountPoint)
+	if err := os.MkdirAll(config.Current().FilesDir(), 0755); err != nil {
+		return err
+	}
+	if err := writeFileMode(generated, content, 0755); err != nil {
+		return err
+	}
+
+	if config.Current().Rootless {
+		logger.Debug("rootless: the init helper mounts %s in the command's mount namespace", f.name)
+		return nil
+	}
+	if e.isMounted(target) {
+		logger.Debug("%s is already mounted over: %s", f.name, target)
+		return nil
+	}
+
+	logger.Debug("bind mounting %s over %s", generated, target)
+	if output, err := exec.Command("mount", "--bind", generated, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount over %s: %v: %s", f.name, err, strings.TrimSpace(string(output)))
+	}
+	return e.recordMount(mountPoint, "services_mounts", target)
+}
@@ -0,0 +1,120 @@
+package fstab
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Entry is a single line of an fstab(5) file
+type Entry struct {
+	Spec    string
+	File    string
+	VfsType string
+	Options []string
+	Freq    int
+	PassNo  int
+}
+
+// HasOption reports whether the entry has the given mount option
+func (e Entry) HasOption(name string) bool {
+	for _, opt := range e.Options {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Option returns the value of a key=value mount option
+func (e Entry) Option(name string) (string, bool) {
+	for _, opt := range e.Options {
+		if key, value, ok := strings.Cut(opt, "="); ok && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ParseFile reads and parses an fstab file
+func ParseFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses fstab(5) formatted data. Comments and blank lines are skipped,
+// octal escapes such as \040 are decoded.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least 2 fields, got %d", lineNum, len(fields))
+		}
+
+		entry := Entry{
+			Spec:    Unescape(fields[0]),
+			File:    Unescape(fields[1]),
+			VfsType: "auto",
+			Options: []string{"defaults"},
+		}
+		if len(fields) > 2 {
+			entry.VfsType = Unescape(fields[2])
+		}
+		if len(fields) > 3 {
+			entry.Options = strings.Split(Unescape(fields[3]), ",")
+		}
+		if len(fields) > 4 {
+			entry.Freq, _ = strconv.Atoi(fields[4])
+		}
+		if len(fields) > 5 {
+			entry.PassNo, _ = strconv.Atoi(fields[5])
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Unescape decodes the octal escapes fstab and /proc/self/mountinfo use for
+// whitespace and backslashes
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package fstab
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	data := `# /etc/fstab: static file system information
+UUID=1234-abcd  /               ext4    errors=remount-ro 0       1
+
+	# indented comment
+/dev/sda2       /home/My\040Files xfs   defaults,noatime,x-systemd.device-timeout=5 0 2
+LABEL=swap      none            swap    sw              0       0
+tmpfs           /tmp
+server:/export  /mnt/nfs        nfs     ro
+`
+	entries, err := Parse(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Entry{
+		{Spec: "UUID=1234-abcd", File: "/", VfsType: "ext4", Options: []string{"errors=remount-ro"}, PassNo: 1},
+		{Spec: "/dev/sda2", File: "/home/My Files", VfsType: "xfs", Options: []string{"defaults", "noatime", "x-systemd.device-timeout=5"}, PassNo: 2},
+		{Spec: "LABEL=swap", File: "none", VfsType: "swap", Options: []string{"sw"}},
+		{Spec: "tmpfs", File: "/tmp", VfsType: "auto", Options: []string{"defaults"}},
+		{Spec: "server:/export", File: "/mnt/nfs", VfsType: "nfs", Options: []string{"ro"}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v\nwant %+v", entries, want)
+	}
+
+	if !entries[1].HasOption("noatime") || entries[1].HasOption("noatim") {
+		t.Error("HasOption does not match whole options")
+	}
+	if value, ok := entries[1].Option("x-systemd.device-timeout"); !ok || value != "5" {
+		t.Errorf("got option value %q, %v", value, ok)
+	}
+	if _, ok := entries[1].Option("noatime"); ok {
+		t.Error("Option found a value for an option without one")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse(strings.NewReader("# comment\n/dev/sda1\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got %v, want an error for line 2", err)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`/mnt/plain`, `/mnt/plain`},
+		{`/mnt/a\040b`, `/mnt/a b`},
+		{`/mnt/tab\011end`, "/mnt/tab\tend"},
+		{`back\134slash`, `back\slash`},
+		{`/mnt/\04`, `/mnt/\04`},
+		{`/mnt/\999`, `/mnt/\999`},
+		{`trailing\`, `trailing\`},
+	}
+	for _, tt := range tests {
+		if got := Unescape(tt.in); got != tt.want {
+			t.Errorf("Unescape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package luks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// FSType is the filesystem type blkid reports for LUKS1 and LUKS2 devices
+const FSType = "crypto_LUKS"
+
+// Available reports whether cryptsetup is installed
+func Available() bool {
+	_, err := exec.LookPath("cryptsetup")
+	return err == nil
+}
+
+// MapperPath returns the device-mapper path of an open mapping
+func MapperPath(name string) string {
+	return "/dev/mapper/" + name
+}
+
+// Open unlocks a LUKS device as /dev/mapper/<name>. If keyFile is set it is
+// passed to cryptsetup as-is, otherwise passphrase is used.
+func Open(device, name, keyFile string, passphrase []byte, readOnly bool) (string, error) {
+	args := []string{"open", "--type", "luks"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+
+	var stdin []byte
+	if keyFile != "" {
+		args = append(args, "--key-file", keyFile)
+	} else {
+		// Passing the passphrase on stdin keeps it out of the process list
+		args = append(args, "--key-file", "-")
+		stdin = passphrase
+	}
+	args = append(args, device, name)
+
+	logger.Debug("executing: cryptsetup %s", strings.Join(args, " "))
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to unlock %s: %w: %s", device, err, strings.TrimSpace(string(output)))
+	}
+
+	return MapperPath(name), nil
+}
+
+// Close closes the mapping with the given name
+func Close(name string) error {
+	logger.Debug("closing LUKS mapping %s", name)
+	cmd := exec.Command("cryptsetup", "close", name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to close %s: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// IsWrongPassphrase reports whether an Open error was caused by a wrong passphrase or key
+func IsWrongPassphrase(err error) bool {
+	// cryptsetup exits with 2 when no key slot could be unlocked
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 2
+}
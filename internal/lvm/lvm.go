@@ -0,0 +1,339 @@
+package lvm
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// PVFSType is the filesystem type blkid reports for LVM physical volumes
+const PVFSType = "LVM2_member"
+
+// rootVolumeNames are logical volume names commonly used for the root filesystem
+var rootVolumeNames = []string{"root", "lv_root", "rootlv", "root_lv", "lvroot"}
+
+// VolumeGroup is a volume group found on an image
+type VolumeGroup struct {
+	// Name is the name the volume group is activated under on the host
+	Name string `json:"name"`
+	// OriginalName is the name inside the image. It differs from Name when
+	// the volume group clashed with a host volume group and was imported
+	// under a temporary name.
+	OriginalName string   `json:"original_name"`
+	UUID         string   `json:"uuid"`
+	PVs          []string `json:"pvs"`
+}
+
+// LogicalVolume is an active logical volume of an image's volume group
+type LogicalVolume struct {
+	Name string
+	VG   VolumeGroup
+	Path string
+	Size int64
+}
+
+// String returns the vg/lv name as the guest knows it
+func (lv LogicalVolume) String() string {
+	return lv.VG.OriginalName + "/" + lv.Name
+}
+
+// Available reports whether the LVM tools are installed
+func Available() bool {
+	_, err := exec.LookPath("lvm")
+	return err == nil
+}
+
+// Activate finds the volume groups on the given physical volumes and activates them.
+// LVM only ever sees the given devices, so host volume groups are never touched.
+// A volume group whose name clashes with a host volume group is imported under
+// tempPrefix+name with vgimportclone. That assigns new PV and VG UUIDs, so it
+// is done on overlays of its physical volumes that keep the new metadata out
+// of the image.
+func Activate(pvs []string, readOnly bool, tempPrefix string) ([]VolumeGroup, error) {
+	config := deviceConfig(pvs, readOnly)
+
+	output, err := run(config, "pvs", "--noheadings", "--separator", "|", "--units", "s", "--nosuffix",
+		"-o", "pv_name,vg_name,vg_uuid,pe_start,pv_mda_count")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan physical volumes: %w", err)
+	}
+
+	var groups []VolumeGroup
+	index := make(map[string]int)
+	physical := make(map[string]physicalVolume)
+	for _, fields := range parseRows(output, 5) {
+		pv, name, uuid := fields[0], fields[1], fields[2]
+		if name == "" {
+			logger.Debug("physical volume %s is not part of a volume group", pv)
+			continue
+		}
+		peStart, _ := strconv.ParseInt(fields[3], 10, 64)
+		mdaCount, _ := strconv.Atoi(fields[4])
+		physical[pv] = physicalVolume{peStart: peStart, mdaCount: mdaCount}
+
+		if i, ok := index[name]; ok {
+			groups[i].PVs = append(groups[i].PVs, pv)
+			continue
+		}
+		index[name] = len(groups)
+		groups = append(groups, VolumeGroup{Name: name, OriginalName: name, UUID: uuid, PVs: []string{pv}})
+	}
+
+	hostGroups, err := hostVolumeGroups()
+	if err != nil {
+		logger.Debug("failed to list host volume groups: %v", err)
+	}
+
+	var activated []VolumeGroup
+	for _, vg := range groups {
+		if clashes(hostGroups[vg.Name], vg.UUID) {
+			imported, err := importClone(vg, physical, readOnly, tempPrefix+vg.Name)
+			if err != nil {
+				Deactivate(activated)
+				return nil, err
+			}
+			vg = imported
+		}
+
+		activateConfig := deviceConfig(vg.PVs, readOnly)
+		if readOnly {
+			activateConfig += fmt.Sprintf(` activation { read_only_volume_list = [ "%s" ] }`, vg.Name)
+		}
+
+		logger.Debug("activating volume group %s on %s", vg.Name, strings.Join(vg.PVs, ", "))
+		if _, err := run(activateConfig, "vgchange", "-ay", vg.Name); err != nil {
+			Deactivate(append(activated, vg))
+			return nil, fmt.Errorf("failed to activate volume group %s: %w", vg.Name, err)
+		}
+		activated = append(activated, vg)
+	}
+
+	return activated, nil
+}
+
+// importClone imports a volume group that clashes with a host volume group
+// under tempName, on overlays of its physical volumes
+func importClone(vg VolumeGroup, physical map[string]physicalVolume, readOnly bool, tempName string) (VolumeGroup, error) {
+	logger.Info("volume group %s clashes with a host volume group, importing it as %s", vg.Name, tempName)
+
+	var overlays []string
+	removeOverlays := func() {
+		for _, path := range overlays {
+			removeOverlay(path)
+		}
+	}
+	for _, pv := range vg.PVs {
+		path, err := createOverlay(pv, overlayName(strings.TrimSuffix(tempName, vg.Name), pv), physical[pv], readOnly)
+		if err != nil {
+			removeOverlays()
+			return vg, fmt.Errorf("failed to import volume group %s: %w", vg.Name, err)
+		}
+		overlays = append(overlays, path)
+	}
+
+	// The overlays take the writes, even in read-only mode
+	config := deviceConfig(overlays, false)
+	args := append([]string{"vgimportclone", "--basevgname", tempName}, overlays...)
+	if _, err := run(config, args...); err != nil {
+		removeOverlays()
+		return vg, fmt.Errorf("failed to import volume group %s as %s: %w", vg.Name, tempName, err)
+	}
+	vg.Name = tempName
+	vg.PVs = overlays
+
+	// vgimportclone assigns a new VG UUID
+	if output, err := run(config, "vgs", "--noheadings", "-o", "vg_uuid", vg.Name); err == nil {
+		vg.UUID = strings.TrimSpace(output)
+	}
+	return vg, nil
+}
+
+// Deactivate deactivates the given volume groups in reverse order and removes
+// the overlays of volume groups that were imported under a temporary name.
+// Older versions imported them in the image itself, those are renamed back
+// to their original name.
+func Deactivate(groups []VolumeGroup) error {
+	var errs []string
+	for i := len(groups) - 1; i >= 0; i-- {
+		vg := groups[i]
+		config := deviceConfig(vg.PVs, false)
+
+		logger.Debug("deactivating volume group %s", vg.Name)
+		if _, err := run(config, "vgchange", "-an", vg.Name); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to deactivate %s: %v", vg.Name, err))
+			continue
+		}
+
+		if vg.Name == vg.OriginalName {
+			continue
+		}
+		for _, pv := range vg.PVs {
+			if isOverlay(pv) {
+				if err := removeOverlay(pv); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+		}
+		if len(vg.PVs) > 0 && !isOverlay(vg.PVs[0]) {
+			logger.Debug("renaming volume group %s back to %s", vg.Name, vg.OriginalName)
+			if _, err := run(config, "vgrename", vg.Name, vg.OriginalName); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to rename %s back to %s: %v", vg.Name, vg.OriginalName, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LogicalVolumes lists the active logical volumes of the given volume groups
+func LogicalVolumes(groups []VolumeGroup) ([]LogicalVolume, error) {
+	var lvs []LogicalVolume
+	for _, vg := range groups {
+		output, err := run(deviceConfig(vg.PVs, true), "lvs", "--noheadings", "--separator", "|",
+			"--units", "b", "--nosuffix", "-o", "lv_name,lv_attr,lv_size", vg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list logical volumes of %s: %w", vg.Name, err)
+		}
+
+		for _, fields := range parseRows(output, 3) {
+			name, attr := fields[0], fields[1]
+			// Skip thin pools and volumes that didn't activate
+			if len(attr) < 5 || attr[0] == 't' || attr[4] != 'a' {
+				logger.Debug("skipping logical volume %s/%s (attributes %s)", vg.Name, name, attr)
+				continue
+			}
+
+			size, _ := strconv.ParseInt(fields[2], 10, 64)
+			lvs = append(lvs, LogicalVolume{
+				Name: name,
+				VG:   vg,
+				Path: MapperPath(vg.Name, name),
+				Size: size,
+			})
+		}
+	}
+
+	return lvs, nil
+}
+
+// Find returns the logical volume named vg/lv, using the volume group name inside the image
+func Find(lvs []LogicalVolume, spec string) (LogicalVolume, error) {
+	vgName, lvName, ok := strings.Cut(spec, "/")
+	if !ok {
+		return LogicalVolume{}, fmt.Errorf("invalid logical volume %q, expected vg/lv", spec)
+	}
+
+	for _, lv := range lvs {
+		if lv.Name == lvName && (lv.VG.OriginalName == vgName || lv.VG.Name == vgName) {
+			return lv, nil
+		}
+	}
+
+	var available []string
+	for _, lv := range lvs {
+		available = append(available, lv.String())
+	}
+	return LogicalVolume{}, fmt.Errorf("logical volume %s not found (available: %s)", spec, strings.Join(available, ", "))
+}
+
+// RootVolume returns the logical volume whose name suggests it holds the root filesystem
+func RootVolume(lvs []LogicalVolume) (LogicalVolume, bool) {
+	for _, name := range rootVolumeNames {
+		for _, lv := range lvs {
+			if lv.Name == name {
+				return lv, true
+			}
+		}
+	}
+	return LogicalVolume{}, false
+}
+
+// MapperPath returns the device-mapper path of a logical volume.
+// Device-mapper escapes dashes in VG and LV names by doubling them.
+func MapperPath(vg, lv string) string {
+	return "/dev/mapper/" + strings.ReplaceAll(vg, "-", "--") + "-" + strings.ReplaceAll(lv, "-", "--")
+}
+
+// deviceConfig restricts LVM to the given devices. The devices file is disabled
+// since it would hide NBD devices that were never registered with the host.
+func deviceConfig(pvs []string, readOnly bool) string {
+	var rules []string
+	for _, pv := range pvs {
+		rules = append(rules, fmt.Sprintf(`"a|^%s$|"`, regexp.QuoteMeta(pv)))
+	}
+	rules = append(rules, `"r|.*|"`)
+	filter := strings.Join(rules, ", ")
+
+	config := fmt.Sprintf("devices { use_devicesfile = 0 filter = [ %s ] global_filter = [ %s ] }", filter, filter)
+	if readOnly {
+		config += " global { metadata_read_only = 1 }"
+	}
+	return config
+}
+
+// hostVolumeGroups returns the UUIDs of the volume groups visible to the host, by name
+func hostVolumeGroups() (map[string][]string, error) {
+	output, err := run("", "vgs", "--noheadings", "--separator", "|", "-o", "vg_name,vg_uuid")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]string)
+	for _, fields := range parseRows(output, 2) {
+		groups[fields[0]] = append(groups[fields[0]], fields[1])
+	}
+	return groups, nil
+}
+
+// clashes reports whether the host has a different volume group with the same name
+func clashes(hostUUIDs []string, uuid string) bool {
+	for _, hostUUID := range hostUUIDs {
+		if hostUUID != uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func run(config string, args ...string) (string, error) {
+	if config != "" {
+		args = append(args, "--config", config)
+	}
+
+	cmd := exec.Command("lvm", args...)
+	logger.Debug("executing: lvm %s", strings.Join(args, " "))
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+func parseRows(output string, columns int) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if len(fields) < columns {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		rows = append(rows, fields)
+	}
+	return rows
+}
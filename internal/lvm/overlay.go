@@ -0,0 +1,179 @@
+package lvm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// overlayCOWSize is the size of the sparse file that takes the writes to an
+// overlay. Importing a volume group only rewrites its metadata.
+const overlayCOWSize = 64 << 20
+
+const (
+	loopCtlGetFree   = 0x4C82
+	loopSetFD        = 0x4C00
+	loopClrFD        = 0x4C01
+	loopSetStatus64  = 0x4C04
+	loFlagsAutoclear = 4
+)
+
+// loopInfo64 is struct loop_info64 from linux/loop.h
+type loopInfo64 struct {
+	device         uint64
+	inode          uint64
+	rdevice        uint64
+	offset         uint64
+	sizeLimit      uint64
+	number         uint32
+	encryptType    uint32
+	encryptKeySize uint32
+	flags          uint32
+	fileName       [64]byte
+	cryptName      [64]byte
+	encryptKey     [32]byte
+	init           [2]uint64
+}
+
+// physicalVolume is what Activate needs to know about a physical volume to
+// stack an overlay on it
+type physicalVolume struct {
+	// peStart is where the data area starts, in 512 byte sectors. Everything
+	// before it is the label and the metadata area.
+	peStart int64
+	// mdaCount is the number of metadata areas, a second one sits at the end
+	mdaCount int
+}
+
+// overlayName returns the device mapper name of the overlay of a physical volume
+func overlayName(tempPrefix, pv string) string {
+	return tempPrefix + "overlay_" + filepath.Base(pv)
+}
+
+// isOverlay reports whether a physical volume recorded for a volume group is
+// an overlay rather than a device of the image
+func isOverlay(pv string) bool {
+	return strings.HasPrefix(pv, "/dev/mapper/")
+}
+
+// createOverlay stacks a device mapper device on a physical volume that sends
+// the writes to its label and metadata area to a throwaway copy-on-write
+// file, so vgimportclone can give its volume group new UUIDs without changing
+// the image. The data area is mapped straight to the physical volume so
+// writes to logical volumes still reach the image, unless readOnly is set, in
+// which case every write is thrown away. It returns the overlay's path.
+func createOverlay(pv, name string, info physicalVolume, readOnly bool) (string, error) {
+	size, err := deviceSectors(pv)
+	if err != nil {
+		return "", err
+	}
+	if !readOnly && info.mdaCount > 1 {
+		return "", fmt.Errorf("physical volume %s keeps a second metadata area at its end, which can only be imported read-only", pv)
+	}
+	if info.peStart <= 0 || info.peStart >= size {
+		return "", fmt.Errorf("invalid data area offset %d of physical volume %s", info.peStart, pv)
+	}
+
+	cow, err := cowDevice()
+	if err != nil {
+		return "", err
+	}
+	// The loop device goes away with the overlay, once nothing holds it open
+	defer cow.Close()
+
+	// The snapshot target only ever reads from its origin
+	table := fmt.Sprintf("0 %d snapshot %s %s N 8\n", size, pv, cow.Name())
+	if !readOnly {
+		table = fmt.Sprintf("0 %d snapshot %s %s N 8\n%d %d linear %s %d\n",
+			info.peStart, pv, cow.Name(), info.peStart, size-info.peStart, pv, info.peStart)
+	}
+
+	logger.Debug("creating overlay %s on %s: %s", name, pv, strings.TrimSpace(table))
+	cmd := exec.Command("dmsetup", "create", name)
+	cmd.Stdin = strings.NewReader(table)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create overlay %s on %s: %w: %s", name, pv, err, strings.TrimSpace(string(out)))
+	}
+	return "/dev/mapper/" + name, nil
+}
+
+// removeOverlay removes the overlay of a physical volume and with it the
+// writes that went to it
+func removeOverlay(path string) error {
+	name := filepath.Base(path)
+	logger.Debug("removing overlay %s", name)
+	if out, err := exec.Command("dmsetup", "remove", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove overlay %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// deviceSectors returns the size of a block device in 512 byte sectors
+func deviceSectors(device string) (int64, error) {
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(path), "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s: %w", device, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// cowDevice returns an open loop device backed by a sparse file that is
+// already deleted. The loop device detaches itself once it is closed and
+// nothing else holds it open.
+func cowDevice() (*os.File, error) {
+	f, err := os.CreateTemp("", "qimi-overlay-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+	if err := f.Truncate(overlayCOWSize); err != nil {
+		return nil, err
+	}
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open loop control: %w", err)
+	}
+	defer ctl.Close()
+
+	// Another process may take the free loop device first
+	for attempt := 0; attempt < 5; attempt++ {
+		n, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), loopCtlGetFree, 0)
+		if errno != 0 {
+			return nil, fmt.Errorf("failed to find a free loop device: %w", errno)
+		}
+
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", n), os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopSetFD, f.Fd()); errno != 0 {
+			loop.Close()
+			if errno == syscall.EBUSY {
+				continue
+			}
+			return nil, fmt.Errorf("failed to attach %s: %w", loop.Name(), errno)
+		}
+
+		info := loopInfo64{flags: loFlagsAutoclear}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			syscall.Syscall(syscall.SYS_IOCTL, loop.Fd(), loopClrFD, 0)
+			loop.Close()
+			return nil, fmt.Errorf("failed to configure %s: %w", loop.Name(), errno)
+		}
+		return loop, nil
+	}
+	return nil, fmt.Errorf("failed to find a free loop device")
+}
@@ -0,0 +1,205 @@
+package mount
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/btrfs"
+	"github.com/packetstream-llc/qimi/internal/fstab"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// rootSubvolumeNames are subvolume names distributions use for the root filesystem
+var rootSubvolumeNames = []string{"@", "root", "@rootfs", "rootfs"}
+
+// snapshotSubvolume matches snapper snapshots such as @/.snapshots/12/snapshot
+var snapshotSubvolume = regexp.MustCompile(`^(?:@/)?\.snapshots/(\d+)/snapshot$`)
+
+// selectBtrfsSubvolume picks the subvolume to mount as root on a btrfs device.
+// In order of preference: the --subvol override, the subvolume the guest's fstab
+// mounts on /, the default subvolume, and finally the top-level or any subvolume
+// that contains os-release. "/" selects the top-level subvolume, an empty result
+// leaves the choice to the kernel (the default subvolume).
+func selectBtrfsSubvolume(device string, opts Options) string {
+	if opts.Subvol != "" {
+		logger.Debug("using btrfs subvolume %s: requested with --subvol", opts.Subvol)
+		return opts.Subvol
+	}
+
+	if !btrfs.Available() {
+		logger.Warn("root filesystem is btrfs but btrfs-progs is not installed, mounting the default subvolume (install the btrfs-progs package)")
+		return ""
+	}
+
+	topLevel, err := os.MkdirTemp("", "qimi-btrfs-")
+	if err != nil {
+		logger.Debug("failed to create directory for btrfs probing: %v", err)
+		return ""
+	}
+	defer os.Remove(topLevel)
+
+	cmd := exec.Command("mount", "-t", "btrfs", "-o", "ro,nologreplay,subvolid=5", device, topLevel)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Debug("failed to mount btrfs top-level subvolume: %v: %s", err, strings.TrimSpace(string(output)))
+		return ""
+	}
+	defer exec.Command("umount", topLevel).Run()
+
+	subvolumes, err := btrfs.List(topLevel)
+	if err != nil {
+		logger.Debug("%v", err)
+		return ""
+	}
+	if len(subvolumes) == 0 {
+		logger.Debug("btrfs filesystem on %s has no subvolumes", device)
+		return ""
+	}
+
+	exists := make(map[string]bool)
+	for _, sv := range subvolumes {
+		logger.Debug("found btrfs subvolume %d: %s", sv.ID, sv.Path)
+		exists[sv.Path] = true
+	}
+
+	defaultSubvol, err := btrfs.Default(topLevel)
+	if err != nil {
+		logger.Debug("%v", err)
+	}
+
+	candidates := rootSubvolumeCandidates(subvolumes, defaultSubvol)
+
+	// The guest's fstab knows which subvolume it mounts on /
+	for _, candidate := range candidates {
+		subvol, ok := fstabRootSubvolume(topLevel, candidate, subvolumes)
+		if !ok {
+			continue
+		}
+		if subvol == "" {
+			// Root is the default subvolume, which the fstab entry relies on
+			break
+		}
+		if !exists[subvol] {
+			logger.Debug("fstab in subvolume %q mounts %s on /, which doesn't exist", candidate, subvol)
+			continue
+		}
+		logger.Debug("using btrfs subvolume %s: mounted on / by the fstab in subvolume %q", subvol, candidate)
+		return subvol
+	}
+
+	if defaultSubvol.ID != 0 && defaultSubvol.ID != btrfs.TopLevelID {
+		logger.Debug("using btrfs subvolume %s: default subvolume", defaultSubvol.Path)
+		return defaultSubvol.Path
+	}
+
+	// Without any hints, look for the subvolume that actually contains an OS
+	for _, candidate := range append([]string{""}, candidates...) {
+		if containsOSRelease(filepath.Join(topLevel, candidate)) {
+			if candidate == "" {
+				logger.Debug("using the btrfs top-level subvolume: contains os-release")
+				return "/"
+			}
+			logger.Debug("using btrfs subvolume %s: contains os-release", candidate)
+			return candidate
+		}
+	}
+
+	logger.Debug("no btrfs subvolume could be identified as root, mounting the default subvolume")
+	return ""
+}
+
+// rootSubvolumeCandidates orders subvolumes by how likely they hold the root filesystem:
+// the default subvolume, well-known names, then snapper snapshots (newest first)
+func rootSubvolumeCandidates(subvolumes []btrfs.Subvolume, defaultSubvol btrfs.Subvolume) []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			candidates = append(candidates, path)
+		}
+	}
+
+	if defaultSubvol.Path != "" {
+		add(defaultSubvol.Path)
+	}
+
+	for _, name := range rootSubvolumeNames {
+		for _, sv := range subvolumes {
+			if sv.Path == name {
+				add(name)
+			}
+		}
+	}
+
+	var snapshots []btrfs.Subvolume
+	for _, sv := range subvolumes {
+		if snapshotSubvolume.MatchString(sv.Path) {
+			snapshots = append(snapshots, sv)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshotNumber(snapshots[i].Path) > snapshotNumber(snapshots[j].Path)
+	})
+	for _, sv := range snapshots {
+		add(sv.Path)
+	}
+
+	return candidates
+}
+
+// fstabRootSubvolume reads the fstab inside a subvolume and returns the subvolume it mounts on /.
+// An empty result with ok set means the / entry has no subvolume option.
+func fstabRootSubvolume(topLevel, candidate string, subvolumes []btrfs.Subvolume) (string, bool) {
+	fstabPath, err := utils.SecureJoin(filepath.Join(topLevel, candidate), "/etc/fstab")
+	if err != nil {
+		return "", false
+	}
+
+	entries, err := fstab.ParseFile(fstabPath)
+	if err != nil {
+		return "", false
+	}
+
+	for _, entry := range entries {
+		if entry.File != "/" {
+			continue
+		}
+		if subvol, ok := entry.Option("subvol"); ok {
+			return strings.TrimPrefix(subvol, "/"), true
+		}
+		if id, ok := entry.Option("subvolid"); ok {
+			for _, sv := range subvolumes {
+				if strconv.Itoa(sv.ID) == id {
+					return sv.Path, true
+				}
+			}
+		}
+		return "", true
+	}
+
+	return "", false
+}
+
+func snapshotNumber(path string) int {
+	m := snapshotSubvolume.FindStringSubmatch(path)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+func containsOSRelease(root string) bool {
+	for _, rel := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if _, err := os.Lstat(filepath.Join(root, rel)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package mount
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/fstab"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// guestDevicePattern matches partition device names a guest may use in its fstab
+// (e.g. /dev/sda2, /dev/vda1, /dev/nvme0n1p3) and captures the partition number
+var guestDevicePattern = regexp.MustCompile(`^/dev/(?:[shvx]d[a-z]+|nvme\d+n\d+p|mmcblk\d+p)(\d+)$`)
+
+// ignoredFstabOptions are fstab options that only matter to the guest's boot process
+var ignoredFstabOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true, "nofail": true,
+	"user": true, "users": true, "nouser": true, "owner": true, "group": true,
+	"_netdev": true, "rw": true, "ro": true,
+}
+
+// mountFstab mounts the filesystems listed in the guest's /etc/fstab that live on
+// the image's own devices. aliases maps guest device paths (e.g. /dev/mapper/rhel-home)
+// to host devices. It returns the mounted targets in mount order.
+func (m *Mounter) mountFstab(devices []nbd.PartitionInfo, aliases map[string]string, rootDevice, mountPoint string, opts Options) ([]string, error) {
+	readOnly := opts.ReadOnly
+
+	fstabPath, err := utils.SecureJoin(mountPoint, "/etc/fstab")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve /etc/fstab: %w", err)
+	}
+
+	entries, err := fstab.ParseFile(fstabPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debug("guest has no /etc/fstab, nothing else to mount")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read guest fstab: %w", err)
+	}
+
+	// Parents have to be mounted before their children (/boot before /boot/efi)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return pathDepth(entries[i].File) < pathDepth(entries[j].File)
+	})
+
+	var mounted []string
+	for _, entry := range entries {
+		if entry.File == "/" || entry.File == "none" || entry.VfsType == "swap" || entry.HasOption("noauto") || entry.HasOption("bind") {
+			continue
+		}
+
+		device, err := resolveFstabSpec(entry.Spec, devices, aliases)
+		if err != nil {
+			if entry.HasOption("nofail") || !isBlockSpec(entry.Spec) {
+				logger.Debug("skipping fstab entry %s on %s: %v", entry.Spec, entry.File, err)
+			} else {
+				logger.Warn("skipping fstab entry %s on %s: %v", entry.Spec, entry.File, err)
+			}
+			continue
+		}
+		// Only btrfs subvolumes share the root device
+		if _, ok := entry.Option("subvol"); device == rootDevice && !ok {
+			continue
+		}
+
+		target, err := utils.SecureJoin(mountPoint, entry.File)
+		if err != nil {
+			logger.Warn("skipping fstab entry %s: failed to resolve %s: %v", entry.Spec, entry.File, err)
+			continue
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if readOnly {
+				logger.Warn("skipping fstab entry %s: mount point %s does not exist in the read-only image", entry.Spec, entry.File)
+				continue
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				logger.Warn("skipping fstab entry %s: failed to create %s: %v", entry.Spec, entry.File, err)
+				continue
+			}
+		}
+
+		detected := fsType(devices, device)
+		if detected == "" && entry.VfsType != "auto" {
+			detected = entry.VfsType
+		}
+		mountType, fsOpts := filesystemOptions(detected, readOnly, opts.NTFSDriver)
+
+		args := []string{}
+		if mountType != "" {
+			args = append(args, "-t", mountType)
+		}
+		if merged := mergeOptions(fstabMountOptions(entry), fsOpts); len(merged) > 0 {
+			args = append(args, "-o", strings.Join(merged, ","))
+		}
+		args = append(args, device, target)
+
+		logger.Debug("mounting fstab entry %s (%s) on %s: mount %s", entry.Spec, device, entry.File, strings.Join(args, " "))
+		if output, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+			logger.Warn("failed to mount %s on %s: %v: %s", device, entry.File, err, strings.TrimSpace(string(output)))
+			continue
+		}
+		mounted = append(mounted, target)
+	}
+
+	return mounted, nil
+}
+
+// unmountAll unmounts the given targets in reverse order
+func unmountAll(targets []string) {
+	for i := len(targets) - 1; i >= 0; i-- {
+		logger.Debug("unmounting submount: %s", targets[i])
+		if output, err := exec.Command("umount", targets[i]).CombinedOutput(); err != nil {
+			logger.Warn("failed to unmount %s: %v: %s", targets[i], err, strings.TrimSpace(string(output)))
+		}
+	}
+}
+
+// resolveFstabSpec maps the device column of an fstab entry to a device of the image
+func resolveFstabSpec(spec string, devices []nbd.PartitionInfo, aliases map[string]string) (string, error) {
+	if device, ok := aliases[spec]; ok {
+		return device, nil
+	}
+
+	match := func(field func(nbd.PartitionInfo) string, value string) (string, error) {
+		for _, p := range devices {
+			if v := field(p); v != "" && strings.EqualFold(v, value) {
+				return p.Path, nil
+			}
+		}
+		return "", fmt.Errorf("no partition of the image matches %s", spec)
+	}
+	byUUID := func(p nbd.PartitionInfo) string { return p.UUID }
+	byLabel := func(p nbd.PartitionInfo) string { return p.Label }
+	byPartUUID := func(p nbd.PartitionInfo) string { return p.PartUUID }
+	byPartLabel := func(p nbd.PartitionInfo) string { return p.Name }
+
+	if key, value, ok := strings.Cut(spec, "="); ok {
+		value = strings.Trim(value, `"`)
+		switch strings.ToUpper(key) {
+		case "UUID":
+			return match(byUUID, value)
+		case "LABEL":
+			return match(byLabel, value)
+		case "PARTUUID":
+			return match(byPartUUID, value)
+		case "PARTLABEL":
+			return match(byPartLabel, value)
+		}
+	}
+
+	for prefix, field := range map[string]func(nbd.PartitionInfo) string{
+		"/dev/disk/by-uuid/":      byUUID,
+		"/dev/disk/by-label/":     byLabel,
+		"/dev/disk/by-partuuid/":  byPartUUID,
+		"/dev/disk/by-partlabel/": byPartLabel,
+	} {
+		if value, ok := strings.CutPrefix(spec, prefix); ok {
+			return match(field, value)
+		}
+	}
+
+	if m := guestDevicePattern.FindStringSubmatch(spec); m != nil {
+		number, _ := strconv.Atoi(m[1])
+		for _, p := range devices {
+			if p.Number == number {
+				return p.Path, nil
+			}
+		}
+		return "", fmt.Errorf("image has no partition %d", number)
+	}
+
+	return "", fmt.Errorf("not a device of this image")
+}
+
+// isBlockSpec reports whether an fstab device column refers to a block device
+// rather than a pseudo filesystem such as proc or tmpfs
+func isBlockSpec(spec string) bool {
+	if strings.HasPrefix(spec, "/dev/") {
+		return true
+	}
+	key, _, ok := strings.Cut(spec, "=")
+	if !ok {
+		return false
+	}
+	switch strings.ToUpper(key) {
+	case "UUID", "LABEL", "PARTUUID", "PARTLABEL":
+		return true
+	}
+	return false
+}
+
+// fstabMountOptions filters out the options that only matter to the guest's boot process
+func fstabMountOptions(entry fstab.Entry) []string {
+	var opts []string
+	for _, opt := range entry.Options {
+		if ignoredFstabOptions[opt] || strings.HasPrefix(opt, "x-") || strings.HasPrefix(opt, "comment=") {
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+func pathDepth(path string) int {
+	return len(strings.Split(strings.Trim(filepath.Clean(path), "/"), "/"))
+}
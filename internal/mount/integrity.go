@@ -0,0 +1,126 @@
+package mount
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// ErrImageModified is returned by Unmount when an image mounted in strict
+// read-only mode was changed while it was mounted
+var ErrImageModified = errors.New("image was modified while mounted in strict read-only mode")
+
+// fingerprint records the state of an image file before a strict read-only mount
+type fingerprint struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+func fingerprintImage(path string) (*fingerprint, error) {
+	// O_NOATIME keeps even the access time of the image untouched where permitted
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if err != nil {
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("computing checksum of %s (%d bytes)", path, info.Size())
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+
+	return &fingerprint{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// verify compares the image file against the recorded fingerprint
+func (fp *fingerprint) verify() error {
+	current, err := fingerprintImage(fp.Path)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", fp.Path, err)
+	}
+
+	var changes []string
+	if !current.ModTime.Equal(fp.ModTime) {
+		changes = append(changes, fmt.Sprintf("mtime changed from %s to %s", fp.ModTime.Format(time.RFC3339Nano), current.ModTime.Format(time.RFC3339Nano)))
+	}
+	if current.Size != fp.Size {
+		changes = append(changes, fmt.Sprintf("size changed from %d to %d", fp.Size, current.Size))
+	}
+	if current.SHA256 != fp.SHA256 {
+		changes = append(changes, fmt.Sprintf("sha256 changed from %s to %s", fp.SHA256, current.SHA256))
+	}
+
+	if len(changes) > 0 {
+		return fmt.Errorf("%w: %s: %s", ErrImageModified, fp.Path, strings.Join(changes, ", "))
+	}
+	return nil
+}
+
+func (m *Mounter) saveFingerprint(mountPoint string, fp *fingerprint) error {
+	data, err := json.Marshal(fp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.metadataPath(mountPoint, ".fingerprint"), data, 0644)
+}
+
+// verifyFingerprint checks the image of a strict read-only mount against the
+// fingerprint taken before it was mounted. Mounts without a fingerprint pass.
+func (m *Mounter) verifyFingerprint(mountPoint string) error {
+	fpFile := m.metadataPath(mountPoint, ".fingerprint")
+	data, err := os.ReadFile(fpFile)
+	if err != nil {
+		return nil
+	}
+	defer os.Remove(fpFile)
+
+	var fp fingerprint
+	if err := json.Unmarshal(data, &fp); err != nil {
+		return fmt.Errorf("invalid fingerprint %s: %w", fpFile, err)
+	}
+
+	if err := fp.verify(); err != nil {
+		return err
+	}
+
+	logger.Info("verified %s is unchanged (sha256 %s)", fp.Path, fp.SHA256)
+	return nil
+}
+
+// checkDeviceReadOnly makes sure the kernel refuses writes to a block device
+func checkDeviceReadOnly(device string) error {
+	data, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(device), "ro"))
+	if err != nil {
+		return fmt.Errorf("failed to check if %s is read-only: %w", device, err)
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return fmt.Errorf("%s is not read-only", device)
+	}
+	return nil
+}
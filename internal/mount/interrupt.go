@@ -0,0 +1,57 @@
+package mount
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// releaseOnSignal makes SIGINT and SIGTERM undo a mount that is being set up,
+// as far as its record goes, before qimi exits. Without it, a Ctrl-C at the
+// passphrase prompt would leave the NBD device and LUKS mappings behind. The
+// returned function stops it again.
+func (m *Mounter) releaseOnSignal(mountPoint string) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	// The passphrase prompt turns off echo
+	restoreTerminal := utils.SaveTerminal(os.Stdin)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			// Holding the lock keeps the mount from recording anything else
+			m.recordMu.Lock()
+			select {
+			case <-done:
+				m.recordMu.Unlock()
+				return
+			default:
+			}
+
+			if restoreTerminal != nil {
+				restoreTerminal()
+			}
+			logger.Warn("interrupted, releasing the devices of %s", mountPoint)
+			if record, err := m.Record(mountPoint); err == nil {
+				if err := m.Unmount(record); err != nil {
+					logger.Error("failed to release the devices of %s, run qimi cleanup: %v", mountPoint, err)
+				}
+			} else {
+				os.Remove(mountPoint)
+			}
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		m.recordMu.Lock()
+		close(done)
+		m.recordMu.Unlock()
+	}
+}
@@ -0,0 +1,189 @@
+package mount
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/fstab"
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/luks"
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// maxPassphraseAttempts is how often the user is asked again after entering a wrong passphrase
+const maxPassphraseAttempts = 3
+
+// unlockLUKS opens the LUKS devices among the image's partitions. If a partition
+// number was requested, only that partition is unlocked. record is called with
+// the name of every mapping before it is opened. It returns the mapper devices
+// as mount candidates and a map from each unlocked partition to its mapper device.
+func unlockLUKS(partitions []nbd.PartitionInfo, opts Options, record func(name string) error) ([]nbd.PartitionInfo, map[string]string, error) {
+	var encrypted []nbd.PartitionInfo
+	for _, p := range partitions {
+		if p.FSType != luks.FSType {
+			continue
+		}
+		if opts.Partition > 0 && p.Number != opts.Partition {
+			continue
+		}
+		encrypted = append(encrypted, p)
+	}
+	if len(encrypted) == 0 {
+		return nil, nil, nil
+	}
+
+	if !luks.Available() {
+		logger.Warn("image contains LUKS encrypted partitions but cryptsetup is not installed (install the cryptsetup package)")
+		return nil, nil, nil
+	}
+
+	var names []string
+	var devices []nbd.PartitionInfo
+	unlocked := make(map[string]string)
+	var lastPassphrase []byte
+
+	for _, p := range encrypted {
+		name := "qimi-" + filepath.Base(p.Path)
+		logger.Debug("unlocking LUKS%s partition %s as %s", nbd.ProbeFilesystem(p.Path)["VERSION"], p.Path, name)
+
+		if err := record(name); err != nil {
+			closeLUKS(names)
+			return nil, nil, fmt.Errorf("failed to save mount record: %w", err)
+		}
+		mapper, passphrase, err := openLUKS(p.Path, name, lastPassphrase, opts)
+		if err != nil {
+			closeLUKS(names)
+			return nil, nil, err
+		}
+		lastPassphrase = passphrase
+		names = append(names, name)
+		unlocked[p.Path] = mapper
+
+		// The mapper device inherits the partition type so DPS root detection still applies
+		props := nbd.ProbeFilesystem(mapper)
+		devices = append(devices, nbd.PartitionInfo{
+			Path:     mapper,
+			FSType:   props["TYPE"],
+			UUID:     props["UUID"],
+			Label:    props["LABEL"],
+			Size:     p.Size,
+			TypeGUID: p.TypeGUID,
+			TypeID:   p.TypeID,
+			Name:     p.Name,
+		})
+	}
+
+	return devices, unlocked, nil
+}
+
+// openLUKS unlocks a single device. A passphrase that unlocked a previous device is
+// tried first, since multi-partition images usually share one passphrase. Only
+// a user at a prompt is asked again after a wrong passphrase, a key read from
+// stdin would just be the same again.
+func openLUKS(device, name string, lastPassphrase []byte, opts Options) (string, []byte, error) {
+	if opts.KeyFile != "" {
+		mapper, err := luks.Open(device, name, opts.KeyFile, nil, opts.ReadOnly)
+		return mapper, nil, err
+	}
+
+	if lastPassphrase != nil {
+		if mapper, err := luks.Open(device, name, "", lastPassphrase, opts.ReadOnly); err == nil {
+			return mapper, lastPassphrase, nil
+		}
+	}
+
+	if opts.Passphrase == nil {
+		return "", nil, fmt.Errorf("%s is encrypted, but no passphrase or key file was provided", device)
+	}
+
+	attempts := 1
+	if opts.PassphrasePrompt {
+		attempts = maxPassphraseAttempts
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		var passphrase []byte
+		passphrase, err = opts.Passphrase(device)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read passphrase for %s: %w", device, err)
+		}
+
+		var mapper string
+		mapper, err = luks.Open(device, name, "", passphrase, opts.ReadOnly)
+		if err == nil {
+			return mapper, passphrase, nil
+		}
+		if !luks.IsWrongPassphrase(err) {
+			break
+		}
+		logger.Warn("wrong passphrase for %s", device)
+	}
+
+	return "", nil, err
+}
+
+func closeLUKS(names []string) {
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := luks.Close(names[i]); err != nil {
+			logger.Warn("%v", err)
+		}
+	}
+}
+
+// cryptAliases maps the device paths the guest uses for its LUKS mappings to the host
+// mapper devices: the /dev/mapper/luks-<UUID> names systemd uses by default and the
+// names from the guest's /etc/crypttab.
+func cryptAliases(mountPoint string, unlocked map[string]string) map[string]string {
+	aliases := make(map[string]string)
+	byUUID := make(map[string]string)
+	for partition, mapper := range unlocked {
+		if uuid := nbd.ProbeFilesystem(partition)["UUID"]; uuid != "" {
+			byUUID[strings.ToLower(uuid)] = mapper
+			aliases["/dev/mapper/luks-"+uuid] = mapper
+		}
+	}
+
+	crypttabPath, err := utils.SecureJoin(mountPoint, "/etc/crypttab")
+	if err != nil {
+		return aliases
+	}
+
+	// crypttab shares fstab's layout: the mapping name and the device take the first two columns
+	entries, err := fstab.ParseFile(crypttabPath)
+	if err != nil {
+		return aliases
+	}
+	for _, entry := range entries {
+		uuid, ok := strings.CutPrefix(entry.File, "UUID=")
+		if !ok {
+			continue
+		}
+		if mapper, ok := byUUID[strings.ToLower(uuid)]; ok {
+			aliases["/dev/mapper/"+entry.Spec] = mapper
+		}
+	}
+
+	return aliases
+}
+
+// luksExtras records opened LUKS mappings in the mount state
+func luksExtras(names []string) []storage.ExtraMount {
+	var extras []storage.ExtraMount
+	for _, name := range names {
+		extras = append(extras, storage.ExtraMount{Type: storage.ExtraTypeLUKS, Name: name})
+	}
+	return extras
+}
+
+// luksMappings returns the LUKS mappings recorded in a mount's state
+func luksMappings(info *storage.MountInfo) []string {
+	var names []string
+	for _, e := range info.Extras(storage.ExtraTypeLUKS) {
+		names = append(names, e.Name)
+	}
+	return names
+}
@@ -0,0 +1,149 @@
+package mount
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/luks"
+	"github.com/packetstream-llc/qimi/internal/lvm"
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/storage"
+)
+
+// activateLVM activates the volume groups on the image's LVM physical volumes and returns their logical volumes
+func activateLVM(nbdDevice string, partitions []nbd.PartitionInfo, readOnly bool) ([]lvm.VolumeGroup, []lvm.LogicalVolume, error) {
+	var pvs []string
+	for _, p := range partitions {
+		if p.FSType == lvm.PVFSType {
+			pvs = append(pvs, p.Path)
+		}
+	}
+	if len(pvs) == 0 {
+		return nil, nil, nil
+	}
+
+	if !lvm.Available() {
+		logger.Warn("image contains LVM physical volumes but the lvm tools are not installed (install the lvm2 package)")
+		return nil, nil, nil
+	}
+
+	// Temporary names are derived from the NBD device, which is unique while the image is attached
+	vgs, err := lvm.Activate(pvs, readOnly, "qimi_"+filepath.Base(nbdDevice)+"_")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lvs, err := lvm.LogicalVolumes(vgs)
+	if err != nil {
+		lvm.Deactivate(vgs)
+		return nil, nil, err
+	}
+
+	for _, lv := range lvs {
+		logger.Debug("found logical volume %s at %s", lv, lv.Path)
+	}
+
+	return vgs, lvs, nil
+}
+
+// selectRootDevice picks the device to mount as the root filesystem.
+// An explicit logical volume or partition number always wins, otherwise a
+// logical volume named like a root volume is preferred before probing all
+// candidates. Encrypted partitions are replaced by their unlocked mapper devices.
+func selectRootDevice(nbdDevice string, devices []nbd.PartitionInfo, lvs []lvm.LogicalVolume, unlocked map[string]string, opts Options) (string, error) {
+	if opts.LV != "" {
+		lv, err := lvm.Find(lvs, opts.LV)
+		if err != nil {
+			return "", err
+		}
+		logger.Debug("selected logical volume %s: requested with --lv", lv)
+		return lv.Path, nil
+	}
+
+	if opts.Partition > 0 || (len(lvs) == 0 && len(unlocked) == 0) {
+		device, err := nbd.GetPartitionDevice(nbdDevice, opts.Partition)
+		if err != nil {
+			return "", err
+		}
+		if mapper, ok := unlocked[device]; ok {
+			logger.Debug("%s is encrypted, using %s", device, mapper)
+			return mapper, nil
+		}
+		return device, nil
+	}
+
+	if lv, ok := lvm.RootVolume(lvs); ok {
+		logger.Debug("selected logical volume %s: named like a root volume", lv)
+		return lv.Path, nil
+	}
+
+	var candidates []nbd.PartitionInfo
+	for _, d := range devices {
+		if d.FSType != lvm.PVFSType && d.FSType != luks.FSType {
+			candidates = append(candidates, d)
+		}
+	}
+
+	root, err := nbd.SelectRoot(candidates)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the root filesystem: %w", err)
+	}
+	return root.Path, nil
+}
+
+// lvmDevices describes logical volumes as mount candidates
+func lvmDevices(lvs []lvm.LogicalVolume) []nbd.PartitionInfo {
+	var devices []nbd.PartitionInfo
+	for _, lv := range lvs {
+		props := nbd.ProbeFilesystem(lv.Path)
+		devices = append(devices, nbd.PartitionInfo{
+			Path:   lv.Path,
+			FSType: props["TYPE"],
+			UUID:   props["UUID"],
+			Label:  props["LABEL"],
+			Size:   lv.Size,
+			Name:   lv.String(),
+		})
+	}
+	return devices
+}
+
+// lvmAliases maps the device paths the guest uses for its logical volumes to the host devices
+func lvmAliases(lvs []lvm.LogicalVolume) map[string]string {
+	aliases := make(map[string]string)
+	for _, lv := range lvs {
+		aliases[lvm.MapperPath(lv.VG.OriginalName, lv.Name)] = lv.Path
+		aliases["/dev/"+lv.VG.OriginalName+"/"+lv.Name] = lv.Path
+	}
+	return aliases
+}
+
+// volumeGroupExtras records activated volume groups in the mount state
+func volumeGroupExtras(vgs []lvm.VolumeGroup) []storage.ExtraMount {
+	var extras []storage.ExtraMount
+	for _, vg := range vgs {
+		extras = append(extras, storage.ExtraMount{
+			Type:         storage.ExtraTypeLVM,
+			Name:         vg.Name,
+			OriginalName: vg.OriginalName,
+			UUID:         vg.UUID,
+			Devices:      vg.PVs,
+		})
+	}
+	return extras
+}
+
+// volumeGroups returns the volume groups recorded in a mount's state
+func volumeGroups(info *storage.MountInfo) []lvm.VolumeGroup {
+	var vgs []lvm.VolumeGroup
+	for _, e := range info.Extras(storage.ExtraTypeLVM) {
+		vgs = append(vgs, lvm.VolumeGroup{
+			Name:         e.Name,
+			OriginalName: e.OriginalName,
+			UUID:         e.UUID,
+			PVs:          e.Devices,
+		})
+	}
+	return vgs
+}
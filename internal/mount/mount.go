@@ -1,37 +1,53 @@
 package mount
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/packetstream-llc/qimi/internal/config"
 	qimiexec "github.com/packetstream-llc/qimi/internal/exec"
 	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/lvm"
+	"github.com/packetstream-llc/qimi/internal/mountinfo"
 	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/storage"
+	"github.com/packetstream-llc/qimi/internal/utils"
 )
 
+// ErrMountBusy is returned by Unmount when the filesystem could not be
+// unmounted because processes still use it
+var ErrMountBusy = errors.New("mount point is busy")
+
 type Mounter struct {
 	mountDir    string
 	metadataDir string
+	// recordMu keeps an interrupted mount from reading a record while it is written
+	recordMu sync.Mutex
 }
 
 func New() (*Mounter, error) {
 	// Check system dependencies first
-	if err := nbd.CheckSystemDependencies(); err != nil {
+	checkDependencies := nbd.CheckSystemDependencies
+	if config.Current().Rootless {
+		checkDependencies = CheckRootlessDependencies
+	}
+	if err := checkDependencies(); err != nil {
 		return nil, fmt.Errorf("system dependencies not met: %w", err)
 	}
 
-	// Use /tmp/qimi/mounts for temporary mounts
-	mountDir := "/tmp/qimi/mounts"
+	mountDir := config.Current().MountDir()
 	if err := os.MkdirAll(mountDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create mount directory: %w", err)
 	}
 
-	// Use /tmp/qimi/metadata for NBD metadata
-	metadataDir := "/tmp/qimi/metadata"
+	metadataDir := config.Current().MetadataDir()
 	if err := os.MkdirAll(metadataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
 	}
@@ -42,46 +58,154 @@ func New() (*Mounter, error) {
 	}, nil
 }
 
+// Options controls how an image is mounted
+type Options struct {
+	ReadOnly bool
+	// Partition selects the partition to mount, 0 auto-detects the root partition
+	Partition int
+	// LV selects an LVM logical volume to mount as vg/lv
+	LV string
+	// KeyFile unlocks LUKS partitions with a key file instead of a passphrase
+	KeyFile string
+	// Passphrase is called to ask for the passphrase of a LUKS partition
+	Passphrase func(device string) ([]byte, error)
+	// PassphrasePrompt is set when Passphrase asks the user, who may then try
+	// again after a wrong passphrase
+	PassphrasePrompt bool
+	// All additionally mounts the filesystems listed in the guest's /etc/fstab
+	All bool
+	// Subvol selects the btrfs subvolume to mount as root
+	Subvol string
+	// MountOptions are extra mount(8) options for the root filesystem
+	MountOptions []string
+	// NTFSDriver selects the NTFS driver (ntfs3 or ntfs-3g), empty picks the best available
+	NTFSDriver string
+	// Strict implies ReadOnly and additionally verifies that the image file is
+	// unchanged on unmount by comparing its mtime and checksum
+	Strict bool
+}
+
 func (m *Mounter) Mount(imagePath string, readOnly bool) (string, error) {
 	return m.MountWithPartition(imagePath, readOnly, 0)
 }
 
 func (m *Mounter) MountWithPartition(imagePath string, readOnly bool, partitionNum int) (string, error) {
-	logger.Debug("mounting image: %s, readOnly: %t, partitionNum: %d", imagePath, readOnly, partitionNum)
+	return m.MountWithOptions(imagePath, Options{ReadOnly: readOnly, Partition: partitionNum})
+}
+
+func (m *Mounter) MountWithOptions(imagePath string, opts Options) (string, error) {
+	info, err := m.MountImage(imagePath, opts)
+	if err != nil {
+		return "", err
+	}
+	return info.MountPoint, nil
+}
+
+// MountImage mounts an image and returns the state record describing the mount
+// and every device set up for it
+func (m *Mounter) MountImage(imagePath string, opts Options) (*storage.MountInfo, error) {
+	logger.Debug("mounting image: %s, readOnly: %t, partitionNum: %d, all: %t", imagePath, opts.ReadOnly, opts.Partition, opts.All)
+	switch opts.NTFSDriver {
+	case "", NTFSDriverNTFS3, NTFSDriverNTFS3G:
+	default:
+		return nil, fmt.Errorf("unknown NTFS driver %q (expected %s or %s)", opts.NTFSDriver, NTFSDriverNTFS3, NTFSDriverNTFS3G)
+	}
+
 	absPath, err := filepath.Abs(imagePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to get absolute path: %w", err)
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
 	if _, err := os.Stat(absPath); err != nil {
-		return "", fmt.Errorf("image file not found: %w", err)
+		return nil, fmt.Errorf("image file not found: %w", err)
 	}
 
 	logger.Debug("absolute path of image: %s", absPath)
+
+	var fp *fingerprint
+	if opts.Strict {
+		opts.ReadOnly = true
+		if fp, err = fingerprintImage(absPath); err != nil {
+			return nil, fmt.Errorf("failed to fingerprint image: %w", err)
+		}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
 	logger.Debug("creating mount point in: %s", m.mountDir)
-	mountPoint := filepath.Join(m.mountDir, filepath.Base(absPath)+".mount")
+	mountPoint := filepath.Join(m.mountDir, id)
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
-		return "", fmt.Errorf("failed to create mount point: %w", err)
+		return nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	info := &storage.MountInfo{
+		ID:         id,
+		ImagePath:  absPath,
+		MountPoint: mountPoint,
+		ReadOnly:   opts.ReadOnly,
+		Format:     nbd.ImageFormat(absPath),
+		CreatedAt:  time.Now(),
+		PID:        os.Getpid(),
+		UID:        utils.InvokingUID(),
+	}
+	if img, err := storage.ResolveImage(absPath); err == nil {
+		info.SetImage(img)
 	}
 
 	logger.Debug("mount point created: %s", mountPoint)
-	if err := m.mountQemuImage(absPath, mountPoint, readOnly, partitionNum); err != nil {
+	stop := m.releaseOnSignal(mountPoint)
+	defer stop()
+	if err := m.mountQemuImage(info, opts); err != nil {
+		m.RemoveMetadata(mountPoint)
 		os.RemoveAll(mountPoint)
-		return "", err
+		return nil, err
+	}
+
+	if err := m.saveRecord(info); err != nil {
+		m.Unmount(info)
+		return nil, fmt.Errorf("failed to save mount record: %w", err)
 	}
 
-	return mountPoint, nil
+	if fp != nil {
+		if err := m.saveFingerprint(mountPoint, fp); err != nil {
+			m.Unmount(info)
+			return nil, fmt.Errorf("failed to save image fingerprint: %w", err)
+		}
+	}
+
+	return info, nil
 }
 
-func (m *Mounter) Unmount(mountPoint string) error {
+// Unmount unmounts everything recorded in a mount's state and releases its devices
+func (m *Mounter) Unmount(info *storage.MountInfo) error {
+	mountPoint := info.MountPoint
 	logger.Debug("unmounting mount point: %s", mountPoint)
 
-	// Try to unmount, but don't fail if already unmounted
-	cmd := exec.Command("umount", mountPoint)
-	cmd.Run() // Ignore error as it might already be unmounted
+	// Unmount the fstab submounts first, in reverse order
+	var submounts []string
+	for _, e := range info.Extras(storage.ExtraTypeMount) {
+		submounts = append(submounts, e.Target)
+	}
+	unmountAll(submounts)
+
+	// An unmount that fails because the mount point is already gone is fine
+	if output, err := unmountRoot(info); err != nil {
+		// Releasing the devices under a mounted filesystem would corrupt it
+		if entries, readErr := mountinfo.Read(); readErr != nil || mountinfo.IsMounted(entries, mountPoint) {
+			return fmt.Errorf("%w: %s: %s", ErrMountBusy, mountPoint, strings.TrimSpace(string(output)))
+		}
+		logger.Debug("%s was not mounted", mountPoint)
+	}
+
+	// Release LVM, LUKS and NBD devices
+	m.ReleaseDevices(info) // Ignore error
 
-	// Try to disconnect NBD if info exists
-	m.disconnectNBD(mountPoint) // Ignore error
+	// Strict read-only mounts check the image only after everything let go of it
+	verifyErr := m.verifyFingerprint(mountPoint)
+	m.RemoveMetadata(mountPoint)
 
 	// Clean up any backup files
 	executor := qimiexec.New()
@@ -98,11 +222,133 @@ func (m *Mounter) Unmount(mountPoint string) error {
 		logger.Warn("Mount point %s is not empty, skipping removal", mountPoint)
 	}
 
-	return nil
+	return verifyErr
+}
+
+// unmountRoot unmounts the root filesystem of a mount
+func unmountRoot(info *storage.MountInfo) ([]byte, error) {
+	if info.Rootless {
+		return UnmountFUSE(info.MountPoint)
+	}
+	return exec.Command("umount", info.MountPoint).CombinedOutput()
+}
+
+// newSessionID returns a random ID that names the mount point and metadata of a mount
+func newSessionID() (string, error) {
+	return utils.RandomID(8)
+}
+
+// SessionID returns the session ID of a mount point created by MountWithOptions
+func SessionID(mountPoint string) string {
+	return filepath.Base(mountPoint)
+}
+
+// metadataPath returns the side file with the given extension that belongs to a mount
+func (m *Mounter) metadataPath(mountPoint, ext string) string {
+	return filepath.Join(m.metadataDir, SessionID(mountPoint)+ext)
+}
+
+// saveRecord keeps a copy of the mount's state next to its other metadata, so
+// mounts that never made it into the state (temporary mounts of exec) can be
+// cleaned up after a crash. While a mount is set up, it is saved after every
+// device that is opened.
+func (m *Mounter) saveRecord(info *storage.MountInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	m.recordMu.Lock()
+	defer m.recordMu.Unlock()
+	// Written atomically, so qimi cleanup never reads half a record
+	path := m.metadataPath(info.MountPoint, ".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
 }
 
-func (m *Mounter) mountQemuImage(imagePath, mountPoint string, readOnly bool, partitionNum int) error {
+// Record returns the record saved for a mount point by MountImage
+func (m *Mounter) Record(mountPoint string) (*storage.MountInfo, error) {
+	data, err := os.ReadFile(m.metadataPath(mountPoint, ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var info storage.MountInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid mount record for %s: %w", mountPoint, err)
+	}
+	return &info, nil
+}
+
+// Records returns the records of all mounts saved by MountImage
+func (m *Mounter) Records() []*storage.MountInfo {
+	files, _ := filepath.Glob(filepath.Join(m.metadataDir, "*.json"))
+	var records []*storage.MountInfo
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var info storage.MountInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			logger.Debug("ignoring invalid mount record %s: %v", f, err)
+			continue
+		}
+		records = append(records, &info)
+	}
+	return records
+}
+
+// RemoveMetadata removes the side files left behind for a mount, including
+// those older versions used to record its devices
+func (m *Mounter) RemoveMetadata(mountPoint string) {
+	files, _ := filepath.Glob(m.metadataPath(mountPoint, ".*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// fsType returns the filesystem type of a device among the mount candidates
+func fsType(devices []nbd.PartitionInfo, path string) string {
+	for _, d := range devices {
+		if d.Path == path {
+			return d.FSType
+		}
+	}
+	return nbd.ProbeFilesystem(path)["TYPE"]
+}
+
+// ReleaseDevices deactivates the LVM volume groups, closes the LUKS mappings and
+// disconnects the NBD device recorded for a mount, in that order. For rootless
+// mounts it stops qemu-storage-daemon.
+func (m *Mounter) ReleaseDevices(info *storage.MountInfo) error {
+	if info.Rootless {
+		return m.releaseExports(info)
+	}
+
+	// Volume groups may sit inside LUKS, and both sit on the NBD device
+	if err := lvm.Deactivate(volumeGroups(info)); err != nil {
+		logger.Warn("failed to deactivate volume groups: %v", err)
+	}
+	closeLUKS(luksMappings(info))
+
+	if info.Device == "" {
+		logger.Warn("no NBD device recorded for %s, please run lsblk for check which NBD device is used and unmount it via qemu-nbd --disconnect", info.MountPoint)
+		return errors.New("no NBD device recorded")
+	}
+	return m.disconnectNBDDevice(info.Device)
+}
+
+func (m *Mounter) mountQemuImage(info *storage.MountInfo, opts Options) error {
+	imagePath, mountPoint := info.ImagePath, info.MountPoint
+	readOnly, partitionNum := opts.ReadOnly, opts.Partition
 	logger.Debug("mounting QEMU image: %s to %s, readOnly: %t, partitionNum: %d", imagePath, mountPoint, readOnly, partitionNum)
+	if config.Current().Rootless {
+		return m.mountRootless(info, opts)
+	}
+
 	nbdDevice, err := nbd.FindFreeNBDDevice()
 	if err != nil {
 		return err
@@ -114,6 +360,20 @@ func (m *Mounter) mountQemuImage(imagePath, mountPoint string, readOnly bool, pa
 		m.disconnectNBDDevice(nbdDevice)
 		return err
 	}
+	info.Device = nbdDevice
+	// A provisional record lets an interrupted mount or qimi cleanup release
+	// what was set up so far
+	if err := m.saveRecord(info); err != nil {
+		m.disconnectNBDDevice(nbdDevice)
+		return fmt.Errorf("failed to save mount record: %w", err)
+	}
+
+	if opts.Strict {
+		if err := checkDeviceReadOnly(nbdDevice); err != nil {
+			m.disconnectNBDDevice(nbdDevice)
+			return fmt.Errorf("refusing strict read-only mount: %w", err)
+		}
+	}
 
 	logger.Debug("Probing partitions on NBD device %s", nbdDevice)
 	if err := nbd.ProbePartitions(nbdDevice); err != nil {
@@ -121,59 +381,110 @@ func (m *Mounter) mountQemuImage(imagePath, mountPoint string, readOnly bool, pa
 		return err
 	}
 
-	logger.Debug("Getting partition device for partition number %d on NBD device %s", partitionNum, nbdDevice)
-	partition, err := nbd.GetPartitionDevice(nbdDevice, partitionNum)
+	partitions, err := nbd.ListPartitions(nbdDevice)
+	if err != nil {
+		logger.Debug("failed to list partitions on %s: %v", nbdDevice, err)
+	}
+
+	// Unlock encrypted partitions, their mapper devices become mount candidates
+	// Mappings are recorded before they are opened, closing one that was never opened is harmless
+	luksDevices, unlocked, err := unlockLUKS(partitions, opts, func(name string) error {
+		info.ExtraMounts = append(info.ExtraMounts, luksExtras([]string{name})...)
+		return m.saveRecord(info)
+	})
 	if err != nil {
 		m.disconnectNBDDevice(nbdDevice)
 		return err
 	}
+	devices := append(luksDevices, partitions...)
+
+	// Activate LVM volume groups found on the image (or inside LUKS), their logical volumes become mount candidates
+	vgs, lvs, err := activateLVM(nbdDevice, devices, readOnly)
+	if err != nil {
+		m.ReleaseDevices(info)
+		return err
+	}
+	info.ExtraMounts = append(info.ExtraMounts, volumeGroupExtras(vgs)...)
+	if err := m.saveRecord(info); err != nil {
+		m.ReleaseDevices(info)
+		return fmt.Errorf("failed to save mount record: %w", err)
+	}
+
+	devices = append(lvmDevices(lvs), devices...)
+
+	logger.Debug("Getting partition device for partition number %d on NBD device %s", partitionNum, nbdDevice)
+	partition, err := selectRootDevice(nbdDevice, devices, lvs, unlocked, opts)
+	if err != nil {
+		m.ReleaseDevices(info)
+		return err
+	}
 
 	// Build mount options
 	logger.Debug("Mounting partition %s to mount point %s", partition, mountPoint)
-	mountOpts := []string{}
+	rootFSType := fsType(devices, partition)
+	mountType, fsOpts := filesystemOptions(rootFSType, readOnly, opts.NTFSDriver)
 	if readOnly {
 		logger.Debug("Mounting in read-only mode")
-		mountOpts = append(mountOpts, "-r")
+	}
+	if rootFSType == "btrfs" {
+		if subvol := selectBtrfsSubvolume(partition, opts); subvol != "" {
+			fsOpts = append(fsOpts, "subvol="+subvol)
+		}
+	}
+
+	mountOpts := []string{}
+	if mountType != "" {
+		mountOpts = append(mountOpts, "-t", mountType)
+	}
+	if merged := mergeOptions(fsOpts, opts.MountOptions); len(merged) > 0 {
+		mountOpts = append(mountOpts, "-o", strings.Join(merged, ","))
 	}
 	mountOpts = append(mountOpts, partition, mountPoint)
 
 	logger.Debug("Executing mount command: %s", strings.Join(mountOpts, " "))
 	cmd := exec.Command("mount", mountOpts...)
 	if output, err := cmd.CombinedOutput(); err != nil {
-		m.disconnectNBDDevice(nbdDevice) // Attempt to disconnect NBD if mount fails
+		m.ReleaseDevices(info) // Attempt to release LVM, LUKS and NBD if mount fails
 		return fmt.Errorf("failed to mount %s to %s: %w\nOutput: %s", partition, mountPoint, err, string(output))
 	}
 
-	// Store NBD metadata outside the mount point
-	nbdFile := filepath.Join(m.metadataDir, filepath.Base(mountPoint)+".nbd")
-	if err := os.WriteFile(nbdFile, []byte(nbdDevice), 0644); err != nil {
-		m.Unmount(mountPoint) // Attempt to unmount if saving metadata fails
-		return fmt.Errorf("failed to save nbd info: %w", err)
-	}
+	info.RootDevice = partition
+	info.Partition = partitionNumber(partitions, unlocked, partition)
+	info.FSType = rootFSType
 
-	return nil
-}
+	if opts.All {
+		aliases := lvmAliases(lvs)
+		for guestPath, device := range cryptAliases(mountPoint, unlocked) {
+			aliases[guestPath] = device
+		}
 
-func (m *Mounter) disconnectNBD(mountPoint string) error {
-	nbdFile := filepath.Join(m.metadataDir, filepath.Base(mountPoint)+".nbd")
-	data, err := os.ReadFile(nbdFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// The NBD doesn't exist. let's check lsblk.
-			logger.Warn("NBD metadata file not found, please run lsblk for check which NBD device is used and unmount it via qemu-nbd --disconnect")
-			return errors.New("NBD metadata file mismatch")
+		submounts, err := m.mountFstab(devices, aliases, partition, mountPoint, opts)
+		if err != nil {
+			logger.Warn("failed to mount fstab entries: %v", err)
 		}
 
-		return nil
+		for _, target := range submounts {
+			info.ExtraMounts = append(info.ExtraMounts, storage.ExtraMount{Type: storage.ExtraTypeMount, Target: target})
+		}
 	}
 
-	nbdDevice := strings.TrimSpace(string(data))
-	err = m.disconnectNBDDevice(nbdDevice)
-
-	// Clean up metadata file
-	os.Remove(nbdFile)
+	return nil
+}
 
-	return err
+// partitionNumber returns the number of the partition a root device lives on,
+// looking through LUKS mappings. Logical volumes have no partition number.
+func partitionNumber(partitions []nbd.PartitionInfo, unlocked map[string]string, device string) int {
+	for partition, mapper := range unlocked {
+		if mapper == device {
+			device = partition
+		}
+	}
+	for _, p := range partitions {
+		if p.Path == device {
+			return p.Number
+		}
+	}
+	return 0
 }
 
 func (m *Mounter) disconnectNBDDevice(nbdDevice string) error {
@@ -0,0 +1,102 @@
+package mount
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// NTFS drivers that can be chosen with Options.NTFSDriver
+const (
+	NTFSDriverNTFS3  = "ntfs3"
+	NTFSDriverNTFS3G = "ntfs-3g"
+)
+
+// filesystemOptions returns the filesystem type to pass to mount(8) and the default
+// options for it. An empty type lets mount(8) detect it.
+//
+//   - XFS is always mounted with nouuid, so clones of the same image can be mounted at once
+//   - read-only ext3/ext4, XFS and btrfs mounts skip journal replay (noload/norecovery/nologreplay),
+//     which would otherwise write to the image despite the read-only mount
+//   - NTFS uses the ntfs3 kernel driver if available and ntfs-3g otherwise,
+//     unless a driver is chosen explicitly
+func filesystemOptions(fsType string, readOnly bool, ntfsDriver string) (string, []string) {
+	var opts []string
+	if readOnly {
+		opts = append(opts, "ro")
+	}
+
+	switch strings.ToLower(fsType) {
+	case "xfs":
+		opts = append(opts, "nouuid")
+		if readOnly {
+			opts = append(opts, "norecovery")
+		}
+		return "xfs", opts
+	case "ext3", "ext4":
+		if readOnly {
+			opts = append(opts, "noload")
+		}
+		return fsType, opts
+	case "btrfs":
+		if readOnly {
+			opts = append(opts, "nologreplay")
+		}
+		return "btrfs", opts
+	case "ntfs", "ntfs3", "ntfs-3g":
+		return chooseNTFSDriver(ntfsDriver), opts
+	case "":
+		return "", opts
+	}
+
+	return fsType, opts
+}
+
+// chooseNTFSDriver returns the requested NTFS driver, or the best available one
+func chooseNTFSDriver(requested string) string {
+	if requested != "" {
+		return requested
+	}
+
+	if kernelSupports(NTFSDriverNTFS3) {
+		return NTFSDriverNTFS3
+	}
+	if _, err := exec.LookPath("ntfs-3g"); err == nil {
+		return NTFSDriverNTFS3G
+	}
+
+	logger.Debug("neither ntfs3 nor ntfs-3g is available, falling back to the legacy ntfs driver")
+	return "ntfs"
+}
+
+// kernelSupports reports whether the kernel knows a filesystem, loading its module if needed
+func kernelSupports(fsType string) bool {
+	if data, err := os.ReadFile("/proc/filesystems"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[len(fields)-1] == fsType {
+				return true
+			}
+		}
+	}
+	return exec.Command("modprobe", fsType).Run() == nil
+}
+
+// mergeOptions appends options, skipping duplicates. Later options win in mount(8),
+// so user supplied options should come last.
+func mergeOptions(lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, opt := range list {
+			if opt == "" || seen[opt] {
+				continue
+			}
+			seen[opt] = true
+			merged = append(merged, opt)
+		}
+	}
+	return merged
+}
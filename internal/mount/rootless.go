@@ -0,0 +1,381 @@
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/nbd"
+	"github.com/packetstream-llc/qimi/internal/partition"
+	"github.com/packetstream-llc/qimi/internal/storage"
+)
+
+// exportStopTimeout is how long qemu-storage-daemon gets to shut down before it is killed
+const exportStopTimeout = 5 * time.Second
+
+// CheckRootlessDependencies verifies that the tools for rootless mounts are
+// available: qemu-storage-daemon serves the image as a file through FUSE and
+// a FUSE filesystem driver mounts it
+func CheckRootlessDependencies() error {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return fmt.Errorf("/dev/fuse not available: %w", err)
+	}
+	if fusermount() == "" {
+		return errors.New("fusermount3 not found")
+	}
+	if _, err := exec.LookPath("qemu-storage-daemon"); err != nil {
+		return fmt.Errorf("qemu-storage-daemon not found: %w", err)
+	}
+	if _, err := exec.LookPath("blkid"); err != nil {
+		return fmt.Errorf("blkid not found: %w", err)
+	}
+	for _, driver := range []string{"fuse2fs", "lklfuse", "ntfs-3g"} {
+		if _, err := exec.LookPath(driver); err == nil {
+			return nil
+		}
+	}
+	return errors.New("no FUSE filesystem driver found (fuse2fs, lklfuse or ntfs-3g)")
+}
+
+// checkRootlessOptions rejects what needs the kernel's block layer
+func checkRootlessOptions(opts Options) error {
+	switch {
+	case opts.LV != "":
+		return errors.New("LVM logical volumes can't be mounted without root")
+	case opts.All:
+		return errors.New("--all can't be used without root")
+	case opts.Subvol != "":
+		return errors.New("btrfs subvolumes can't be selected without root")
+	case opts.NTFSDriver == NTFSDriverNTFS3:
+		return errors.New("the ntfs3 kernel driver needs root, use ntfs-3g")
+	}
+	return nil
+}
+
+// mountRootless mounts an image without root: qemu-storage-daemon exports the
+// root partition as a file through FUSE, which a FUSE filesystem driver mounts
+func (m *Mounter) mountRootless(info *storage.MountInfo, opts Options) error {
+	if err := checkRootlessOptions(opts); err != nil {
+		return err
+	}
+	exportPath := m.metadataPath(info.MountPoint, ".export")
+
+	// The partition table is read through an export of the whole disk
+	pid, err := startExport(info, exportPath, nil, true)
+	if err != nil {
+		return err
+	}
+	root, err := selectRootlessPartition(exportPath, opts.Partition)
+	stopExport(pid, exportPath)
+	if err != nil {
+		return err
+	}
+
+	if pid, err = startExport(info, exportPath, root, opts.ReadOnly); err != nil {
+		return err
+	}
+	info.Rootless = true
+	info.ExtraMounts = append(info.ExtraMounts, storage.ExtraMount{Type: storage.ExtraTypeExport, Name: "qemu-storage-daemon", Target: exportPath, PID: pid})
+	if err := m.saveRecord(info); err != nil {
+		m.ReleaseDevices(info)
+		return fmt.Errorf("failed to save mount record: %w", err)
+	}
+
+	fsType := nbd.ProbeFilesystem(exportPath)["TYPE"]
+	cmd, err := fuseCommand(fsType, exportPath, info.MountPoint, opts)
+	if err != nil {
+		m.ReleaseDevices(info)
+		return err
+	}
+	logger.Debug("Executing FUSE driver: %s", strings.Join(cmd.Args, " "))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		m.ReleaseDevices(info)
+		return fmt.Errorf("failed to mount %s with %s: %w\nOutput: %s", info.ImagePath, cmd.Args[0], err, string(output))
+	}
+
+	if root != nil {
+		info.Partition = root.Number
+	}
+	info.FSType = fsType
+	return nil
+}
+
+// selectRootlessPartition picks the partition to mount from an export of the
+// whole disk. It returns nil for disks without a partition table.
+func selectRootlessPartition(exportPath string, number int) (*partition.Partition, error) {
+	table, err := partition.ReadDevice(exportPath)
+	if errors.Is(err, partition.ErrNoTable) {
+		if number > 0 {
+			return nil, fmt.Errorf("partition %d not found, the image has no partition table", number)
+		}
+		logger.Debug("no partition table found, using the whole disk")
+		if fsType := nbd.ProbeFilesystem(exportPath)["TYPE"]; fsType != "" {
+			if err := checkRootlessFilesystem(fsType); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+
+	if number > 0 {
+		p := table.Partition(number)
+		if p == nil || p.Extended {
+			return nil, fmt.Errorf("partition %d not found", number)
+		}
+		if err := checkRootlessFilesystem(probeRange(exportPath, p.Start, p.Size)["TYPE"]); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	// The root is selected like for NBD devices, without looking for os-release
+	var candidates []nbd.PartitionInfo
+	var unsupported error
+	for _, p := range table.Partitions {
+		if p.Extended {
+			continue
+		}
+		info := nbd.PartitionInfo{
+			Number:   p.Number,
+			Path:     fmt.Sprintf("partition %d", p.Number),
+			FSType:   probeRange(exportPath, p.Start, p.Size)["TYPE"],
+			PartUUID: p.PartUUID,
+			Size:     p.Size,
+			TypeGUID: p.TypeGUID,
+			TypeID:   p.TypeID,
+			Name:     p.Name,
+			Flags:    p.Flags,
+		}
+		logger.Debug("partition %d: fstype=%s size=%d", info.Number, info.FSType, info.Size)
+		if err := checkRootlessFilesystem(info.FSType); err != nil {
+			unsupported = err
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+
+	selected, err := nbd.SelectRoot(candidates)
+	if err != nil && unsupported != nil {
+		return nil, unsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return table.Partition(selected.Number), nil
+}
+
+// checkRootlessFilesystem rejects containers that need the device mapper
+func checkRootlessFilesystem(fsType string) error {
+	switch fsType {
+	case "crypto_LUKS":
+		return errors.New("LUKS encrypted partitions can't be unlocked without root")
+	case "LVM2_member":
+		return errors.New("LVM volume groups can't be activated without root")
+	}
+	return nil
+}
+
+// probeRange returns the superblock properties blkid reports for a range of a file
+func probeRange(path string, offset, size int64) map[string]string {
+	props := make(map[string]string)
+	cmd := exec.Command("blkid", "-p", "-o", "export", "-O", strconv.FormatInt(offset, 10), "-S", strconv.FormatInt(size, 10), path)
+	output, err := cmd.Output()
+	if err != nil {
+		return props
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			props[key] = value
+		}
+	}
+	return props
+}
+
+// startExport starts qemu-storage-daemon exporting the image, or a partition
+// of it, through FUSE on exportPath and returns the daemon's PID
+func startExport(info *storage.MountInfo, exportPath string, p *partition.Partition, readOnly bool) (int, error) {
+	// The export is mounted over a regular file
+	if err := os.WriteFile(exportPath, nil, 0600); err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	pidFile := exportPath + ".pid"
+	os.Remove(pidFile)
+
+	format := info.Format
+	if format == "" {
+		format = "raw"
+	}
+	ro := "off"
+	if readOnly {
+		ro = "on"
+	}
+
+	node := "format"
+	args := []string{
+		"--blockdev", fmt.Sprintf("driver=file,node-name=file,filename=%s,read-only=%s", qemuEscape(info.ImagePath), ro),
+		"--blockdev", fmt.Sprintf("driver=%s,node-name=format,file=file,read-only=%s", format, ro),
+	}
+	if p != nil {
+		node = "partition"
+		args = append(args, "--blockdev", fmt.Sprintf("driver=raw,node-name=partition,file=format,offset=%d,size=%d,read-only=%s", p.Start, p.Size, ro))
+	}
+	writable := "on"
+	if readOnly {
+		writable = "off"
+	}
+	args = append(args,
+		"--export", fmt.Sprintf("type=fuse,id=export,node-name=%s,mountpoint=%s,writable=%s,allow-other=off", node, qemuEscape(exportPath), writable),
+		"--pidfile", pidFile,
+		"--daemonize",
+	)
+
+	logger.Debug("Executing qemu-storage-daemon %s", strings.Join(args, " "))
+	if output, err := exec.Command("qemu-storage-daemon", args...).CombinedOutput(); err != nil {
+		os.Remove(exportPath)
+		if msg := string(output); strings.Contains(msg, "Failed to get") && strings.Contains(msg, "lock") {
+			return 0, fmt.Errorf("%w: %s", nbd.ErrImageLocked, strings.TrimSpace(msg))
+		}
+		return 0, fmt.Errorf("failed to export %s: %w\nOutput: %s", info.ImagePath, err, string(output))
+	}
+
+	data, err := os.ReadFile(pidFile)
+	os.Remove(pidFile)
+	pid, convErr := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || convErr != nil {
+		UnmountFUSE(exportPath)
+		os.Remove(exportPath)
+		return 0, fmt.Errorf("failed to read the PID of qemu-storage-daemon from %s", pidFile)
+	}
+	logger.Debug("qemu-storage-daemon (PID %d) exports %s on %s", pid, info.ImagePath, exportPath)
+	return pid, nil
+}
+
+// stopExport stops qemu-storage-daemon, which unmounts its export, and
+// removes the export file
+func stopExport(pid int, exportPath string) error {
+	logger.Debug("Stopping qemu-storage-daemon (PID %d)", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("failed to stop qemu-storage-daemon (PID %d): %w", pid, err)
+	}
+
+	deadline := time.Now().Add(exportStopTimeout)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			logger.Warn("qemu-storage-daemon (PID %d) did not exit, killing it", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// A killed daemon leaves its export mounted
+	UnmountFUSE(exportPath)
+	if err := os.Remove(exportPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove export file: %w", err)
+	}
+	return nil
+}
+
+// releaseExports stops the qemu-storage-daemon of a rootless mount
+func (m *Mounter) releaseExports(info *storage.MountInfo) error {
+	var errs []error
+	running := info.ExportRunning()
+	for _, e := range info.Extras(storage.ExtraTypeExport) {
+		// Never signal a process that merely reuses the PID
+		if !running {
+			UnmountFUSE(e.Target)
+			os.Remove(e.Target)
+			continue
+		}
+		if err := stopExport(e.PID, e.Target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fuseCommand returns the command that mounts a filesystem of the given type
+// from device on the mount point with a FUSE driver: fuse2fs for ext2/3/4,
+// ntfs-3g for NTFS and lklfuse, which runs the Linux filesystem code in user
+// space, for the rest
+func fuseCommand(fsType, device, mountPoint string, opts Options) (*exec.Cmd, error) {
+	var fuseOpts []string
+	if opts.ReadOnly {
+		fuseOpts = append(fuseOpts, "ro")
+	}
+	has := func(driver string) bool {
+		_, err := exec.LookPath(driver)
+		return err == nil
+	}
+
+	switch strings.ToLower(fsType) {
+	case "":
+		return nil, errors.New("no filesystem found")
+	case "ext2", "ext3", "ext4":
+		if has("fuse2fs") {
+			// fakeroot gives the mounting user, root of exec's user namespace, access to every file
+			fuseOpts = mergeOptions(append(fuseOpts, "fakeroot"), opts.MountOptions)
+			return exec.Command("fuse2fs", device, mountPoint, "-o", strings.Join(fuseOpts, ",")), nil
+		}
+	case "ntfs":
+		if has("ntfs-3g") {
+			fuseOpts = mergeOptions(fuseOpts, opts.MountOptions)
+			if len(fuseOpts) == 0 {
+				return exec.Command("ntfs-3g", device, mountPoint), nil
+			}
+			return exec.Command("ntfs-3g", "-o", strings.Join(fuseOpts, ","), device, mountPoint), nil
+		}
+	}
+
+	if !has("lklfuse") {
+		return nil, fmt.Errorf("no FUSE driver found for %s filesystems, install lklfuse (or fuse2fs for ext2/3/4, ntfs-3g for NTFS)", fsType)
+	}
+	// lklfuse passes the filesystem's own options on in opts, with escaped commas
+	mountType, fsOpts := filesystemOptions(fsType, opts.ReadOnly, NTFSDriverNTFS3)
+	var kernelOpts []string
+	for _, o := range mergeOptions(fsOpts, opts.MountOptions) {
+		if o != "ro" {
+			kernelOpts = append(kernelOpts, o)
+		}
+	}
+	fuseOpts = append(fuseOpts, "type="+mountType)
+	if len(kernelOpts) > 0 {
+		fuseOpts = append(fuseOpts, "opts="+strings.Join(kernelOpts, `\,`))
+	}
+	return exec.Command("lklfuse", device, mountPoint, "-o", strings.Join(fuseOpts, ",")), nil
+}
+
+// fusermount returns the helper that unmounts FUSE filesystems without root
+func fusermount() string {
+	for _, tool := range []string{"fusermount3", "fusermount"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// UnmountFUSE unmounts a FUSE filesystem mounted without root
+func UnmountFUSE(path string) ([]byte, error) {
+	tool := fusermount()
+	if tool == "" {
+		return nil, errors.New("fusermount3 not found")
+	}
+	logger.Debug("unmounting FUSE filesystem: %s", path)
+	return exec.Command(tool, "-u", path).CombinedOutput()
+}
+
+// qemuEscape escapes a value for qemu's comma separated options
+func qemuEscape(s string) string {
+	return strings.ReplaceAll(s, ",", ",,")
+}
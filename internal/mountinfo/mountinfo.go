@@ -0,0 +1,105 @@
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/fstab"
+)
+
+// Entry is a single line of /proc/self/mountinfo
+type Entry struct {
+	ID         int
+	ParentID   int
+	MountPoint string
+	Options    []string
+	FSType     string
+	Source     string
+}
+
+// Read returns the mounts of the calling process's mount namespace
+func Read() ([]Entry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses the format of proc_pid_mountinfo(5)
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", scanner.Text())
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount ID %q: %w", fields[0], err)
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent mount ID %q: %w", fields[1], err)
+		}
+
+		entries = append(entries, Entry{
+			ID:         id,
+			ParentID:   parentID,
+			MountPoint: fstab.Unescape(fields[4]),
+			Options:    strings.Split(fields[5], ","),
+			FSType:     fstab.Unescape(fields[sep+1]),
+			Source:     fstab.Unescape(fields[sep+2]),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// Under returns the entries mounted at dir or below it, deepest first, so
+// they can be unmounted in order
+func Under(entries []Entry, dir string) []Entry {
+	dir = filepath.Clean(dir)
+
+	var under []Entry
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.MountPoint == dir || strings.HasPrefix(e.MountPoint, dir+"/") {
+			under = append(under, e)
+		}
+	}
+
+	// Later mounts stack on earlier ones and the mount table lists them in
+	// mount order, so walking it backwards keeps the newest first among equal depths
+	sort.SliceStable(under, func(i, j int) bool {
+		return strings.Count(under[i].MountPoint, "/") > strings.Count(under[j].MountPoint, "/")
+	})
+	return under
+}
+
+// IsMounted reports whether something is mounted at path
+func IsMounted(entries []Entry, path string) bool {
+	path = filepath.Clean(path)
+	for _, e := range entries {
+		if e.MountPoint == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package nbd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// ErrImageLocked is returned when qemu's image locking reports that another
+// process has the image open for writing
+var ErrImageLocked = errors.New("image is in use by another process")
+
+// CheckImageLock asks qemu whether another process (a running VM, qemu-nbd,
+// ...) holds a write lock on the image. qemu-img info only needs a shared
+// lock, so it fails exactly when someone is writing to the image.
+func CheckImageLock(imagePath string) error {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		logger.Debug("qemu-img not found, skipping image lock check")
+		return nil
+	}
+
+	out, err := exec.Command("qemu-img", "info", imagePath).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if isLockError(string(out)) {
+		return fmt.Errorf("%w: %s", ErrImageLocked, strings.TrimSpace(string(out)))
+	}
+
+	logger.Debug("qemu-img info %s failed: %v: %s", imagePath, err, strings.TrimSpace(string(out)))
+	return nil
+}
+
+// ImageFormat returns the format qemu detects for an image, or "" if it
+// cannot tell. Without qemu-img only qcow2 and raw are told apart.
+func ImageFormat(imagePath string) string {
+	if _, err := exec.LookPath("qemu-img"); err == nil {
+		// -U skips locking, the image may already be attached
+		out, err := exec.Command("qemu-img", "info", "-U", "--output=json", imagePath).Output()
+		if err == nil {
+			var info struct {
+				Format string `json:"format"`
+			}
+			if json.Unmarshal(out, &info) == nil && info.Format != "" {
+				return info.Format
+			}
+		}
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return ""
+	}
+	if string(magic) == "QFI\xfb" {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+// isLockError reports whether qemu output describes an image locking failure
+func isLockError(output string) bool {
+	return strings.Contains(output, "Failed to get") && strings.Contains(output, "lock")
+}
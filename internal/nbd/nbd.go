@@ -1,6 +1,7 @@
 package nbd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -8,6 +9,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/partition"
 )
 
 // CheckSystemDependencies verifies that required tools and modules are available
@@ -27,6 +31,11 @@ func CheckSystemDependencies() error {
 		return fmt.Errorf("partprobe not found: %w", err)
 	}
 
+	// Check if blkid is available
+	if _, err := exec.LookPath("blkid"); err != nil {
+		return fmt.Errorf("blkid not found: %w", err)
+	}
+
 	return nil
 }
 
@@ -110,8 +119,11 @@ func ConnectImage(imagePath, nbd string, readOnly bool) error {
 		args = append(args, "--read-only")
 	}
 
-	cmd := exec.Command("qemu-nbd", args...)
-	if err := cmd.Run(); err != nil {
+	out, err := exec.Command("qemu-nbd", args...).CombinedOutput()
+	if err != nil {
+		if isLockError(string(out)) {
+			return fmt.Errorf("failed to connect %s to %s: %w: %s", imagePath, nbd, ErrImageLocked, strings.TrimSpace(string(out)))
+		}
 		return fmt.Errorf("failed to connect %s to %s: %w", imagePath, nbd, err)
 	}
 
@@ -139,9 +151,24 @@ func ProbePartitions(nbd string) error {
 
 // PartitionInfo contains information about a partition
 type PartitionInfo struct {
-	Number int
-	Path   string
-	FSType string
+	Number   int
+	Path     string
+	FSType   string
+	UUID     string
+	Label    string
+	PartUUID string
+	Size     int64
+	TypeGUID string
+	TypeID   byte
+	Name     string
+	Flags    partition.Flags
+}
+
+func (p PartitionInfo) typeString() string {
+	if p.TypeGUID != "" {
+		return partition.TypeName(p.TypeGUID)
+	}
+	return fmt.Sprintf("0x%02x", p.TypeID)
 }
 
 // GetPartitionDevice returns the best partition device to mount
@@ -167,6 +194,7 @@ func GetPartitionDevice(nbd string, partitionNum int) (string, error) {
 	if len(partitions) == 0 {
 		// No suitable partitions found, use the device directly if it has a filesystem
 		if deviceHasFS {
+			logger.Debug("no partitions found, using %s directly", nbd)
 			return nbd, nil
 		}
 		// No filesystem found anywhere
@@ -174,60 +202,100 @@ func GetPartitionDevice(nbd string, partitionNum int) (string, error) {
 	}
 
 	if len(partitions) > 1 {
-		// Check if we have obvious root filesystems vs boot/swap partitions
-		rootFSTypes := []string{"ext4", "ext3", "ext2", "xfs", "btrfs", "f2fs"}
-		var rootPartitions []PartitionInfo
-		
-		for _, part := range partitions {
-			for _, rootFS := range rootFSTypes {
-				if strings.EqualFold(part.FSType, rootFS) {
-					rootPartitions = append(rootPartitions, part)
-					break
-				}
-			}
+		part, err := selectRootPartition(partitions)
+		if err != nil {
+			return "", err
 		}
-		
-		// If we have exactly one obvious root filesystem, use it
-		if len(rootPartitions) == 1 {
-			return rootPartitions[0].Path, nil
+		return part.Path, nil
+	}
+
+	// Single suitable partition found
+	logger.Debug("selected %s: only partition with a filesystem", partitions[0].Path)
+	return partitions[0].Path, nil
+}
+
+// SelectRoot picks the root filesystem among arbitrary candidate devices,
+// such as partitions combined with LVM logical volumes
+func SelectRoot(candidates []PartitionInfo) (PartitionInfo, error) {
+	partitions := filterSuitablePartitions(candidates)
+	switch len(partitions) {
+	case 0:
+		return PartitionInfo{}, fmt.Errorf("no filesystem found")
+	case 1:
+		logger.Debug("selected %s: only candidate with a filesystem", partitions[0].Path)
+		return partitions[0], nil
+	}
+	return selectRootPartition(partitions)
+}
+
+// selectRootPartition picks the root filesystem among several partitions sorted by filesystem preference
+func selectRootPartition(partitions []PartitionInfo) (PartitionInfo, error) {
+	// Prefer partitions typed as root by the Discoverable Partitions Specification
+	if part, ok := selectByPartitionType(partitions); ok {
+		return part, nil
+	}
+
+	// Otherwise look for the partition that actually contains an OS
+	if part, ok := selectByOSRelease(partitions); ok {
+		return part, nil
+	}
+
+	logger.Debug("no partition could be identified as root, falling back to filesystem type preference")
+
+	// Check if we have obvious root filesystems vs boot/swap partitions
+	rootFSTypes := []string{"ext4", "ext3", "ext2", "xfs", "btrfs", "f2fs"}
+	var rootPartitions []PartitionInfo
+
+	for _, part := range partitions {
+		for _, rootFS := range rootFSTypes {
+			if strings.EqualFold(part.FSType, rootFS) {
+				rootPartitions = append(rootPartitions, part)
+				break
+			}
 		}
-		
-		// If we have multiple root filesystems of different types, pick the most preferred
-		if len(rootPartitions) > 1 {
-			// Check if they're all the same filesystem type
-			firstType := strings.ToLower(rootPartitions[0].FSType)
-			allSameType := true
-			for _, part := range rootPartitions[1:] {
-				if strings.ToLower(part.FSType) != firstType {
-					allSameType = false
-					break
-				}
+	}
+
+	// If we have exactly one obvious root filesystem, use it
+	if len(rootPartitions) == 1 {
+		logger.Debug("selected %s: only partition with a common root filesystem (%s)", rootPartitions[0].Path, rootPartitions[0].FSType)
+		return rootPartitions[0], nil
+	}
+
+	// If we have multiple root filesystems of different types, pick the most preferred
+	if len(rootPartitions) > 1 {
+		// Check if they're all the same filesystem type
+		firstType := strings.ToLower(rootPartitions[0].FSType)
+		allSameType := true
+		for _, part := range rootPartitions[1:] {
+			if strings.ToLower(part.FSType) != firstType {
+				allSameType = false
+				break
 			}
-			
-			// If they're all the same type (e.g., multiple XFS), pick the larger one
-			if allSameType {
-				largestPartition, err := findLargestPartition(rootPartitions)
-				if err != nil {
-					// If we can't determine size, fall back to asking user
-					var partNums []string
-					for _, p := range rootPartitions {
-						partNums = append(partNums, fmt.Sprintf("%d (%s)", p.Number, p.FSType))
-					}
-					return "", fmt.Errorf("multiple %s partitions found: %s. Please specify a partition number using --partition flag", firstType, strings.Join(partNums, ", "))
+		}
+
+		// If they're all the same type (e.g., multiple XFS), pick the larger one
+		if allSameType {
+			largestPartition, err := findLargestPartition(rootPartitions)
+			if err != nil {
+				// If we can't determine size, fall back to asking user
+				var partNums []string
+				for _, p := range rootPartitions {
+					partNums = append(partNums, fmt.Sprintf("%d (%s)", p.Number, p.FSType))
 				}
-				return largestPartition.Path, nil
+				return PartitionInfo{}, fmt.Errorf("multiple %s partitions found: %s. Please specify a partition number using --partition flag", firstType, strings.Join(partNums, ", "))
 			}
-			
-			// Different root filesystem types, pick the most preferred one
-			return rootPartitions[0].Path, nil
+			logger.Debug("selected %s: largest of %d %s partitions", largestPartition.Path, len(rootPartitions), firstType)
+			return largestPartition, nil
 		}
-		
-		// No obvious root filesystems, return the most preferred available
-		return partitions[0].Path, nil
+
+		// Different root filesystem types, pick the most preferred one
+		logger.Debug("selected %s: most preferred filesystem type (%s)", rootPartitions[0].Path, rootPartitions[0].FSType)
+		return rootPartitions[0], nil
 	}
 
-	// Single suitable partition found
-	return partitions[0].Path, nil
+	// No obvious root filesystems, return the most preferred available
+	logger.Debug("selected %s: no common root filesystem found, using the most preferred available (%s)", partitions[0].Path, partitions[0].FSType)
+	return partitions[0], nil
 }
 
 // GetPartitionNumber extracts partition number from a partition specifier
@@ -258,70 +326,33 @@ func GetPartitionNumber(partSpec string) int {
 // Returns a list of partitions with recognized filesystems, sorted by preference
 // Also returns whether the device itself has a filesystem
 func detectSuitablePartitions(nbd string) ([]PartitionInfo, bool, error) {
-	// Get partition information using lsblk
-	cmd := exec.Command("lsblk", "-o", "NAME,FSTYPE", "-r", "-n", nbd)
-	output, err := cmd.Output()
+	deviceHasFS := ProbeFilesystem(nbd)["TYPE"] != ""
+
+	partitions, err := ListPartitions(nbd)
 	if err != nil {
-		// If lsblk fails, check if we can use the device directly
-		if _, statErr := os.Stat(nbd); statErr == nil {
+		if errors.Is(err, partition.ErrNoTable) {
+			logger.Debug("no partition table found on %s", nbd)
+			return nil, deviceHasFS, nil
+		}
+		if deviceHasFS {
+			// The partition table is unreadable, but the device can still be used directly
+			logger.Warn("failed to read partition table on %s: %v, using the device directly", nbd, err)
 			return nil, true, nil
 		}
 		return nil, false, fmt.Errorf("failed to get partition info for %s: %w", nbd, err)
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) == 0 {
-		return nil, false, nil // No partitions
-	}
-
-	// Debug: print lsblk output
-	// fmt.Printf("DEBUG: lsblk output for %s:\n%s\n", nbd, string(output))
-
-	// Parse partition information
-	var partitions []PartitionInfo
-	var deviceHasFS bool
-	baseDeviceName := strings.TrimPrefix(nbd, "/dev/")
-
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 1 {
-			continue
-		}
-
-		name := fields[0]
-		fstype := ""
-		if len(fields) > 1 {
-			fstype = fields[1]
-		}
-
-		// Check if the base device itself has a filesystem
-		if name == baseDeviceName {
-			if fstype != "" && fstype != "-" {
-				deviceHasFS = true
-			}
-			continue
-		}
-
-		// Check if this is a partition of our device
-		if strings.HasPrefix(name, baseDeviceName+"p") {
-			// Extract partition number
-			partNumStr := strings.TrimPrefix(name, baseDeviceName+"p")
-			partNum, _ := strconv.Atoi(partNumStr)
-			if partNum > 0 {
-				partitions = append(partitions, PartitionInfo{
-					Number: partNum,
-					Path:   "/dev/" + name,
-					FSType: fstype,
-				})
-			}
-		}
-	}
-
 	if len(partitions) == 0 {
 		// No partitions found
 		return nil, deviceHasFS, nil
 	}
 
+	return filterSuitablePartitions(partitions), deviceHasFS, nil
+}
+
+// filterSuitablePartitions returns the partitions with recognized filesystems, sorted by preference.
+// If none has a recognized filesystem, all partitions are returned.
+func filterSuitablePartitions(partitions []PartitionInfo) []PartitionInfo {
 	// Priority order for filesystem types (most preferred first)
 	preferredFS := []string{
 		"ext4", "ext3", "ext2", // Linux filesystems
@@ -340,7 +371,7 @@ func detectSuitablePartitions(nbd string) ([]PartitionInfo, bool, error) {
 
 	// If no partitions have recognized filesystems, return all partitions
 	if len(suitablePartitions) == 0 {
-		return partitions, deviceHasFS, nil
+		return partitions
 	}
 
 	// Sort suitable partitions by filesystem preference
@@ -366,7 +397,7 @@ func detectSuitablePartitions(nbd string) ([]PartitionInfo, bool, error) {
 		}
 	}
 
-	return suitablePartitions, deviceHasFS, nil
+	return suitablePartitions
 }
 
 // findLargestPartition finds the partition with the largest size from the given list
@@ -375,58 +406,81 @@ func findLargestPartition(partitions []PartitionInfo) (PartitionInfo, error) {
 		return PartitionInfo{}, fmt.Errorf("no partitions provided")
 	}
 
-	// Get partition sizes using lsblk
-	var devicePaths []string
-	for _, p := range partitions {
-		devicePaths = append(devicePaths, p.Path)
+	// Find the partition with the largest size
+	var largestPartition PartitionInfo
+	var largestSize int64 = -1
+
+	for _, partition := range partitions {
+		if partition.Size > largestSize {
+			largestSize = partition.Size
+			largestPartition = partition
+		}
 	}
 
-	cmd := exec.Command("lsblk", "-o", "NAME,SIZE", "-r", "-n", "-b")
-	cmd.Args = append(cmd.Args, devicePaths...)
-	
-	output, err := cmd.Output()
-	if err != nil {
-		return PartitionInfo{}, fmt.Errorf("failed to get partition sizes: %w", err)
+	if largestSize <= 0 {
+		return PartitionInfo{}, fmt.Errorf("could not determine partition sizes")
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	partitionSizes := make(map[string]int64)
+	return largestPartition, nil
+}
+
+// ListPartitions reads the partition table of an NBD device and returns its partitions
+// with their detected filesystems. Extended partition containers are skipped.
+func ListPartitions(nbd string) ([]PartitionInfo, error) {
+	table, err := partition.ReadDevice(nbd)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("found %s partition table on %s with %d entries", table.Type, nbd, len(table.Partitions))
 
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
+	var partitions []PartitionInfo
+	for _, p := range table.Partitions {
+		if p.Extended {
 			continue
 		}
-		
-		deviceName := fields[0]
-		sizeStr := fields[1]
-		
-		size, err := strconv.ParseInt(sizeStr, 10, 64)
-		if err != nil {
-			continue
+
+		path := fmt.Sprintf("%sp%d", nbd, p.Number)
+		props := ProbeFilesystem(path)
+		info := PartitionInfo{
+			Number:   p.Number,
+			Path:     path,
+			FSType:   props["TYPE"],
+			UUID:     props["UUID"],
+			Label:    props["LABEL"],
+			PartUUID: p.PartUUID,
+			Size:     p.Size,
+			TypeGUID: p.TypeGUID,
+			TypeID:   p.TypeID,
+			Name:     p.Name,
+			Flags:    p.Flags,
 		}
-		
-		// Map device name to full path
-		fullPath := "/dev/" + deviceName
-		partitionSizes[fullPath] = size
+		logger.Debug("partition %d: path=%s fstype=%s size=%d type=%s name=%q flags=%s",
+			info.Number, info.Path, info.FSType, info.Size, info.typeString(), info.Name, info.Flags)
+		partitions = append(partitions, info)
 	}
 
-	// Find the partition with the largest size
-	var largestPartition PartitionInfo
-	var largestSize int64 = -1
+	return partitions, nil
+}
 
-	for _, partition := range partitions {
-		if size, exists := partitionSizes[partition.Path]; exists {
-			if size > largestSize {
-				largestSize = size
-				largestPartition = partition
-			}
-		}
+// ProbeFilesystem returns the superblock properties blkid reports for a device (TYPE, UUID, LABEL, ...)
+// An empty map is returned if nothing could be detected
+func ProbeFilesystem(device string) map[string]string {
+	props := make(map[string]string)
+
+	// -p bypasses the blkid cache, which knows nothing about freshly attached NBD devices
+	cmd := exec.Command("blkid", "-p", "-o", "export", device)
+	output, err := cmd.Output()
+	if err != nil {
+		// blkid exits with status 2 if nothing was detected
+		return props
 	}
 
-	if largestSize == -1 {
-		return PartitionInfo{}, fmt.Errorf("could not determine partition sizes")
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			props[key] = value
+		}
 	}
 
-	return largestPartition, nil
+	return props
 }
@@ -0,0 +1,138 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/partition"
+	"github.com/packetstream-llc/qimi/internal/utils"
+)
+
+// osReleasePaths are the locations of os-release relative to a root filesystem
+var osReleasePaths = []string{"etc/os-release", "usr/lib/os-release"}
+
+// selectByPartitionType picks the root partition using the GPT type GUIDs
+// from the Discoverable Partitions Specification. A root partition for the
+// host architecture is preferred over a root partition for a foreign one.
+func selectByPartitionType(partitions []PartitionInfo) (PartitionInfo, bool) {
+	var native, foreign []PartitionInfo
+	for _, p := range partitions {
+		if !partition.IsRootType(p.TypeGUID) {
+			continue
+		}
+		if p.Flags.Has(partition.FlagNoAuto) {
+			logger.Debug("%s has type %s but is marked no-auto, ignoring it", p.Path, partition.TypeName(p.TypeGUID))
+			continue
+		}
+		if partition.IsNativeRootType(p.TypeGUID) {
+			native = append(native, p)
+		} else {
+			foreign = append(foreign, p)
+		}
+	}
+
+	for _, candidates := range [][]PartitionInfo{native, foreign} {
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			p := candidates[0]
+			logger.Debug("selected %s: GPT type is %s (Discoverable Partitions Specification)", p.Path, partition.TypeName(p.TypeGUID))
+			return p, true
+		default:
+			// Several root partitions (e.g. A/B updates), let os-release decide between them
+			if p, ok := selectByOSRelease(candidates); ok {
+				return p, true
+			}
+			p := candidates[0]
+			logger.Debug("selected %s: first of %d partitions with GPT type %s", p.Path, len(candidates), partition.TypeName(p.TypeGUID))
+			return p, true
+		}
+	}
+
+	return PartitionInfo{}, false
+}
+
+// selectByOSRelease mounts each candidate read-only and picks the one that contains os-release.
+// Partitions whose type marks them as something other than root (ESP, swap, /home, ...) are skipped.
+func selectByOSRelease(partitions []PartitionInfo) (PartitionInfo, bool) {
+	var found []PartitionInfo
+	for _, p := range partitions {
+		if partition.IsNonRootType(p.TypeGUID, p.TypeID) {
+			logger.Debug("%s has type %s, not probing it for os-release", p.Path, p.typeString())
+			continue
+		}
+		if p.FSType == "" || p.FSType == "swap" {
+			continue
+		}
+
+		ok, err := hasOSRelease(p)
+		if err != nil {
+			logger.Debug("could not probe %s for os-release: %v", p.Path, err)
+			continue
+		}
+		if ok {
+			logger.Debug("%s (%s) contains os-release", p.Path, p.FSType)
+			found = append(found, p)
+		} else {
+			logger.Debug("%s (%s) has no os-release", p.Path, p.FSType)
+		}
+	}
+
+	if len(found) == 1 {
+		logger.Debug("selected %s: only partition containing os-release", found[0].Path)
+		return found[0], true
+	}
+	if len(found) > 1 {
+		p, err := findLargestPartition(found)
+		if err == nil {
+			logger.Debug("selected %s: largest of %d partitions containing os-release", p.Path, len(found))
+			return p, true
+		}
+	}
+
+	return PartitionInfo{}, false
+}
+
+// hasOSRelease temporarily mounts a partition read-only and checks for /etc/os-release or /usr/lib/os-release
+func hasOSRelease(p PartitionInfo) (bool, error) {
+	if !utils.IsRoot() {
+		return false, errors.New("mounting needs root")
+	}
+
+	probeDir, err := os.MkdirTemp("", "qimi-probe-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create probe directory: %w", err)
+	}
+	defer os.Remove(probeDir)
+
+	// Never replay journals while probing, a read-only mount would otherwise still write to the device
+	opts := []string{"ro"}
+	switch strings.ToLower(p.FSType) {
+	case "ext3", "ext4":
+		opts = append(opts, "noload")
+	case "xfs":
+		opts = append(opts, "norecovery", "nouuid")
+	case "btrfs":
+		opts = append(opts, "nologreplay")
+	}
+
+	cmd := exec.Command("mount", "-t", p.FSType, "-o", strings.Join(opts, ","), p.Path, probeDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("mount failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	defer exec.Command("umount", probeDir).Run()
+
+	for _, rel := range osReleasePaths {
+		if _, err := os.Lstat(filepath.Join(probeDir, rel)); err == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
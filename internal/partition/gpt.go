@@ -0,0 +1,223 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+var errNoGPT = errors.New("no GPT header found")
+
+var gptSignature = []byte("EFI PART")
+
+// Protective MBR partition type used by GPT disks
+const mbrTypeGPTProtective = 0xEE
+
+// Limits on the partition entry array, far above what partitioning tools
+// write (128 entries of 128 bytes), so crafted headers cannot make us
+// allocate huge buffers
+const (
+	maxGPTEntries     = 4096
+	maxGPTEntrySize   = 4096
+	maxGPTEntriesSize = 1 << 20
+)
+
+type gptHeader struct {
+	currentLBA   uint64
+	backupLBA    uint64
+	diskGUID     string
+	entriesLBA   uint64
+	numEntries   uint32
+	entrySize    uint32
+	entriesCRC32 uint32
+}
+
+// readGPT reads the primary GPT header and validates it against the backup header.
+// If the primary header is damaged, the backup header at the end of the disk is used instead.
+func readGPT(r io.ReaderAt, size int64, sectorSize int) (*Table, error) {
+	// The protective MBR and the primary header take the first two sectors
+	if size < 2*int64(sectorSize) {
+		return nil, errNoGPT
+	}
+	lastLBA := uint64(size/int64(sectorSize)) - 1
+
+	primary, primaryErr := readGPTHeader(r, 1, sectorSize)
+	if errors.Is(primaryErr, errNoGPT) {
+		// Without a primary header we only trust a backup header if one is present
+		if _, err := readGPTHeader(r, lastLBA, sectorSize); errors.Is(err, errNoGPT) {
+			return nil, errNoGPT
+		}
+	}
+
+	var entries []byte
+	if primaryErr == nil {
+		entries, primaryErr = readGPTEntries(r, primary, sectorSize)
+	}
+
+	backupLBA := lastLBA
+	if primaryErr == nil && primary.backupLBA != 0 && primary.backupLBA <= lastLBA {
+		backupLBA = primary.backupLBA
+	}
+
+	backup, backupErr := readGPTHeader(r, backupLBA, sectorSize)
+	var backupEntries []byte
+	if backupErr == nil {
+		backupEntries, backupErr = readGPTEntries(r, backup, sectorSize)
+	}
+
+	switch {
+	case primaryErr != nil && backupErr != nil:
+		return nil, fmt.Errorf("GPT primary header is invalid (%v) and backup header is invalid (%v)", primaryErr, backupErr)
+	case primaryErr != nil:
+		logger.Warn("GPT primary header is invalid (%v), using backup header at LBA %d", primaryErr, backupLBA)
+		primary, entries = backup, backupEntries
+	case backupErr != nil:
+		logger.Warn("GPT backup header at LBA %d is invalid: %v", backupLBA, backupErr)
+	default:
+		if backup.diskGUID != primary.diskGUID || backup.currentLBA != primary.backupLBA || !bytes.Equal(backupEntries, entries) {
+			logger.Warn("GPT backup header does not match the primary header, using primary")
+		}
+	}
+
+	table := &Table{
+		Type:       TypeGPT,
+		DiskID:     primary.diskGUID,
+		SectorSize: sectorSize,
+	}
+
+	entrySize := int(primary.entrySize)
+	if len(entries) != int(primary.numEntries)*entrySize {
+		return nil, fmt.Errorf("GPT partition entries are %d bytes, expected %d entries of %d bytes", len(entries), primary.numEntries, entrySize)
+	}
+
+	for i := 0; i < int(primary.numEntries); i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		typeGUID := formatGUID(entry[0:16])
+		if typeGUID == zeroGUID {
+			continue
+		}
+
+		firstLBA := binary.LittleEndian.Uint64(entry[32:40])
+		lastLBA := binary.LittleEndian.Uint64(entry[40:48])
+		if lastLBA < firstLBA {
+			logger.Warn("GPT entry %d has an invalid range %d-%d, skipping", i+1, firstLBA, lastLBA)
+			continue
+		}
+
+		guid := formatGUID(entry[16:32])
+		table.Partitions = append(table.Partitions, Partition{
+			Number:   i + 1,
+			Start:    int64(firstLBA) * int64(sectorSize),
+			Size:     int64(lastLBA-firstLBA+1) * int64(sectorSize),
+			TypeGUID: typeGUID,
+			GUID:     guid,
+			PartUUID: guid,
+			Name:     decodeUTF16Name(entry[56:128]),
+			Flags:    Flags(binary.LittleEndian.Uint64(entry[48:56])),
+		})
+	}
+
+	return table, nil
+}
+
+func readGPTHeader(r io.ReaderAt, lba uint64, sectorSize int) (*gptHeader, error) {
+	buf, err := readAt(r, int64(lba)*int64(sectorSize), sectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(buf[0:8], gptSignature) {
+		return nil, errNoGPT
+	}
+
+	headerSize := binary.LittleEndian.Uint32(buf[12:16])
+	if headerSize < 92 || int(headerSize) > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, buf[:headerSize])
+	expectedCRC := binary.LittleEndian.Uint32(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	if crc := crc32.ChecksumIEEE(header); crc != expectedCRC {
+		return nil, fmt.Errorf("GPT header checksum mismatch (got %08x, want %08x)", crc, expectedCRC)
+	}
+
+	h := &gptHeader{
+		currentLBA:   binary.LittleEndian.Uint64(buf[24:32]),
+		backupLBA:    binary.LittleEndian.Uint64(buf[32:40]),
+		diskGUID:     formatGUID(buf[56:72]),
+		entriesLBA:   binary.LittleEndian.Uint64(buf[72:80]),
+		numEntries:   binary.LittleEndian.Uint32(buf[80:84]),
+		entrySize:    binary.LittleEndian.Uint32(buf[84:88]),
+		entriesCRC32: binary.LittleEndian.Uint32(buf[88:92]),
+	}
+
+	if h.currentLBA != lba {
+		return nil, fmt.Errorf("GPT header at LBA %d claims to be at LBA %d", lba, h.currentLBA)
+	}
+	if h.entrySize < 128 || h.entrySize > maxGPTEntrySize || h.entrySize%8 != 0 {
+		return nil, fmt.Errorf("invalid GPT entry size %d", h.entrySize)
+	}
+	if h.numEntries == 0 || h.numEntries > maxGPTEntries {
+		return nil, fmt.Errorf("invalid GPT entry count %d", h.numEntries)
+	}
+	if int64(h.numEntries)*int64(h.entrySize) > maxGPTEntriesSize {
+		return nil, fmt.Errorf("GPT partition entries too large (%d entries of %d bytes)", h.numEntries, h.entrySize)
+	}
+
+	return h, nil
+}
+
+func readGPTEntries(r io.ReaderAt, h *gptHeader, sectorSize int) ([]byte, error) {
+	size := int64(h.numEntries) * int64(h.entrySize)
+	if size > maxGPTEntriesSize {
+		return nil, fmt.Errorf("GPT partition entries too large (%d bytes)", size)
+	}
+	// An entry LBA beyond what an int64 offset can hold is certainly past the disk
+	if h.entriesLBA > uint64(math.MaxInt64/int64(sectorSize)) {
+		return nil, fmt.Errorf("invalid GPT partition entries LBA %d", h.entriesLBA)
+	}
+	entries, err := readAt(r, int64(h.entriesLBA)*int64(sectorSize), int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	if crc := crc32.ChecksumIEEE(entries); crc != h.entriesCRC32 {
+		return nil, fmt.Errorf("GPT partition entries checksum mismatch (got %08x, want %08x)", crc, h.entriesCRC32)
+	}
+
+	return entries, nil
+}
+
+const zeroGUID = "00000000-0000-0000-0000-000000000000"
+
+// formatGUID formats a GUID stored in the mixed-endian on-disk layout
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16])
+}
+
+func decodeUTF16Name(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u := binary.LittleEndian.Uint16(b[i : i+2])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
@@ -0,0 +1,183 @@
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+const (
+	mbrSectorSize     = 512
+	mbrEntriesOffset  = 446
+	mbrEntrySize      = 16
+	mbrBootIndicator  = 0x80
+	maxLogicalEntries = 128
+)
+
+// isExtendedType reports whether an MBR partition type is an extended partition container
+func isExtendedType(id byte) bool {
+	return id == 0x05 || id == 0x0F || id == 0x85
+}
+
+type mbrEntry struct {
+	bootable bool
+	typeID   byte
+	startLBA uint32
+	sectors  uint32
+}
+
+// readMBRSector reads the first sector and returns it if it carries the MBR boot signature, or nil otherwise
+func readMBRSector(r io.ReaderAt) ([]byte, error) {
+	sector, err := readAt(r, 0, mbrSectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return nil, nil
+	}
+
+	return sector, nil
+}
+
+func parseMBREntries(sector []byte) []mbrEntry {
+	entries := make([]mbrEntry, 4)
+	for i := range entries {
+		e := sector[mbrEntriesOffset+i*mbrEntrySize : mbrEntriesOffset+(i+1)*mbrEntrySize]
+		entries[i] = mbrEntry{
+			bootable: e[0] == mbrBootIndicator,
+			typeID:   e[4],
+			startLBA: binary.LittleEndian.Uint32(e[8:12]),
+			sectors:  binary.LittleEndian.Uint32(e[12:16]),
+		}
+	}
+	return entries
+}
+
+// hasProtectiveEntry reports whether an MBR has a GPT protective entry
+// starting at LBA 1, which the kernel requires of protective and hybrid MBRs
+func hasProtectiveEntry(sector []byte) bool {
+	for _, e := range parseMBREntries(sector) {
+		if e.typeID == mbrTypeGPTProtective && e.startLBA == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// readMBR parses the primary partitions and walks the EBR chain of an extended partition
+func readMBR(r io.ReaderAt, size int64, sector []byte) (*Table, error) {
+	signature := binary.LittleEndian.Uint32(sector[440:444])
+	table := &Table{
+		Type:       TypeMBR,
+		DiskID:     fmt.Sprintf("%08x", signature),
+		SectorSize: mbrSectorSize,
+	}
+
+	var extended *mbrEntry
+	for i, e := range parseMBREntries(sector) {
+		if e.typeID == 0 || e.sectors == 0 {
+			continue
+		}
+		if e.typeID == mbrTypeGPTProtective {
+			return nil, fmt.Errorf("protective MBR found but no valid GPT header")
+		}
+
+		p := newMBRPartition(table, i+1, e, int64(e.startLBA))
+		if isExtendedType(e.typeID) {
+			p.Extended = true
+			if extended == nil {
+				ext := e
+				extended = &ext
+			}
+		}
+		table.Partitions = append(table.Partitions, p)
+	}
+
+	if extended != nil {
+		logical, err := readLogicalPartitions(r, size, table, extended)
+		if err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, logical...)
+	}
+
+	return table, nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records. Each EBR
+// describes one logical partition relative to itself and links to the next EBR
+// relative to the start of the extended partition. As in the kernel, logical
+// partitions are numbered from 5 in the order they are found, EBRs without one
+// don't take a number.
+func readLogicalPartitions(r io.ReaderAt, size int64, table *Table, extended *mbrEntry) ([]Partition, error) {
+	var partitions []Partition
+	extStart := int64(extended.startLBA)
+	ebrLBA := extStart
+	seen := make(map[int64]bool)
+
+	for number := 5; len(partitions) < maxLogicalEntries; {
+		if seen[ebrLBA] {
+			logger.Warn("loop detected in extended partition chain at LBA %d", ebrLBA)
+			break
+		}
+		seen[ebrLBA] = true
+
+		if ebrLBA*mbrSectorSize >= size {
+			logger.Warn("extended boot record at LBA %d is beyond the end of the disk", ebrLBA)
+			break
+		}
+
+		sector, err := readAt(r, ebrLBA*mbrSectorSize, mbrSectorSize)
+		if err != nil {
+			return nil, err
+		}
+		if sector[510] != 0x55 || sector[511] != 0xAA {
+			logger.Warn("invalid extended boot record signature at LBA %d", ebrLBA)
+			break
+		}
+
+		// Data partitions come from the first two entries, the other two often
+		// hold garbage. The chain goes on at the first extended entry.
+		entries := parseMBREntries(sector)
+		var next *mbrEntry
+		for i, e := range entries {
+			if e.sectors == 0 {
+				continue
+			}
+			if isExtendedType(e.typeID) {
+				if next == nil {
+					next = &entries[i]
+				}
+				continue
+			}
+			if i < 2 && len(partitions) < maxLogicalEntries {
+				partitions = append(partitions, newMBRPartition(table, number, e, ebrLBA+int64(e.startLBA)))
+				number++
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		ebrLBA = extStart + int64(next.startLBA)
+	}
+
+	return partitions, nil
+}
+
+func newMBRPartition(table *Table, number int, e mbrEntry, startLBA int64) Partition {
+	p := Partition{
+		Number:   number,
+		Start:    startLBA * mbrSectorSize,
+		Size:     int64(e.sectors) * mbrSectorSize,
+		TypeID:   e.typeID,
+		PartUUID: fmt.Sprintf("%s-%02x", table.DiskID, number),
+	}
+	if e.bootable {
+		p.Flags |= FlagLegacyBootable
+	}
+	return p
+}
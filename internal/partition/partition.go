@@ -0,0 +1,156 @@
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrNoTable is returned when a device carries neither a GPT nor an MBR partition table
+var ErrNoTable = errors.New("no partition table found")
+
+// Table types, named the same way blkid reports PTTYPE
+const (
+	TypeGPT = "gpt"
+	TypeMBR = "dos"
+)
+
+// Flags holds partition attributes. GPT attribute bits are stored as-is;
+// the MBR boot indicator is mapped onto FlagLegacyBootable.
+type Flags uint64
+
+const (
+	FlagRequired       Flags = 1 << 0
+	FlagNoBlockIO      Flags = 1 << 1
+	FlagLegacyBootable Flags = 1 << 2
+	FlagGrowFS         Flags = 1 << 59
+	FlagReadOnly       Flags = 1 << 60
+	FlagHidden         Flags = 1 << 62
+	FlagNoAuto         Flags = 1 << 63
+)
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagRequired, "required"},
+	{FlagNoBlockIO, "no-block-io"},
+	{FlagLegacyBootable, "legacy-boot"},
+	{FlagGrowFS, "grow-fs"},
+	{FlagReadOnly, "read-only"},
+	{FlagHidden, "hidden"},
+	{FlagNoAuto, "no-auto"},
+}
+
+// Has reports whether all bits of f2 are set in f
+func (f Flags) Has(f2 Flags) bool {
+	return f&f2 == f2
+}
+
+func (f Flags) String() string {
+	var names []string
+	for _, n := range flagNames {
+		if f.Has(n.flag) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Partition describes a single entry of a partition table
+type Partition struct {
+	// Number is the partition number as the kernel assigns it
+	// (1-4 for MBR primaries, 5+ for logical partitions)
+	Number int
+	// Start and Size are in bytes
+	Start int64
+	Size  int64
+	// TypeGUID is set for GPT partitions, TypeID for MBR partitions
+	TypeGUID string
+	TypeID   byte
+	// GUID is the GPT unique partition GUID
+	GUID string
+	// PartUUID is the identifier the kernel exposes as PARTUUID
+	PartUUID string
+	Name     string
+	Flags    Flags
+	// Extended marks an MBR extended partition container, which holds
+	// logical partitions but no filesystem of its own
+	Extended bool
+}
+
+// Table is a parsed partition table
+type Table struct {
+	Type       string
+	DiskID     string
+	SectorSize int
+	Partitions []Partition
+}
+
+// Partition returns the partition with the given number, or nil
+func (t *Table) Partition(number int) *Partition {
+	for i := range t.Partitions {
+		if t.Partitions[i].Number == number {
+			return &t.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// ReadDevice reads the partition table of a block device or image file
+func ReadDevice(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// Block devices report a zero size through stat, seeking works for both
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine size of %s: %w", path, err)
+	}
+
+	return Read(f, size)
+}
+
+// Read parses the partition table from r, which holds a disk of the given size in bytes.
+// GPT is tried first and MBR is used when no GPT header is present.
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	mbr, err := readMBRSector(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the kernel, only trust a GPT header if the MBR refers to it with a
+	// protective or hybrid 0xEE entry, so a stale backup GPT of a disk that
+	// was re-partitioned as MBR is ignored. Disks without an MBR at all are
+	// still read as GPT.
+	if mbr == nil || hasProtectiveEntry(mbr) {
+		for _, sectorSize := range []int{512, 4096} {
+			table, err := readGPT(r, size, sectorSize)
+			if err == nil {
+				return table, nil
+			}
+			if !errors.Is(err, errNoGPT) {
+				return nil, err
+			}
+		}
+	}
+
+	if mbr == nil {
+		return nil, ErrNoTable
+	}
+
+	return readMBR(r, size, mbr)
+}
+
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes at offset %d: %w", n, off, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,301 @@
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+const (
+	testSectors  = 2048
+	linuxGUID    = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	espGUID      = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	testDiskGUID = "01234567-89ab-cdef-0123-456789abcdef"
+)
+
+// image is a synthetic disk of 512 byte sectors
+type image []byte
+
+func newImage() image {
+	return make(image, testSectors*512)
+}
+
+func (img image) sector(lba int64) []byte {
+	return img[lba*512 : (lba+1)*512]
+}
+
+// setMBREntry writes entry i of the MBR or EBR at lba and its boot signature
+func (img image) setMBREntry(lba int64, i int, typeID byte, start, sectors uint32) {
+	s := img.sector(lba)
+	e := s[mbrEntriesOffset+i*mbrEntrySize:]
+	e[4] = typeID
+	binary.LittleEndian.PutUint32(e[8:12], start)
+	binary.LittleEndian.PutUint32(e[12:16], sectors)
+	s[510], s[511] = 0x55, 0xAA
+}
+
+// encodeGUID is the inverse of formatGUID
+func encodeGUID(t *testing.T, guid string) []byte {
+	t.Helper()
+	raw, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil || len(raw) != 16 {
+		t.Fatalf("invalid GUID %s", guid)
+	}
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(b[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(b[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(b[8:], raw[8:])
+	return b
+}
+
+type gptPart struct {
+	typeGUID   string
+	first, end uint64
+	name       string
+}
+
+// writeGPT writes a GPT header at headerLBA with its entry array at
+// entriesLBA, describing parts
+func (img image) writeGPT(t *testing.T, headerLBA, backupLBA, entriesLBA uint64, parts []gptPart) {
+	t.Helper()
+	const numEntries, entrySize = 128, 128
+	entries := make([]byte, numEntries*entrySize)
+	for i, p := range parts {
+		e := entries[i*entrySize:]
+		copy(e[0:16], encodeGUID(t, p.typeGUID))
+		guid := encodeGUID(t, testDiskGUID)
+		guid[15] = byte(i + 1)
+		copy(e[16:32], guid)
+		binary.LittleEndian.PutUint64(e[32:40], p.first)
+		binary.LittleEndian.PutUint64(e[40:48], p.end)
+		for j, c := range p.name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], uint16(c))
+		}
+	}
+	copy(img[entriesLBA*512:], entries)
+
+	h := img.sector(int64(headerLBA))
+	copy(h[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(h[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(h[12:16], 92)
+	binary.LittleEndian.PutUint64(h[24:32], headerLBA)
+	binary.LittleEndian.PutUint64(h[32:40], backupLBA)
+	copy(h[56:72], encodeGUID(t, testDiskGUID))
+	binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:84], numEntries)
+	binary.LittleEndian.PutUint32(h[84:88], entrySize)
+	binary.LittleEndian.PutUint32(h[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(h[16:20], 0)
+	binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:92]))
+}
+
+var testGPTParts = []gptPart{
+	{typeGUID: espGUID, first: 64, end: 127, name: "EFI"},
+	{typeGUID: linuxGUID, first: 128, end: 1983, name: "root"},
+}
+
+// gptImage returns a disk with a protective MBR and primary and backup GPTs
+func gptImage(t *testing.T) image {
+	img := newImage()
+	img.setMBREntry(0, 0, mbrTypeGPTProtective, 1, testSectors-1)
+	img.writeGPT(t, 1, testSectors-1, 2, testGPTParts)
+	img.writeGPT(t, testSectors-1, 1, testSectors-33, testGPTParts)
+	return img
+}
+
+func read(t *testing.T, img image) (*Table, error) {
+	t.Helper()
+	return Read(bytes.NewReader(img), int64(len(img)))
+}
+
+type wantPart struct {
+	number      int
+	start, size int64
+}
+
+func checkPartitions(t *testing.T, table *Table, want []wantPart) {
+	t.Helper()
+	if len(table.Partitions) != len(want) {
+		t.Fatalf("got %d partitions %+v, want %d", len(table.Partitions), table.Partitions, len(want))
+	}
+	for i, w := range want {
+		p := table.Partitions[i]
+		if p.Number != w.number || p.Start != w.start || p.Size != w.size {
+			t.Errorf("partition %d = number %d, start %d, size %d, want number %d, start %d, size %d",
+				i, p.Number, p.Start, p.Size, w.number, w.start, w.size)
+		}
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	table, err := read(t, gptImage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeGPT || table.DiskID != testDiskGUID {
+		t.Fatalf("got type %s, disk ID %s", table.Type, table.DiskID)
+	}
+	checkPartitions(t, table, []wantPart{{1, 64 * 512, 64 * 512}, {2, 128 * 512, 1856 * 512}})
+	if p := table.Partition(2); p.TypeGUID != linuxGUID || p.Name != "root" {
+		t.Errorf("partition 2 has type %s and name %q", p.TypeGUID, p.Name)
+	}
+}
+
+func TestReadGPTBackup(t *testing.T) {
+	img := gptImage(t)
+	// Break the primary header's checksum
+	img.sector(1)[16] ^= 0xff
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeGPT {
+		t.Fatalf("got type %s", table.Type)
+	}
+	checkPartitions(t, table, []wantPart{{1, 64 * 512, 64 * 512}, {2, 128 * 512, 1856 * 512}})
+}
+
+func TestReadGPTWithoutMBR(t *testing.T) {
+	img := gptImage(t)
+	img.sector(0)[510] = 0
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeGPT {
+		t.Fatalf("got type %s", table.Type)
+	}
+}
+
+func TestReadHybridMBR(t *testing.T) {
+	img := gptImage(t)
+	img.setMBREntry(0, 1, 0x83, 128, 1856)
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeGPT {
+		t.Fatalf("got type %s", table.Type)
+	}
+}
+
+func TestReadStaleBackupGPT(t *testing.T) {
+	// Re-partitioned as MBR, the backup GPT at the end of the disk remains
+	img := gptImage(t)
+	copy(img.sector(0), make([]byte, 512))
+	copy(img.sector(1), make([]byte, 512))
+	img.setMBREntry(0, 0, 0x83, 2048/4, 1024)
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeMBR {
+		t.Fatalf("got type %s, want the MBR", table.Type)
+	}
+	checkPartitions(t, table, []wantPart{{1, 512 * 512, 1024 * 512}})
+}
+
+func TestReadProtectiveMBRWithoutGPT(t *testing.T) {
+	img := newImage()
+	img.setMBREntry(0, 0, mbrTypeGPTProtective, 1, testSectors-1)
+
+	if _, err := read(t, img); err == nil {
+		t.Fatal("expected an error for a protective MBR without GPT")
+	}
+}
+
+func TestReadGPTEntrySizeLimit(t *testing.T) {
+	img := gptImage(t)
+	for _, lba := range []int64{1, testSectors - 1} {
+		h := img.sector(lba)
+		binary.LittleEndian.PutUint32(h[84:88], 1<<20)
+		binary.LittleEndian.PutUint32(h[16:20], 0)
+		binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:92]))
+	}
+
+	if _, err := read(t, img); err == nil {
+		t.Fatal("expected an error for oversized GPT entries")
+	}
+}
+
+func TestReadTinyImage(t *testing.T) {
+	// Too small for a GPT, which must not be read past the end
+	img := make(image, 512)
+	img[510], img[511] = 0x55, 0xAA
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeMBR || len(table.Partitions) != 0 {
+		t.Fatalf("got %+v", table)
+	}
+
+	img[510] = 0
+	if _, err := read(t, img); !errors.Is(err, ErrNoTable) {
+		t.Fatalf("got %v, want ErrNoTable", err)
+	}
+}
+
+func TestReadNoTable(t *testing.T) {
+	if _, err := read(t, newImage()); !errors.Is(err, ErrNoTable) {
+		t.Fatalf("got %v, want ErrNoTable", err)
+	}
+}
+
+func TestReadMBRLogical(t *testing.T) {
+	img := newImage()
+	img.setMBREntry(0, 0, 0x83, 64, 100)
+	img.setMBREntry(0, 1, 0x05, 200, 1800)
+	img.sector(0)[mbrEntriesOffset] = mbrBootIndicator
+
+	// First EBR: a logical partition and a link to the second
+	img.setMBREntry(200, 0, 0x83, 10, 90)
+	img.setMBREntry(200, 1, 0x05, 100, 300)
+	// Second EBR: no partition of its own, only a link to the third
+	img.setMBREntry(300, 1, 0x05, 400, 300)
+	// Third EBR: the last logical partition
+	img.setMBREntry(600, 0, 0x82, 10, 200)
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Type != TypeMBR {
+		t.Fatalf("got type %s", table.Type)
+	}
+	checkPartitions(t, table, []wantPart{
+		{1, 64 * 512, 100 * 512},
+		{2, 200 * 512, 1800 * 512},
+		{5, 210 * 512, 90 * 512},
+		{6, 610 * 512, 200 * 512},
+	})
+	if !table.Partitions[0].Flags.Has(FlagLegacyBootable) {
+		t.Error("partition 1 is not marked bootable")
+	}
+	if !table.Partitions[1].Extended {
+		t.Error("partition 2 is not marked extended")
+	}
+}
+
+func TestReadMBRLogicalLoop(t *testing.T) {
+	img := newImage()
+	img.setMBREntry(0, 0, 0x05, 200, 1800)
+	img.setMBREntry(200, 0, 0x83, 10, 90)
+	img.setMBREntry(200, 1, 0x05, 0, 300)
+
+	table, err := read(t, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPartitions(t, table, []wantPart{{1, 200 * 512, 1800 * 512}, {5, 210 * 512, 90 * 512}})
+}
@@ -0,0 +1,119 @@
+package partition
+
+import "runtime"
+
+// GPT partition type GUIDs from the Discoverable Partitions Specification
+// (https://uapi-group.org/specifications/specs/discoverable_partitions_specification/)
+const (
+	TypeESP          = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	TypeXBOOTLDR     = "bc13c2ff-59e6-4262-a352-b275fd6f7172"
+	TypeSwap         = "0657fd6d-a4ab-43c4-84e5-0933c84b4f4f"
+	TypeHome         = "933ac7e1-2eb4-4f13-b844-0e14e2aef915"
+	TypeSrv          = "3b8f8425-20e0-4f3b-907f-1a25a76f98e8"
+	TypeVar          = "4d21b016-b534-45c2-a9fb-5c16e091fd2d"
+	TypeTmp          = "7ec6f557-3bc5-4aca-b293-16ef5df639d1"
+	TypeLinuxGeneric = "0fc63daf-8483-4772-8e79-3d69d8477de4"
+	TypeLinuxLVM     = "e6d6d379-f507-44c2-a23c-238f2a3df928"
+
+	TypeRootX86     = "44479540-f297-41b2-9af7-d131d5f0458a"
+	TypeRootX86_64  = "4f68bce3-e8cd-4db1-96e7-fbcaf984b709"
+	TypeRootARM     = "69dad710-2ce4-4e3c-b16c-21a1d49abed3"
+	TypeRootARM64   = "b921b045-1df0-41c3-af44-4c6f280d3fae"
+	TypeRootRISCV64 = "72ec70a6-cf74-40e6-bd49-4bda08e8f224"
+
+	TypeUsrX86     = "75250d76-8cc6-458e-bd66-bd47cc81a812"
+	TypeUsrX86_64  = "8484680c-9521-48c6-9c11-b0720656f69e"
+	TypeUsrARM     = "7d0359a3-02b3-4f0a-865c-654403e70625"
+	TypeUsrARM64   = "b0e01050-ee5f-4390-949a-9101b17104e9"
+	TypeUsrRISCV64 = "beaec34b-8442-439b-a40b-984381ed097d"
+)
+
+// MBR partition type IDs
+const (
+	TypeIDLinux    byte = 0x83
+	TypeIDSwap     byte = 0x82
+	TypeIDLinuxLVM byte = 0x8e
+	TypeIDESP      byte = 0xef
+)
+
+// rootTypes maps root partition type GUIDs to the GOARCH they are meant for
+var rootTypes = map[string]string{
+	TypeRootX86:     "386",
+	TypeRootX86_64:  "amd64",
+	TypeRootARM:     "arm",
+	TypeRootARM64:   "arm64",
+	TypeRootRISCV64: "riscv64",
+}
+
+var usrTypes = map[string]string{
+	TypeUsrX86:     "386",
+	TypeUsrX86_64:  "amd64",
+	TypeUsrARM:     "arm",
+	TypeUsrARM64:   "arm64",
+	TypeUsrRISCV64: "riscv64",
+}
+
+var typeNames = map[string]string{
+	TypeESP:          "esp",
+	TypeXBOOTLDR:     "xbootldr",
+	TypeSwap:         "swap",
+	TypeHome:         "home",
+	TypeSrv:          "srv",
+	TypeVar:          "var",
+	TypeTmp:          "tmp",
+	TypeLinuxGeneric: "linux-generic",
+	TypeLinuxLVM:     "linux-lvm",
+	TypeRootX86:      "root-x86",
+	TypeRootX86_64:   "root-x86-64",
+	TypeRootARM:      "root-arm",
+	TypeRootARM64:    "root-arm64",
+	TypeRootRISCV64:  "root-riscv64",
+	TypeUsrX86:       "usr-x86",
+	TypeUsrX86_64:    "usr-x86-64",
+	TypeUsrARM:       "usr-arm",
+	TypeUsrARM64:     "usr-arm64",
+	TypeUsrRISCV64:   "usr-riscv64",
+}
+
+// TypeName returns the short name of a well-known GPT partition type, or the GUID itself
+func TypeName(typeGUID string) string {
+	if name, ok := typeNames[typeGUID]; ok {
+		return name
+	}
+	return typeGUID
+}
+
+// IsRootType reports whether typeGUID is a root partition type for any architecture
+func IsRootType(typeGUID string) bool {
+	_, ok := rootTypes[typeGUID]
+	return ok
+}
+
+// IsNativeRootType reports whether typeGUID is the root partition type for the host architecture
+func IsNativeRootType(typeGUID string) bool {
+	return rootTypes[typeGUID] == runtime.GOARCH
+}
+
+// IsUsrType reports whether typeGUID is a /usr partition type for any architecture
+func IsUsrType(typeGUID string) bool {
+	_, ok := usrTypes[typeGUID]
+	return ok
+}
+
+// IsNonRootType reports whether a partition type is known to hold something other than
+// the root filesystem (ESP, swap, /home, /usr, ...)
+func IsNonRootType(typeGUID string, typeID byte) bool {
+	switch typeGUID {
+	case TypeESP, TypeXBOOTLDR, TypeSwap, TypeHome, TypeSrv, TypeVar, TypeTmp:
+		return true
+	}
+	if IsUsrType(typeGUID) {
+		return true
+	}
+
+	switch typeID {
+	case TypeIDSwap, TypeIDESP:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Process is a running process found in /proc
+type Process struct {
+	PID     int
+	Command string
+	// Reason says how the process uses a directory, for processes found by FindUsing
+	Reason string
+}
+
+// FindByRoot returns the processes whose root directory is dir or below it,
+// that is the processes chrooted into a mount
+func FindByRoot(dir string) []Process {
+	dir = filepath.Clean(dir)
+
+	var found []Process
+	for _, pid := range pids() {
+		root, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "root"))
+		if err != nil {
+			continue
+		}
+		if within(root, dir) {
+			found = append(found, Process{PID: pid, Command: command(pid)})
+		}
+	}
+	return found
+}
+
+// links are the per-process links FindUsing checks besides open files
+var links = []struct{ name, reason string }{
+	{"root", "root directory"},
+	{"cwd", "working directory"},
+	{"exe", "executable"},
+}
+
+// FindUsing returns the processes that keep dir busy: those whose root,
+// working directory or executable is at or below dir, or that have a file
+// open there. The calling process is never included.
+func FindUsing(dir string) []Process {
+	dir = filepath.Clean(dir)
+	self := os.Getpid()
+
+	var found []Process
+	for _, pid := range pids() {
+		if pid == self {
+			continue
+		}
+		if reason := usage(pid, dir); reason != "" {
+			found = append(found, Process{PID: pid, Command: command(pid), Reason: reason})
+		}
+	}
+	return found
+}
+
+// usage describes how a process uses dir, or returns "" if it doesn't
+func usage(pid int, dir string) string {
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	for _, l := range links {
+		if target, err := os.Readlink(filepath.Join(procDir, l.name)); err == nil && within(strings.TrimSuffix(target, " (deleted)"), dir) {
+			return l.reason
+		}
+	}
+
+	fds, err := os.ReadDir(filepath.Join(procDir, "fd"))
+	if err != nil {
+		return ""
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(procDir, "fd", fd.Name()))
+		if err == nil && within(strings.TrimSuffix(target, " (deleted)"), dir) {
+			return "open file " + target
+		}
+	}
+	return ""
+}
+
+// within reports whether path is dir or below it
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Alive reports whether a process with the given PID exists
+func Alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid)))
+	return err == nil
+}
+
+// StartTime returns when a process started, in clock ticks since boot, which
+// tells a process apart from a later one that reuses its PID
+func StartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name is in parentheses and may contain spaces, the start
+	// time is the 22nd field and the 20th after the name
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// pids lists the PIDs in /proc
+func pids() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var pids []int
+	for _, e := range entries {
+		if pid, err := strconv.Atoi(e.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// command returns the command line of a process with arguments separated by spaces
+func command(pid int) string {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		comm, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+		return "[" + strings.TrimSpace(string(comm)) + "]"
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+}
@@ -0,0 +1,96 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+}
+
+// ParseSignal parses a signal given by name, with or without the SIG
+// prefix, or by number
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number: %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", s)
+}
+
+// Signal sends sig to every process in procs and returns the processes that
+// could not be signalled. Processes that exited in the meantime are ignored.
+func Signal(procs []Process, sig syscall.Signal) map[int]error {
+	failed := make(map[int]error)
+	for _, p := range procs {
+		if err := syscall.Kill(p.PID, sig); err != nil && err != syscall.ESRCH {
+			failed[p.PID] = err
+		}
+	}
+	return failed
+}
+
+// Terminate sends SIGTERM to procs and SIGKILL to those still running after
+// timeout. It returns the processes that are still alive at the end.
+func Terminate(procs []Process, timeout time.Duration) []Process {
+	Signal(procs, syscall.SIGTERM)
+	if remaining := waitExit(procs, timeout); len(remaining) > 0 {
+		Signal(remaining, syscall.SIGKILL)
+		return waitExit(remaining, time.Second)
+	}
+	return nil
+}
+
+// waitExit waits up to timeout for procs to exit and returns those that didn't
+func waitExit(procs []Process, timeout time.Duration) []Process {
+	deadline := time.Now().Add(timeout)
+	for {
+		var alive []Process
+		for _, p := range procs {
+			// Zombies hold no files, waiting for their parent to reap them is pointless
+			if Alive(p.PID) && !zombie(p.PID) {
+				alive = append(alive, p)
+			}
+		}
+		if len(alive) == 0 || time.Now().After(deadline) {
+			return alive
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// zombie reports whether a process has exited but was not reaped yet
+func zombie(pid int) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses and may contain spaces
+	if i := bytes.LastIndexByte(data, ')'); i >= 0 && i+2 < len(data) {
+		return data[i+2] == 'Z'
+	}
+	return false
+}
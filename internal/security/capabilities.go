@@ -0,0 +1,154 @@
+package security
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capabilityNames are the Linux capabilities without the CAP_ prefix, by number
+var capabilityNames = []string{
+	"CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "KILL",
+	"SETGID", "SETUID", "SETPCAP", "LINUX_IMMUTABLE", "NET_BIND_SERVICE",
+	"NET_BROADCAST", "NET_ADMIN", "NET_RAW", "IPC_LOCK", "IPC_OWNER",
+	"SYS_MODULE", "SYS_RAWIO", "SYS_CHROOT", "SYS_PTRACE", "SYS_PACCT",
+	"SYS_ADMIN", "SYS_BOOT", "SYS_NICE", "SYS_RESOURCE", "SYS_TIME",
+	"SYS_TTY_CONFIG", "MKNOD", "LEASE", "AUDIT_WRITE", "AUDIT_CONTROL",
+	"SETFCAP", "MAC_OVERRIDE", "MAC_ADMIN", "SYSLOG", "WAKE_ALARM",
+	"BLOCK_SUSPEND", "AUDIT_READ", "PERFMON", "BPF", "CHECKPOINT_RESTORE",
+}
+
+// DefaultCapabilities are the capabilities commands keep in hardened mode:
+// Docker's defaults without SYS_CHROOT, since calling chroot again is the
+// classic way out of a chroot
+var DefaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW", "SETGID",
+	"SETUID", "SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "KILL", "AUDIT_WRITE",
+}
+
+// Capabilities is a set of capabilities, bit n standing for capability n
+type Capabilities uint64
+
+// allCapabilities has every capability known to qimi
+var allCapabilities = Capabilities(1)<<len(capabilityNames) - 1
+
+// Has reports whether the set has the named capability
+func (c Capabilities) Has(name string) bool {
+	n, err := parseCapability(name)
+	return err == nil && c&(1<<n) != 0
+}
+
+// String lists the capabilities of the set
+func (c Capabilities) String() string {
+	var names []string
+	for n, name := range capabilityNames {
+		if c&(1<<n) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseCapability returns the number of a capability given with or without the CAP_ prefix
+func parseCapability(name string) (int, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	for n, known := range capabilityNames {
+		if known == name {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown capability %s", name)
+}
+
+// parseCapabilities returns the set of the named capabilities, ALL stands for every one
+func parseCapabilities(names []string) (Capabilities, error) {
+	var set Capabilities
+	for _, name := range names {
+		if strings.EqualFold(name, "ALL") {
+			set |= allCapabilities
+			continue
+		}
+		n, err := parseCapability(name)
+		if err != nil {
+			return 0, err
+		}
+		set |= 1 << n
+	}
+	return set, nil
+}
+
+// Constants of capset(2) and prctl(2)
+const (
+	linuxCapabilityVersion3 = 0x20080522
+	prCapbsetDrop           = 24
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// lastCapability returns the highest capability the kernel knows
+func lastCapability() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	return n
+}
+
+// dropCapabilities reduces the capabilities of the calling thread, and of
+// what it executes as root, to keep
+func dropCapabilities(keep Capabilities) error {
+	// Root gets every capability of the bounding set on exec, so that is what limits the command
+	for n := 0; n <= lastCapability(); n++ {
+		if n < 64 && keep&(1<<n) != 0 {
+			continue
+		}
+		if err := prctl(prCapbsetDrop, uintptr(n), 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", n, err)
+		}
+	}
+
+	if err := prctl(prCapAmbient, prCapAmbientClearAll, 0); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+
+	// Capabilities the thread does not have cannot be kept
+	header := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to get capabilities: %w", errno)
+	}
+	for i := range data {
+		bits := uint32(keep>>(32*i)) & data[i].permitted
+		data[i] = capData{effective: bits, permitted: bits, inheritable: bits}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", errno)
+	}
+	return nil
+}
+
+func prctl(option int, arg2, arg3 uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, uintptr(option), arg2, arg3, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
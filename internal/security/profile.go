@@ -0,0 +1,51 @@
+package security
+
+import "syscall"
+
+// Namespace flags of clone(2) that commands may only use with SYS_ADMIN
+const cloneNamespaceFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC |
+	syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWCGROUP
+
+// DefaultProfile returns the seccomp profile of hardened mode. Like Docker's
+// default, it blocks what only makes sense with capabilities a command in
+// an image does not get, unless they are added back: kernel modules and
+// kexec, mounts and namespaces, tracing other processes, keyrings, clocks,
+// swap and reboot. Unlike Docker's, everything else is allowed rather than
+// listed, so new system calls keep working with new guests.
+func DefaultProfile() *Profile {
+	enosys := uint(syscall.ENOSYS)
+	deny := func(caps []string, names ...string) Syscall {
+		return Syscall{Names: names, Action: "SCMP_ACT_ERRNO", Excludes: Filter{Caps: caps}}
+	}
+
+	return &Profile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []Syscall{
+			// Nobody needs these in an image
+			{Names: []string{"create_module", "get_kernel_syms", "query_module", "nfsservctl", "uselib", "ustat", "sysfs", "_sysctl", "vm86", "vm86old", "lookup_dcookie"}, Action: "SCMP_ACT_ERRNO"},
+			deny([]string{"SYS_MODULE"}, "init_module", "finit_module", "delete_module"),
+			deny([]string{"SYS_BOOT"}, "reboot", "kexec_load", "kexec_file_load"),
+			deny([]string{"SYS_TIME"}, "settimeofday", "clock_settime", "clock_adjtime", "stime"),
+			deny([]string{"SYS_PTRACE"}, "ptrace", "process_vm_readv", "process_vm_writev", "kcmp"),
+			deny([]string{"SYS_PACCT"}, "acct"),
+			deny([]string{"SYS_RAWIO"}, "iopl", "ioperm"),
+			deny([]string{"SYS_CHROOT"}, "chroot"),
+			deny([]string{"SYSLOG"}, "syslog"),
+			deny([]string{"DAC_READ_SEARCH"}, "open_by_handle_at", "name_to_handle_at"),
+			deny([]string{"SYS_ADMIN"}, "mount", "umount", "umount2", "pivot_root", "swapon", "swapoff",
+				"fsopen", "fsconfig", "fsmount", "fspick", "open_tree", "move_mount", "mount_setattr",
+				"setns", "unshare", "quotactl", "quotactl_fd", "bpf", "perf_event_open", "userfaultfd",
+				"add_key", "request_key", "keyctl", "io_uring_setup", "io_uring_enter", "io_uring_register"),
+			// A user namespace would give back every capability, and with it a way out of the chroot
+			{
+				Names:    []string{"clone"},
+				Action:   "SCMP_ACT_ALLOW",
+				Args:     []Arg{{Index: 0, Value: cloneNamespaceFlags, ValueTwo: 0, Op: "SCMP_CMP_MASKED_EQ"}},
+				Excludes: Filter{Caps: []string{"SYS_ADMIN"}},
+			},
+			deny([]string{"SYS_ADMIN"}, "clone"),
+			// The flags of clone3 are out of reach of seccomp, C libraries fall back to clone
+			{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &enosys, Excludes: Filter{Caps: []string{"SYS_ADMIN"}}},
+		},
+	}
+}
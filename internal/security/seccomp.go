@@ -0,0 +1,359 @@
+package security
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// Profile is a seccomp profile in the OCI runtime spec format, with the
+// includes and excludes of Docker's profiles
+type Profile struct {
+	DefaultAction   string    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string  `json:"architectures,omitempty"`
+	Syscalls        []Syscall `json:"syscalls,omitempty"`
+}
+
+// Syscall is a rule of a seccomp profile: the action for the named system
+// calls when all argument conditions hold
+type Syscall struct {
+	Names    []string `json:"names"`
+	Action   string   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+// Arg is a condition on a system call argument
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// Filter limits a rule to commands with the given capabilities or architectures
+type Filter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// LoadProfile reads a seccomp profile from a JSON file
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	if p.DefaultAction == "" {
+		return nil, fmt.Errorf("invalid seccomp profile %s: no defaultAction", path)
+	}
+	return &p, nil
+}
+
+// Values of the classic BPF instructions and seccomp return values
+const (
+	bpfLdAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfAnd    = 0x54 // BPF_ALU | BPF_AND | BPF_K
+	bpfJeq    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgt    = 0x25 // BPF_JMP | BPF_JGT | BPF_K
+	bpfJge    = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRet    = 0x06 // BPF_RET | BPF_K
+	bpfMaxLen = 4096
+
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+
+	auditArchX86_64  = 0xc000003e
+	auditArchAARCH64 = 0xc00000b7
+
+	// x32SyscallBit marks the system calls of the x32 ABI on x86_64
+	x32SyscallBit = 0x40000000
+
+	// Offsets in struct seccomp_data
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+)
+
+// scmpArches maps the architecture names of profiles to AUDIT_ARCH values,
+// Docker's profiles use the Go names in includes and excludes
+var scmpArches = map[string]uint32{
+	"SCMP_ARCH_X86_64":  auditArchX86_64,
+	"SCMP_ARCH_AARCH64": auditArchAARCH64,
+	"amd64":             auditArchX86_64,
+	"arm64":             auditArchAARCH64,
+}
+
+// instruction is a classic BPF instruction whose jumps go to labels
+type instruction struct {
+	code   uint16
+	jt, jf string
+	k      uint32
+}
+
+// program assembles BPF instructions with symbolic jump targets
+type program struct {
+	code   []instruction
+	labels map[string]int
+}
+
+func (p *program) emit(code uint16, k uint32, jt, jf string) {
+	p.code = append(p.code, instruction{code: code, jt: jt, jf: jf, k: k})
+}
+
+func (p *program) label(name string) {
+	p.labels[name] = len(p.code)
+}
+
+// assemble resolves the labels and returns the program as struct sock_filter array
+func (p *program) assemble() ([]byte, error) {
+	if len(p.code) > bpfMaxLen {
+		return nil, fmt.Errorf("seccomp filter too large: %d instructions", len(p.code))
+	}
+
+	offset := func(i int, label string) (uint8, error) {
+		if label == "" {
+			return 0, nil
+		}
+		target, ok := p.labels[label]
+		if !ok {
+			return 0, fmt.Errorf("undefined label %s", label)
+		}
+		jump := target - i - 1
+		if jump < 0 || jump > 255 {
+			return 0, fmt.Errorf("seccomp filter jump to %s out of range", label)
+		}
+		return uint8(jump), nil
+	}
+
+	out := make([]byte, 0, 8*len(p.code))
+	for i, ins := range p.code {
+		jt, err := offset(i, ins.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(i, ins.jf)
+		if err != nil {
+			return nil, err
+		}
+		out = binary.NativeEndian.AppendUint16(out, ins.code)
+		out = append(out, jt, jf)
+		out = binary.NativeEndian.AppendUint32(out, ins.k)
+	}
+	return out, nil
+}
+
+// Compile turns the profile into a seccomp BPF program for a command with the
+// given capabilities. Rules are checked in order and the first match wins.
+// System calls this architecture does not have are skipped.
+func (p *Profile) Compile(caps Capabilities) ([]byte, error) {
+	if nativeArch == 0 {
+		return nil, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+	}
+	if len(p.Architectures) > 0 && !slices.ContainsFunc(p.Architectures, func(a string) bool { return scmpArches[a] == nativeArch }) {
+		return nil, fmt.Errorf("seccomp profile does not cover %s", runtime.GOARCH)
+	}
+
+	defaultRet, err := actionValue(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	prog := &program{labels: make(map[string]int)}
+
+	// System calls of other architectures, like i386 ones on x86_64, have
+	// other numbers and would get around the rules
+	prog.emit(bpfLdAbs, offsetArch, "", "")
+	prog.emit(bpfJeq, nativeArch, "native", "")
+	prog.emit(bpfRet, retKillProcess, "", "")
+	prog.label("native")
+	prog.emit(bpfLdAbs, offsetNr, "", "")
+	if nativeArch == auditArchX86_64 {
+		prog.emit(bpfJge, x32SyscallBit, "", "rules")
+		prog.emit(bpfRet, retErrno|uint32(syscall.ENOSYS), "", "")
+	}
+	prog.label("rules")
+
+	// The accumulator holds the system call number unless argument checks replaced it
+	loaded := true
+	blocks := 0
+	for _, rule := range p.Syscalls {
+		if !rule.applies(caps) {
+			continue
+		}
+		ret, err := actionValue(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("rule for %v: %w", rule.Names, err)
+		}
+		for _, name := range rule.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				logger.Debug("seccomp: skipping unknown system call %s", name)
+				continue
+			}
+			blocks++
+			next := fmt.Sprintf("next-%d", blocks)
+			if !loaded {
+				prog.emit(bpfLdAbs, offsetNr, "", "")
+			}
+			prog.emit(bpfJeq, nr, "", next)
+			for a, arg := range rule.Args {
+				if err := compileArg(prog, arg, next, fmt.Sprintf("pass-%d-%d", blocks, a)); err != nil {
+					return nil, fmt.Errorf("rule for %s: %w", name, err)
+				}
+			}
+			prog.emit(bpfRet, ret, "", "")
+			prog.label(next)
+			loaded = len(rule.Args) == 0
+		}
+	}
+	prog.emit(bpfRet, defaultRet, "", "")
+
+	return prog.assemble()
+}
+
+// applies reports whether a rule is meant for this architecture and a
+// command with the given capabilities
+func (s Syscall) applies(caps Capabilities) bool {
+	for _, c := range s.Includes.Caps {
+		if !caps.Has(c) {
+			return false
+		}
+	}
+	for _, c := range s.Excludes.Caps {
+		if caps.Has(c) {
+			return false
+		}
+	}
+	native := func(a string) bool { return scmpArches[a] == nativeArch }
+	if len(s.Includes.Arches) > 0 && !slices.ContainsFunc(s.Includes.Arches, native) {
+		return false
+	}
+	return !slices.ContainsFunc(s.Excludes.Arches, native)
+}
+
+// compileArg emits the check of a 64-bit argument, which BPF compares in
+// two 32-bit halves. Failing checks jump to fail.
+func compileArg(prog *program, arg Arg, fail string, pass string) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("invalid argument index %d", arg.Index)
+	}
+	// amd64 and arm64 are little-endian, the low half comes first
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	value := arg.Value
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		prog.emit(bpfLdAbs, hi, "", "")
+		prog.emit(bpfJeq, uint32(value>>32), "", fail)
+		prog.emit(bpfLdAbs, lo, "", "")
+		prog.emit(bpfJeq, uint32(value), "", fail)
+	case "SCMP_CMP_NE":
+		prog.emit(bpfLdAbs, hi, "", "")
+		prog.emit(bpfJeq, uint32(value>>32), "", pass)
+		prog.emit(bpfLdAbs, lo, "", "")
+		prog.emit(bpfJeq, uint32(value), fail, "")
+	case "SCMP_CMP_MASKED_EQ":
+		mask, want := arg.Value, arg.ValueTwo
+		prog.emit(bpfLdAbs, hi, "", "")
+		prog.emit(bpfAnd, uint32(mask>>32), "", "")
+		prog.emit(bpfJeq, uint32(want>>32), "", fail)
+		prog.emit(bpfLdAbs, lo, "", "")
+		prog.emit(bpfAnd, uint32(mask), "", "")
+		prog.emit(bpfJeq, uint32(want), "", fail)
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		// Greater in the high half passes, equal compares the low half
+		prog.emit(bpfLdAbs, hi, "", "")
+		prog.emit(bpfJgt, uint32(value>>32), pass, "")
+		prog.emit(bpfJeq, uint32(value>>32), "", fail)
+		prog.emit(bpfLdAbs, lo, "", "")
+		if arg.Op == "SCMP_CMP_GT" {
+			prog.emit(bpfJgt, uint32(value), "", fail)
+		} else {
+			prog.emit(bpfJge, uint32(value), "", fail)
+		}
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		prog.emit(bpfLdAbs, hi, "", "")
+		prog.emit(bpfJgt, uint32(value>>32), fail, "")
+		prog.emit(bpfJeq, uint32(value>>32), "", pass)
+		prog.emit(bpfLdAbs, lo, "", "")
+		if arg.Op == "SCMP_CMP_LT" {
+			prog.emit(bpfJge, uint32(value), fail, "")
+		} else {
+			prog.emit(bpfJgt, uint32(value), fail, "")
+		}
+	default:
+		return fmt.Errorf("unsupported comparison %s", arg.Op)
+	}
+	prog.label(pass)
+	return nil
+}
+
+// actionValue returns the seccomp return value of a profile action
+func actionValue(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet) & 0xffff
+	}
+
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return retAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return retErrno | errno, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return retKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return retKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return retTrap, nil
+	case "SCMP_ACT_TRACE":
+		return retTrace | errno, nil
+	case "SCMP_ACT_LOG":
+		return retLog, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action %s", action)
+	}
+}
+
+type sockFprog struct {
+	len    uint16
+	filter unsafe.Pointer
+}
+
+// installFilter applies a program from Compile to the calling thread
+func installFilter(filter []byte) error {
+	if len(filter) == 0 || len(filter)%8 != 0 {
+		return errors.New("invalid seccomp filter")
+	}
+	prog := sockFprog{len: uint16(len(filter) / 8), filter: unsafe.Pointer(&filter[0])}
+	err := prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if err != nil {
+		return fmt.Errorf("failed to install seccomp filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package security
+
+import (
+	"encoding/binary"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// seccompData is struct seccomp_data, what a filter is run against
+type seccompData struct {
+	nr   uint32
+	arch uint32
+	args [6]uint64
+}
+
+// runFilter interprets a program from Compile the way the kernel does
+func runFilter(t *testing.T, filter []byte, data seccompData) uint32 {
+	t.Helper()
+	buf := make([]byte, 64)
+	binary.NativeEndian.PutUint32(buf[offsetNr:], data.nr)
+	binary.NativeEndian.PutUint32(buf[offsetArch:], data.arch)
+	for i, arg := range data.args {
+		binary.NativeEndian.PutUint64(buf[offsetArgs+8*i:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(filter)/8; pc++ {
+		ins := filter[8*pc:]
+		code := binary.NativeEndian.Uint16(ins)
+		jt, jf := int(ins[2]), int(ins[3])
+		k := binary.NativeEndian.Uint32(ins[4:])
+
+		jump := func(cond bool) {
+			if cond {
+				pc += jt
+			} else {
+				pc += jf
+			}
+		}
+		switch code {
+		case bpfLdAbs:
+			if int(k)+4 > len(buf) {
+				t.Fatalf("load from offset %d at %d", k, pc)
+			}
+			acc = binary.NativeEndian.Uint32(buf[k:])
+		case bpfAnd:
+			acc &= k
+		case bpfJeq:
+			jump(acc == k)
+		case bpfJgt:
+			jump(acc > k)
+		case bpfJge:
+			jump(acc >= k)
+		case bpfRet:
+			return k
+		default:
+			t.Fatalf("unknown instruction %#x at %d", code, pc)
+		}
+	}
+	t.Fatal("filter ran off its end")
+	return 0
+}
+
+// compile compiles a profile for this architecture, skipping the test where
+// seccomp filters are not supported
+func compile(t *testing.T, p *Profile, caps Capabilities) []byte {
+	t.Helper()
+	if nativeArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	filter, err := p.Compile(caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func nr(t *testing.T, name string) uint32 {
+	t.Helper()
+	n, ok := syscallNumbers[name]
+	if !ok {
+		t.Fatalf("unknown system call %s", name)
+	}
+	return n
+}
+
+func TestCompileRules(t *testing.T) {
+	eperm := retErrno | uint32(syscall.EPERM)
+	eacces := uint(syscall.EACCES)
+	p := &Profile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []Syscall{
+			{Names: []string{"no_such_syscall", "getpid"}, Action: "SCMP_ACT_ERRNO"},
+			// Checks arguments, so the next rules have to load the number again
+			{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eacces, Args: []Arg{{Index: 0, Value: 3, Op: "SCMP_CMP_EQ"}}},
+			{Names: []string{"read", "write"}, Action: "SCMP_ACT_KILL_PROCESS"},
+			// Never reached, the first matching rule wins
+			{Names: []string{"getpid"}, Action: "SCMP_ACT_ALLOW"},
+		},
+	}
+	filter := compile(t, p, 0)
+
+	tests := []struct {
+		name string
+		data seccompData
+		want uint32
+	}{
+		{"listed", seccompData{nr: nr(t, "getpid")}, eperm},
+		{"argument matches", seccompData{nr: nr(t, "read"), args: [6]uint64{3}}, retErrno | uint32(syscall.EACCES)},
+		{"argument differs", seccompData{nr: nr(t, "read"), args: [6]uint64{4}}, retKillProcess},
+		{"later rule", seccompData{nr: nr(t, "write")}, retKillProcess},
+		{"default", seccompData{nr: nr(t, "close")}, retAllow},
+	}
+	for _, tt := range tests {
+		tt.data.arch = nativeArch
+		if got := runFilter(t, filter, tt.data); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileArchitecture(t *testing.T) {
+	filter := compile(t, &Profile{DefaultAction: "SCMP_ACT_ALLOW"}, 0)
+
+	if got := runFilter(t, filter, seccompData{nr: nr(t, "getpid"), arch: 0x40000003}); got != retKillProcess {
+		t.Errorf("foreign architecture: got %#x, want kill", got)
+	}
+	if nativeArch == auditArchX86_64 {
+		got := runFilter(t, filter, seccompData{nr: x32SyscallBit | nr(t, "getpid"), arch: nativeArch})
+		if got != retErrno|uint32(syscall.ENOSYS) {
+			t.Errorf("x32 system call: got %#x, want ENOSYS", got)
+		}
+	}
+
+	if _, err := (&Profile{DefaultAction: "SCMP_ACT_ALLOW", Architectures: []string{"SCMP_ARCH_PPC64LE"}}).Compile(0); err == nil {
+		t.Error("expected an error for a profile of another architecture")
+	}
+}
+
+func TestCompileComparisons(t *testing.T) {
+	// Values that differ in the low half, the high half or both
+	const value = 0x1_0000_0005
+	args := []uint64{0, 4, 5, 6, 0x1_0000_0004, value, 0x1_0000_0006, 0x2_0000_0000, 0x2_0000_0005, 0xffff_ffff_ffff_ffff}
+
+	tests := []struct {
+		op       string
+		valueTwo uint64
+		holds    func(x uint64) bool
+	}{
+		{"SCMP_CMP_EQ", 0, func(x uint64) bool { return x == value }},
+		{"SCMP_CMP_NE", 0, func(x uint64) bool { return x != value }},
+		{"SCMP_CMP_GT", 0, func(x uint64) bool { return x > value }},
+		{"SCMP_CMP_GE", 0, func(x uint64) bool { return x >= value }},
+		{"SCMP_CMP_LT", 0, func(x uint64) bool { return x < value }},
+		{"SCMP_CMP_LE", 0, func(x uint64) bool { return x <= value }},
+		// Value is the mask, ValueTwo what the masked argument must be
+		{"SCMP_CMP_MASKED_EQ", 0x1_0000_0004, func(x uint64) bool { return x&value == 0x1_0000_0004 }},
+	}
+	for _, tt := range tests {
+		p := &Profile{
+			DefaultAction: "SCMP_ACT_ALLOW",
+			Syscalls: []Syscall{{
+				Names:  []string{"write"},
+				Action: "SCMP_ACT_ERRNO",
+				Args:   []Arg{{Index: 2, Value: value, ValueTwo: tt.valueTwo, Op: tt.op}},
+			}},
+		}
+		filter := compile(t, p, 0)
+		for _, x := range args {
+			data := seccompData{nr: nr(t, "write"), arch: nativeArch}
+			data.args[2] = x
+			want := uint32(retAllow)
+			if tt.holds(x) {
+				want = retErrno | uint32(syscall.EPERM)
+			}
+			if got := runFilter(t, filter, data); got != want {
+				t.Errorf("%s %#x with argument %#x: got %#x, want %#x", tt.op, uint64(value), x, got, want)
+			}
+		}
+	}
+}
+
+func TestCompileMultipleArgs(t *testing.T) {
+	p := &Profile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []Syscall{{
+			Names:  []string{"write"},
+			Action: "SCMP_ACT_KILL",
+			Args: []Arg{
+				{Index: 0, Value: 1, Op: "SCMP_CMP_NE"},
+				{Index: 1, Value: 100, Op: "SCMP_CMP_LT"},
+			},
+		}},
+	}
+	filter := compile(t, p, 0)
+
+	tests := []struct {
+		fd, size uint64
+		want     uint32
+	}{
+		{2, 10, retKillThread},
+		{1, 10, retAllow},
+		{2, 100, retAllow},
+		{1, 100, retAllow},
+	}
+	for _, tt := range tests {
+		data := seccompData{nr: nr(t, "write"), arch: nativeArch, args: [6]uint64{tt.fd, tt.size}}
+		if got := runFilter(t, filter, data); got != tt.want {
+			t.Errorf("fd %d, size %d: got %#x, want %#x", tt.fd, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCompileCapabilities(t *testing.T) {
+	p := &Profile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []Syscall{
+			{Names: []string{"mount"}, Action: "SCMP_ACT_ERRNO", Excludes: Filter{Caps: []string{"SYS_ADMIN"}}},
+			{Names: []string{"reboot"}, Action: "SCMP_ACT_ERRNO", Includes: Filter{Caps: []string{"SYS_BOOT"}}},
+			{Names: []string{"getpid"}, Action: "SCMP_ACT_ERRNO", Excludes: Filter{Arches: []string{"amd64", "arm64"}}},
+		},
+	}
+	sysAdmin, err := parseCapabilities([]string{"SYS_ADMIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eperm := retErrno | uint32(syscall.EPERM)
+	tests := []struct {
+		name string
+		caps Capabilities
+		call string
+		want uint32
+	}{
+		{"excluded capability missing", 0, "mount", eperm},
+		{"excluded capability held", sysAdmin, "mount", retAllow},
+		{"included capability missing", 0, "reboot", retAllow},
+		{"excluded architecture", 0, "getpid", retAllow},
+	}
+	for _, tt := range tests {
+		filter := compile(t, p, tt.caps)
+		if got := runFilter(t, filter, seccompData{nr: nr(t, tt.call), arch: nativeArch}); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileDefaultProfile(t *testing.T) {
+	filter := compile(t, DefaultProfile(), 0)
+
+	clone := func(flags uint64) seccompData {
+		return seccompData{nr: nr(t, "clone"), arch: nativeArch, args: [6]uint64{flags}}
+	}
+	if got := runFilter(t, filter, clone(syscall.CLONE_VM|syscall.CLONE_THREAD)); got != retAllow {
+		t.Errorf("clone of a thread: got %#x, want allow", got)
+	}
+	if got := runFilter(t, filter, clone(syscall.CLONE_NEWUSER)); got != retErrno|uint32(syscall.EPERM) {
+		t.Errorf("clone of a user namespace: got %#x, want EPERM", got)
+	}
+	if got := runFilter(t, filter, seccompData{nr: nr(t, "clone3"), arch: nativeArch}); got != retErrno|uint32(syscall.ENOSYS) {
+		t.Errorf("clone3: got %#x, want ENOSYS", got)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	tests := []struct {
+		name    string
+		profile *Profile
+		want    string
+	}{
+		{"default action", &Profile{DefaultAction: "SCMP_ACT_NOTIFY"}, "unsupported seccomp action"},
+		{"rule action", &Profile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_FOO"}}}, "unsupported seccomp action"},
+		{"comparison", &Profile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO", Args: []Arg{{Op: "SCMP_CMP_FOO"}}}}}, "unsupported comparison"},
+		{"argument index", &Profile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_ERRNO", Args: []Arg{{Index: 6, Op: "SCMP_CMP_EQ"}}}}}, "invalid argument index"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.profile.Compile(0); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	prog := &program{labels: make(map[string]int)}
+	prog.emit(bpfJeq, 1, "target", "")
+	for i := 0; i < 256; i++ {
+		prog.emit(bpfRet, retAllow, "", "")
+	}
+	prog.label("target")
+	prog.emit(bpfRet, retKillProcess, "", "")
+	if _, err := prog.assemble(); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("jump over 256 instructions: got %v", err)
+	}
+
+	prog = &program{labels: make(map[string]int)}
+	prog.emit(bpfJeq, 1, "", "missing")
+	if _, err := prog.assemble(); err == nil || !strings.Contains(err.Error(), "undefined label") {
+		t.Errorf("undefined label: got %v", err)
+	}
+
+	// The furthest jump possible lands on its target
+	prog = &program{labels: make(map[string]int)}
+	prog.emit(bpfJeq, 1, "target", "")
+	for i := 0; i < 255; i++ {
+		prog.emit(bpfRet, retAllow, "", "")
+	}
+	prog.label("target")
+	prog.emit(bpfRet, retKillProcess, "", "")
+	filter, err := prog.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter[2] != 255 || filter[3] != 0 {
+		t.Errorf("got jumps %d and %d, want 255 and 0", filter[2], filter[3])
+	}
+}
@@ -0,0 +1,148 @@
+package security
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Options control the privileges of commands
+type Options struct {
+	// Hardened drops capabilities to DefaultCapabilities, sets no_new_privs
+	// and applies DefaultProfile. The exec package also isolates hardened
+	// commands in a mount namespace of their own.
+	Hardened bool
+	// CapAdd and CapDrop change the capabilities commands keep, from
+	// DefaultCapabilities in hardened mode and from all otherwise
+	CapAdd  []string
+	CapDrop []string
+	// NoNewPrivileges overrides whether no_new_privs is set
+	NoNewPrivileges *bool
+	// Seccomp is the path of a seccomp profile, or "unconfined" for none
+	Seccomp string
+}
+
+// IsZero reports whether commands run with the privileges they get from chroot
+func (o Options) IsZero() bool {
+	return !o.Hardened && len(o.CapAdd) == 0 && len(o.CapDrop) == 0 && o.NoNewPrivileges == nil && o.Seccomp == ""
+}
+
+// ParseSecurityOpt applies a security option given as seccomp=PROFILE,
+// seccomp=unconfined or no-new-privileges[=true|false], with = or :
+func (o *Options) ParseSecurityOpt(opt string) error {
+	key, value, hasValue := strings.Cut(opt, "=")
+	if !hasValue {
+		key, value, hasValue = strings.Cut(opt, ":")
+	}
+
+	switch key {
+	case "seccomp":
+		if value == "" {
+			return fmt.Errorf("invalid security option %s, use seccomp=PROFILE or seccomp=unconfined", opt)
+		}
+		o.Seccomp = value
+	case "no-new-privileges":
+		enabled := true
+		if hasValue {
+			var err error
+			if enabled, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid security option %s", opt)
+			}
+		}
+		o.NoNewPrivileges = &enabled
+	default:
+		return fmt.Errorf("unknown security option %s", opt)
+	}
+	return nil
+}
+
+// Config is what the init helper applies to a command just before it runs
+type Config struct {
+	// DropCapabilities limits the command to Capabilities
+	DropCapabilities bool         `json:"drop_capabilities,omitempty"`
+	Capabilities     Capabilities `json:"capabilities,omitempty"`
+	NoNewPrivs       bool         `json:"no_new_privs,omitempty"`
+	// Seccomp is a compiled filter
+	Seccomp []byte `json:"seccomp,omitempty"`
+}
+
+// Resolve turns the options into a Config, loading and compiling the seccomp
+// profile. It returns nil if the options change nothing.
+func (o Options) Resolve() (*Config, error) {
+	if o.IsZero() {
+		return nil, nil
+	}
+	config := &Config{NoNewPrivs: o.Hardened, Capabilities: allCapabilities}
+
+	if o.Hardened || len(o.CapAdd) > 0 || len(o.CapDrop) > 0 {
+		if o.Hardened {
+			config.Capabilities, _ = parseCapabilities(DefaultCapabilities)
+		}
+		drop, err := parseCapabilities(o.CapDrop)
+		if err != nil {
+			return nil, err
+		}
+		add, err := parseCapabilities(o.CapAdd)
+		if err != nil {
+			return nil, err
+		}
+		config.Capabilities = config.Capabilities&^drop | add
+		config.DropCapabilities = true
+	}
+
+	if o.NoNewPrivileges != nil {
+		config.NoNewPrivs = *o.NoNewPrivileges
+	}
+
+	var profile *Profile
+	switch o.Seccomp {
+	case "unconfined":
+	case "":
+		if o.Hardened {
+			profile = DefaultProfile()
+		}
+	default:
+		var err error
+		if profile, err = LoadProfile(o.Seccomp); err != nil {
+			return nil, err
+		}
+	}
+	if profile != nil {
+		var err error
+		if config.Seccomp, err = profile.Compile(config.Capabilities); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Apply restricts the calling thread as configured. It must run on a
+// locked OS thread that then executes the command.
+func (c *Config) Apply() error {
+	if c.NoNewPrivs {
+		if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	}
+
+	// Without no_new_privs, installing a filter takes SYS_ADMIN, which may be dropped next
+	if len(c.Seccomp) > 0 && !c.NoNewPrivs {
+		if err := installFilter(c.Seccomp); err != nil {
+			return err
+		}
+	}
+
+	if c.DropCapabilities {
+		if err := dropCapabilities(c.Capabilities); err != nil {
+			return err
+		}
+	}
+
+	// Otherwise the filter comes last, so it cannot get in the way of the steps before
+	if len(c.Seccomp) > 0 && c.NoNewPrivs {
+		if err := installFilter(c.Seccomp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
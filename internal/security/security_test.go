@@ -0,0 +1,129 @@
+package security
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestParseSecurityOpt(t *testing.T) {
+	tests := []struct {
+		opt     string
+		seccomp string
+		nnp     *bool
+		wantErr bool
+	}{
+		{opt: "seccomp=unconfined", seccomp: "unconfined"},
+		{opt: "seccomp:/etc/profile.json", seccomp: "/etc/profile.json"},
+		{opt: "no-new-privileges", nnp: boolPtr(true)},
+		{opt: "no-new-privileges=false", nnp: boolPtr(false)},
+		{opt: "no-new-privileges:true", nnp: boolPtr(true)},
+		{opt: "seccomp", wantErr: true},
+		{opt: "seccomp=", wantErr: true},
+		{opt: "no-new-privileges=maybe", wantErr: true},
+		{opt: "apparmor=unconfined", wantErr: true},
+	}
+	for _, tt := range tests {
+		var o Options
+		err := o.ParseSecurityOpt(tt.opt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.opt, err)
+			continue
+		}
+		if o.Seccomp != tt.seccomp {
+			t.Errorf("%s: got seccomp %q, want %q", tt.opt, o.Seccomp, tt.seccomp)
+		}
+		if (o.NoNewPrivileges == nil) != (tt.nnp == nil) || tt.nnp != nil && *o.NoNewPrivileges != *tt.nnp {
+			t.Errorf("%s: got no-new-privileges %v, want %v", tt.opt, o.NoNewPrivileges, tt.nnp)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	if config, err := (Options{}).Resolve(); config != nil || err != nil {
+		t.Errorf("no options: got %+v and %v, want nothing", config, err)
+	}
+
+	defaults, err := parseCapabilities(DefaultCapabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Options{Hardened: true, Seccomp: "unconfined", CapAdd: []string{"cap_sys_admin"}, CapDrop: []string{"CHOWN"}}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.DropCapabilities || !config.NoNewPrivs || config.Seccomp != nil {
+		t.Errorf("hardened: got %+v", config)
+	}
+	if want := defaults&^(1<<0) | 1<<21; config.Capabilities != want {
+		t.Errorf("hardened: got capabilities %s, want %s", config.Capabilities, want)
+	}
+
+	// Without --hardened capabilities are dropped from the full set, and a
+	// capability both dropped and added is kept
+	config, err = Options{CapDrop: []string{"ALL"}, CapAdd: []string{"NET_ADMIN"}, NoNewPrivileges: boolPtr(true)}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.DropCapabilities || !config.NoNewPrivs || config.Capabilities.String() != "NET_ADMIN" {
+		t.Errorf("dropped all: got %+v", config)
+	}
+	config, err = Options{CapDrop: []string{"MKNOD"}, NoNewPrivileges: boolPtr(false), Hardened: true, Seccomp: "unconfined"}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NoNewPrivs || config.Capabilities.Has("MKNOD") || !config.Capabilities.Has("CAP_KILL") {
+		t.Errorf("hardened without no-new-privileges: got %+v", config)
+	}
+
+	if _, err := (Options{CapAdd: []string{"FLY"}}).Resolve(); err == nil {
+		t.Error("expected an error for an unknown capability")
+	}
+	if _, err := (Options{Seccomp: filepath.Join(t.TempDir(), "missing.json")}).Resolve(); err == nil {
+		t.Error("expected an error for a missing seccomp profile")
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	if nativeArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	dir := t.TempDir()
+
+	config, err := Options{Hardened: true}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Seccomp) == 0 {
+		t.Error("hardened mode did not apply the default profile")
+	}
+
+	path := filepath.Join(dir, "profile.json")
+	writeProfile := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeProfile(`{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read","write"],"action":"SCMP_ACT_ALLOW"}]}`)
+	config, err = Options{Seccomp: path}.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DropCapabilities || config.NoNewPrivs {
+		t.Errorf("profile only: got %+v", config)
+	}
+	if got := runFilter(t, config.Seccomp, seccompData{nr: nr(t, "write"), arch: nativeArch}); got != retAllow {
+		t.Errorf("write: got %#x, want allow", got)
+	}
+
+	writeProfile(`{"syscalls":[]}`)
+	if _, err := (Options{Seccomp: path}).Resolve(); err == nil {
+		t.Error("expected an error for a profile without a default action")
+	}
+	writeProfile(`{`)
+	if _, err := (Options{Seccomp: path}).Resolve(); err == nil {
+		t.Error("expected an error for an invalid profile")
+	}
+}
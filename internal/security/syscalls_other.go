@@ -0,0 +1,8 @@
+//go:build !amd64 && !arm64
+
+package security
+
+// nativeArch is 0 where qimi has no system call table, seccomp filters are not supported there
+const nativeArch = 0
+
+var syscallNumbers = map[string]uint32{}
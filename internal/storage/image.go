@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ImageFile identifies an image file independently of the path used to reach it
+type ImageFile struct {
+	RealPath string
+	Dev      uint64
+	Inode    uint64
+}
+
+// ResolveImage resolves symlinks and relative components of path and records
+// the device and inode of the image file
+func ResolveImage(path string) (*ImageFile, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("failed to stat %s", realPath)
+	}
+
+	return &ImageFile{
+		RealPath: realPath,
+		Dev:      uint64(st.Dev),
+		Inode:    st.Ino,
+	}, nil
+}
+
+// SetImage records the identity of the mounted image file
+func (info *MountInfo) SetImage(img *ImageFile) {
+	info.RealPath = img.RealPath
+	info.Dev = img.Dev
+	info.Inode = img.Inode
+}
+
+// SameImage reports whether the mount uses the given image file. Entries
+// written before the inode was recorded fall back to the stored path.
+func (info *MountInfo) SameImage(img *ImageFile) bool {
+	if info.Inode != 0 {
+		return info.Dev == img.Dev && info.Inode == img.Inode
+	}
+
+	mounted, err := ResolveImage(info.ImagePath)
+	if err != nil {
+		return false
+	}
+	return mounted.Dev == img.Dev && mounted.Inode == img.Inode
+}
+
+// FindByImage returns the mounts that use the given image file
+func (s *Storage) FindByImage(img *ImageFile) []*MountInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var mounts []*MountInfo
+	for _, info := range s.mounts {
+		if info.SameImage(img) {
+			mounts = append(mounts, info)
+		}
+	}
+	return mounts
+}
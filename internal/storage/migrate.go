@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
+)
+
+// Where version 1 kept its state file and the devices of a mount in side files
+var (
+	legacyStatePath   = filepath.Join(config.LegacyRoot, "state.json")
+	legacyMetadataDir = filepath.Join(config.LegacyRoot, "metadata")
+)
+
+// importLegacy moves the state file of versions that kept everything in
+// /tmp/qimi to the configured state directory. The file lock must be held.
+func (s *Storage) importLegacy() error {
+	legacyPath := legacyStatePath
+	// The legacy state belongs to root
+	if legacyPath == s.dbPath || config.Current().Rootless {
+		return nil
+	}
+
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		return nil
+	}
+	if err := s.decode(data); err != nil {
+		logger.Warn("ignoring unreadable legacy state file %s: %v", legacyPath, err)
+		s.mounts = make(map[string]*MountInfo)
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return fmt.Errorf("failed to import legacy state file %s: %w", legacyPath, err)
+	}
+
+	logger.Info("imported %d mount(s) from legacy state file %s into %s", len(s.mounts), legacyPath, s.dbPath)
+	return os.Rename(legacyPath, legacyPath+".migrated")
+}
+
+// migrateV1 fills in a version 1 entry from the side files that recorded its
+// NBD device, volume groups, LUKS mappings and submounts
+func migrateV1(info *MountInfo) {
+	if info.ID == "" {
+		info.ID = filepath.Base(info.MountPoint)
+	}
+	// Relative image paths were relative to the directory qimi mount ran in,
+	// which is unknown, so they are left to the path-based lookup
+	if filepath.IsAbs(info.ImagePath) && info.RealPath == "" {
+		info.RealPath = info.ImagePath
+	}
+
+	base := filepath.Join(legacyMetadataDir, filepath.Base(info.MountPoint))
+	logger.Debug("migrating state of %s from %s.*", info.MountPoint, base)
+
+	if data, err := os.ReadFile(base + ".nbd"); err == nil {
+		info.Device = strings.TrimSpace(string(data))
+	}
+
+	if data, err := os.ReadFile(base + ".lvm"); err == nil {
+		var vgs []struct {
+			Name         string   `json:"name"`
+			OriginalName string   `json:"original_name"`
+			UUID         string   `json:"uuid"`
+			PVs          []string `json:"pvs"`
+		}
+		if err := json.Unmarshal(data, &vgs); err != nil {
+			logger.Warn("invalid LVM metadata %s.lvm: %v", base, err)
+		}
+		for _, vg := range vgs {
+			info.ExtraMounts = append(info.ExtraMounts, ExtraMount{
+				Type:         ExtraTypeLVM,
+				Name:         vg.Name,
+				OriginalName: vg.OriginalName,
+				UUID:         vg.UUID,
+				Devices:      vg.PVs,
+			})
+		}
+	}
+
+	for _, name := range readLines(base + ".luks") {
+		info.ExtraMounts = append(info.ExtraMounts, ExtraMount{Type: ExtraTypeLUKS, Name: name})
+	}
+	for _, target := range readLines(base + ".mounts") {
+		info.ExtraMounts = append(info.ExtraMounts, ExtraMount{Type: ExtraTypeMount, Target: target})
+	}
+}
+
+// readLines returns the non-empty lines of a file
+func readLines(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
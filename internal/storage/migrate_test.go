@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestStorage returns a storage whose state file and legacy files live in
+// a temporary directory
+func newTestStorage(t *testing.T) (*Storage, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldState, oldMetadata := legacyStatePath, legacyMetadataDir
+	legacyStatePath = filepath.Join(dir, "legacy", "state.json")
+	legacyMetadataDir = filepath.Join(dir, "legacy", "metadata")
+	t.Cleanup(func() { legacyStatePath, legacyMetadataDir = oldState, oldMetadata })
+	if err := os.MkdirAll(legacyMetadataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Storage{dbPath: filepath.Join(dir, "state.json")}
+	s.lockPath = s.dbPath + ".lock"
+	return s, dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const v1State = `{
+  "/images/disk.qcow2": {
+    "image_path": "/images/disk.qcow2",
+    "mount_point": "/tmp/qimi/mounts/abc123",
+    "read_only": false,
+    "root_device": "/dev/mapper/vg_root-lv",
+    "uid": 0
+  },
+  "disk.raw": {
+    "image_path": "disk.raw",
+    "mount_point": "/tmp/qimi/mounts/def456",
+    "read_only": true,
+    "uid": 1000
+  }
+}`
+
+func TestMigrateV1(t *testing.T) {
+	s, _ := newTestStorage(t)
+
+	base := filepath.Join(legacyMetadataDir, "abc123")
+	writeFile(t, base+".nbd", "/dev/nbd3\n")
+	writeFile(t, base+".lvm", `[{"name":"qimi_abc123_vg","original_name":"vg","uuid":"u-1","pvs":["/dev/nbd3p2"]}]`)
+	writeFile(t, base+".luks", "qimi_luks_1\n\n  qimi_luks_2  \n")
+	writeFile(t, base+".mounts", "/tmp/qimi/mounts/abc123/boot\n/tmp/qimi/mounts/abc123/home\n")
+	writeFile(t, s.dbPath, v1State)
+
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := s.mounts["/images/disk.qcow2"]
+	if info == nil {
+		t.Fatal("mount of /images/disk.qcow2 was not loaded")
+	}
+	if info.ID != "abc123" || info.RealPath != "/images/disk.qcow2" || info.Device != "/dev/nbd3" {
+		t.Errorf("got ID %q, real path %q and device %q", info.ID, info.RealPath, info.Device)
+	}
+	want := []ExtraMount{
+		{Type: ExtraTypeLVM, Name: "qimi_abc123_vg", OriginalName: "vg", UUID: "u-1", Devices: []string{"/dev/nbd3p2"}},
+		{Type: ExtraTypeLUKS, Name: "qimi_luks_1"},
+		{Type: ExtraTypeLUKS, Name: "qimi_luks_2"},
+		{Type: ExtraTypeMount, Target: "/tmp/qimi/mounts/abc123/boot"},
+		{Type: ExtraTypeMount, Target: "/tmp/qimi/mounts/abc123/home"},
+	}
+	if !reflect.DeepEqual(info.ExtraMounts, want) {
+		t.Errorf("got extra mounts %+v, want %+v", info.ExtraMounts, want)
+	}
+
+	// Without side files only the ID is known, and a relative image path
+	// is not taken for the real path
+	info = s.mounts["disk.raw"]
+	if info == nil {
+		t.Fatal("mount of disk.raw was not loaded")
+	}
+	if info.ID != "def456" || info.RealPath != "" || info.Device != "" || len(info.ExtraMounts) != 0 || !info.ReadOnly || info.UID != 1000 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestMigrateV1InvalidLVM(t *testing.T) {
+	newTestStorage(t)
+	writeFile(t, filepath.Join(legacyMetadataDir, "abc123.lvm"), "not json")
+
+	info := &MountInfo{ImagePath: "/images/disk.qcow2", MountPoint: "/tmp/qimi/mounts/abc123"}
+	migrateV1(info)
+	if len(info.ExtraMounts) != 0 {
+		t.Errorf("got extra mounts %+v from invalid metadata", info.ExtraMounts)
+	}
+}
+
+func TestImportLegacy(t *testing.T) {
+	s, _ := newTestStorage(t)
+	writeFile(t, filepath.Join(legacyMetadataDir, "abc123.nbd"), "/dev/nbd3")
+	writeFile(t, legacyStatePath, v1State)
+
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.mounts) != 2 || s.mounts["/images/disk.qcow2"].Device != "/dev/nbd3" {
+		t.Errorf("got mounts %+v", s.mounts)
+	}
+
+	if _, err := os.Stat(legacyStatePath); !os.IsNotExist(err) {
+		t.Errorf("legacy state file was not moved away: %v", err)
+	}
+	if _, err := os.Stat(legacyStatePath + ".migrated"); err != nil {
+		t.Error(err)
+	}
+
+	// The imported state is saved in the current format
+	data, err := os.ReadFile(s.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != SchemaVersion || state.Mounts["/images/disk.qcow2"].ID != "abc123" {
+		t.Errorf("got saved state %s", data)
+	}
+
+	// Loading again reads the imported file
+	if err := s.load(); err != nil || len(s.mounts) != 2 {
+		t.Errorf("got %d mounts and error %v after import", len(s.mounts), err)
+	}
+}
+
+func TestImportLegacyUnreadable(t *testing.T) {
+	s, _ := newTestStorage(t)
+	writeFile(t, legacyStatePath, "{")
+
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.mounts) != 0 {
+		t.Errorf("got mounts %+v", s.mounts)
+	}
+	// The unreadable file is left for the user to look at
+	if _, err := os.Stat(legacyStatePath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadVersions(t *testing.T) {
+	s, dir := newTestStorage(t)
+
+	writeFile(t, s.dbPath, `{"version":2,"mounts":{"/images/disk.qcow2":{"id":"abc123","image_path":"/images/disk.qcow2","mount_point":"/run/qimi/mounts/abc123","uid":0}}}`)
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if info := s.mounts["/images/disk.qcow2"]; info == nil || info.ID != "abc123" {
+		t.Errorf("got mounts %+v", s.mounts)
+	}
+
+	writeFile(t, s.dbPath, `{"version":3,"mounts":{}}`)
+	if err := s.load(); !errors.Is(err, errUnsupportedVersion) {
+		t.Errorf("got %v for a newer state file, want %v", err, errUnsupportedVersion)
+	}
+	if _, err := os.Stat(s.dbPath); err != nil {
+		t.Errorf("newer state file was touched: %v", err)
+	}
+
+	writeFile(t, s.dbPath, "{")
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.mounts) != 0 {
+		t.Errorf("got mounts %+v from a corrupt state file", s.mounts)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moved bool
+	for _, e := range entries {
+		moved = moved || strings.HasPrefix(e.Name(), "state.json.corrupt-")
+	}
+	if !moved {
+		t.Error("corrupt state file was not moved aside")
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines")
+	writeFile(t, path, "a\n\n  b \r\nc")
+	if got, want := readLines(path), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := readLines(path + ".missing"); got != nil {
+		t.Errorf("got %q for a missing file", got)
+	}
+}
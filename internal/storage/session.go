@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/logger"
+	"github.com/packetstream-llc/qimi/internal/process"
+)
+
+// Session is a running qimi exec command
+type Session struct {
+	ID string `json:"id"`
+	// MountID is the ID of the mount the command runs in
+	MountID    string `json:"mount_id"`
+	Name       string `json:"name,omitempty"`
+	ImagePath  string `json:"image_path"`
+	MountPoint string `json:"mount_point"`
+	// Temporary is set when exec mounted the image just for this command
+	Temporary bool     `json:"temporary,omitempty"`
+	Command   []string `json:"command"`
+	// Detached is set for sessions started with exec --detach, whose stdio is
+	// served on a socket by a supervisor
+	Detached bool `json:"detached,omitempty"`
+	// PID is the qimi exec process that runs and waits for the command
+	PID int `json:"pid"`
+	// PIDStartTime is the start time of PID in clock ticks since boot, so a
+	// process that reuses the PID of a crashed session isn't taken for it
+	PIDStartTime uint64    `json:"pid_start_time,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	UID          int       `json:"uid"`
+	User         string    `json:"user,omitempty"`
+	TTY          string    `json:"tty,omitempty"`
+}
+
+// Alive reports whether the qimi process of the session is still running
+func (s *Session) Alive() bool {
+	if !process.Alive(s.PID) {
+		return false
+	}
+	if s.PIDStartTime == 0 {
+		// Recorded by a qimi version that didn't track start times
+		return true
+	}
+	start, err := process.StartTime(s.PID)
+	return err == nil && start == s.PIDStartTime
+}
+
+// pruneSessions forgets the sessions of qimi processes that died without
+// ending them. The state must be loaded and locked.
+func (s *Storage) pruneSessions() {
+	for id, session := range s.sessions {
+		if !session.Alive() {
+			logger.Debug("forgetting session %s of dead process %d", id, session.PID)
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// mountSessions returns the live sessions running in a mount
+func (s *Storage) mountSessions(mountID string) []*Session {
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.MountID == mountID && session.Alive() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// AcquireSession registers a session. For a session on a persistent mount,
+// setup runs under the state lock when no other session uses the mount, so
+// the resources sessions share are set up exactly once.
+func (s *Storage) AcquireSession(session *Session, setup func() error) error {
+	return s.update(func() error {
+		if !session.Temporary {
+			if _, err := s.lookup(session.MountID); err != nil {
+				return err
+			}
+			if len(s.mountSessions(session.MountID)) == 0 && setup != nil {
+				if err := setup(); err != nil {
+					return err
+				}
+			}
+		}
+
+		s.sessions[session.ID] = session
+		return nil
+	})
+}
+
+// ReleaseSession unregisters a session. For a session on a persistent mount,
+// teardown runs under the state lock when it was the last one using the
+// mount. The session is unregistered even if teardown fails.
+func (s *Storage) ReleaseSession(id string, teardown func() error) error {
+	var teardownErr error
+	err := s.update(func() error {
+		session, ok := s.sessions[id]
+		if !ok {
+			return fmt.Errorf("session %s not found", id)
+		}
+		delete(s.sessions, id)
+
+		// A forced unmount may have removed the mount already
+		if _, err := s.lookup(session.MountID); err != nil || session.Temporary {
+			return nil
+		}
+		if len(s.mountSessions(session.MountID)) == 0 && teardown != nil {
+			teardownErr = teardown()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return teardownErr
+}
+
+// GetSession returns a running session by ID
+func (s *Storage) GetSession(id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !session.Alive() {
+		return nil, fmt.Errorf("session not found: %s", id)
+	}
+	return session, nil
+}
+
+// ListSessions returns the running sessions, oldest first
+func (s *Storage) ListSessions() []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.Alive() {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+// MountSessions returns the running sessions using a mount
+func (s *Storage) MountSessions(info *MountInfo) []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.mountSessions(info.ID)
+}
+
+// PruneSessions removes the sessions of dead processes from the state
+func (s *Storage) PruneSessions() error {
+	return s.update(func() error { return nil })
+}
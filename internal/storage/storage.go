@@ -2,68 +2,273 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/packetstream-llc/qimi/internal/config"
+	"github.com/packetstream-llc/qimi/internal/logger"
 )
 
+// SchemaVersion is the version of the state file format written by this version of qimi
+const SchemaVersion = 2
+
 type MountInfo struct {
+	// ID is the session ID that names the mount point and its metadata
+	ID         string `json:"id,omitempty"`
 	ImagePath  string `json:"image_path"`
 	MountPoint string `json:"mount_point"`
 	Name       string `json:"name,omitempty"`
 	ReadOnly   bool   `json:"read_only"`
+	// RealPath, Dev and Inode identify the image file however it is referred to
+	RealPath string `json:"real_path,omitempty"`
+	Dev      uint64 `json:"dev,omitempty"`
+	Inode    uint64 `json:"inode,omitempty"`
+	// Format is the image format qemu detected (qcow2, raw, ...)
+	Format string `json:"format,omitempty"`
+	// Device is the NBD device the image is attached to
+	Device string `json:"device,omitempty"`
+	// Rootless mounts serve the image through qemu-storage-daemon and mount
+	// it with a FUSE driver instead of NBD and the kernel
+	Rootless bool `json:"rootless,omitempty"`
+	// Partition is the number of the mounted partition, 0 for whole disks and logical volumes
+	Partition  int    `json:"partition,omitempty"`
+	RootDevice string `json:"root_device,omitempty"`
+	FSType     string `json:"fs_type,omitempty"`
+	// ExtraMounts are the LVM volume groups, LUKS mappings and submounts set up
+	// for this mount, in the order they were created
+	ExtraMounts []ExtraMount `json:"extra_mounts,omitempty"`
+	CreatedAt   time.Time    `json:"created_at,omitzero"`
+	PID         int          `json:"pid,omitempty"`
+	UID         int          `json:"uid"`
+}
+
+// Types of extra mounts
+const (
+	ExtraTypeLVM   = "lvm"
+	ExtraTypeLUKS  = "luks"
+	ExtraTypeMount = "mount"
+	// ExtraTypeExport is the FUSE export of a rootless mount
+	ExtraTypeExport = "export"
+)
+
+// ExtraMount is a device or filesystem set up in addition to the root mount
+type ExtraMount struct {
+	Type string `json:"type"`
+	// Name is the volume group or LUKS mapping name
+	Name string `json:"name,omitempty"`
+	// OriginalName is the volume group name inside the image
+	OriginalName string `json:"original_name,omitempty"`
+	UUID         string `json:"uuid,omitempty"`
+	// Devices are the physical volumes of a volume group
+	Devices []string `json:"devices,omitempty"`
+	// Target is where a submount is mounted, or the file an export is mounted on
+	Target string `json:"target,omitempty"`
+	// PID is the qemu-storage-daemon serving an export
+	PID int `json:"pid,omitempty"`
+}
+
+// Extras returns the extra mounts of the given type
+func (info *MountInfo) Extras(typ string) []ExtraMount {
+	var extras []ExtraMount
+	for _, e := range info.ExtraMounts {
+		if e.Type == typ {
+			extras = append(extras, e)
+		}
+	}
+	return extras
+}
+
+// ExportRunning reports whether the qemu-storage-daemon of every export of a
+// rootless mount is still running
+func (info *MountInfo) ExportRunning() bool {
+	exports := info.Extras(ExtraTypeExport)
+	for _, e := range exports {
+		comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", e.PID))
+		// The command name is cut to 15 characters
+		if err != nil || !strings.HasPrefix(string(comm), "qemu-storage") {
+			return false
+		}
+	}
+	return len(exports) > 0
+}
+
+// errUnsupportedVersion means the state file was written by a newer qimi and must not be touched
+var errUnsupportedVersion = errors.New("unsupported state file")
+
+// stateFile is the on-disk format of the state file
+type stateFile struct {
+	Version  int                   `json:"version"`
+	Mounts   map[string]*MountInfo `json:"mounts"`
+	Sessions map[string]*Session   `json:"sessions,omitempty"`
 }
 
 type Storage struct {
-	mu     sync.RWMutex
-	mounts map[string]*MountInfo
-	dbPath string
+	mu       sync.RWMutex
+	mounts   map[string]*MountInfo
+	sessions map[string]*Session
+	dbPath   string
+	lockPath string
 }
 
 func New() (*Storage, error) {
-	// Use /tmp/qimi since mounts don't persist across reboots anyway
-	qimiDir := "/tmp/qimi"
-	if err := os.MkdirAll(qimiDir, 0755); err != nil {
+	cfg := config.Current()
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create qimi directory: %w", err)
 	}
 
 	s := &Storage{
-		mounts: make(map[string]*MountInfo),
-		dbPath: filepath.Join(qimiDir, "state.json"),
+		mounts:   make(map[string]*MountInfo),
+		sessions: make(map[string]*Session),
+		dbPath:   cfg.StatePath(),
+		lockPath: cfg.StatePath() + ".lock",
+	}
+
+	// Loading may have to move a corrupt state file aside, so it takes the
+	// exclusive lock like any other writer
+	lock, err := lockFile(s.lockPath, true)
+	if err != nil {
+		return nil, err
 	}
+	defer lock.unlock()
 
-	if err := s.load(); err != nil && !os.IsNotExist(err) {
+	if err := s.load(); err != nil {
 		return nil, fmt.Errorf("failed to load mounts database: %w", err)
 	}
 
 	return s, nil
 }
 
+// load reads the state file. The file lock must be held. A state file that
+// cannot be parsed is moved aside so later commands keep working.
 func (s *Storage) load() error {
+	s.mounts = make(map[string]*MountInfo)
+	s.sessions = make(map[string]*Session)
+
 	data, err := os.ReadFile(s.dbPath)
+	if os.IsNotExist(err) {
+		return s.importLegacy()
+	}
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, &s.mounts)
+	if err := s.decode(data); errors.Is(err, errUnsupportedVersion) {
+		return err
+	} else if err != nil {
+		s.mounts = make(map[string]*MountInfo)
+		corruptPath := fmt.Sprintf("%s.corrupt-%d", s.dbPath, time.Now().Unix())
+		if renameErr := os.Rename(s.dbPath, corruptPath); renameErr != nil {
+			return fmt.Errorf("state file %s is corrupt (%v) and could not be moved aside: %w", s.dbPath, err, renameErr)
+		}
+		logger.Warn("state file %s is corrupt (%v), moved it to %s and starting with an empty mount list; run 'qimi cleanup' to release leftover devices", s.dbPath, err, corruptPath)
+	}
+
+	return nil
 }
 
+// decode parses the state file, migrating older formats
+func (s *Storage) decode(data []byte) error {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	// Version 1 files are a bare map of mounts, which has no version field
+	if err := json.Unmarshal(data, &probe); err != nil || probe.Version == 0 {
+		if err := json.Unmarshal(data, &s.mounts); err != nil {
+			return err
+		}
+		for _, info := range s.mounts {
+			migrateV1(info)
+		}
+		return nil
+	}
+
+	if probe.Version > SchemaVersion {
+		return fmt.Errorf("%w: state file version %d is newer than supported version %d", errUnsupportedVersion, probe.Version, SchemaVersion)
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Mounts != nil {
+		s.mounts = state.Mounts
+	}
+	if state.Sessions != nil {
+		s.sessions = state.Sessions
+	}
+	return nil
+}
+
+// save atomically replaces the state file. The file lock must be held.
 func (s *Storage) save() error {
-	data, err := json.MarshalIndent(s.mounts, "", "  ")
+	data, err := json.MarshalIndent(stateFile{Version: SchemaVersion, Mounts: s.mounts, Sessions: s.sessions}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.dbPath), filepath.Base(s.dbPath)+".tmp-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
 
-	return os.WriteFile(s.dbPath, data, 0644)
+	return os.Rename(tmp.Name(), s.dbPath)
 }
 
-func (s *Storage) AddMount(info *MountInfo) error {
+// update runs a load-modify-save cycle under the exclusive file lock, so
+// concurrent qimi processes never overwrite each other's changes
+func (s *Storage) update(fn func() error) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	key := info.ImagePath
+	lock, err := lockFile(s.lockPath, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.pruneSessions()
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *Storage) AddMount(info *MountInfo) error {
+	return s.update(func() error {
+		return s.addMount(info)
+	})
+}
+
+func (s *Storage) addMount(info *MountInfo) error {
+	key := info.ID
+	if key == "" {
+		key = info.ImagePath
+	}
 	if info.Name != "" {
 		if _, exists := s.mounts[info.Name]; exists {
 			return fmt.Errorf("mount with name %s already exists", info.Name)
@@ -72,42 +277,71 @@ func (s *Storage) AddMount(info *MountInfo) error {
 	}
 
 	s.mounts[key] = info
-	return s.save()
+	return nil
 }
 
 func (s *Storage) RemoveMount(nameOrPath string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.mounts[nameOrPath]; !exists {
-		for k, v := range s.mounts {
-			if v.ImagePath == nameOrPath {
-				delete(s.mounts, k)
-				return s.save()
-			}
+	return s.update(func() error {
+		key, err := s.lookup(nameOrPath)
+		if err != nil {
+			return err
 		}
-		return fmt.Errorf("mount not found: %s", nameOrPath)
-	}
 
-	delete(s.mounts, nameOrPath)
-	return s.save()
+		delete(s.mounts, key)
+		return nil
+	})
 }
 
 func (s *Storage) GetMount(nameOrPath string) (*MountInfo, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if info, exists := s.mounts[nameOrPath]; exists {
-		return info, nil
+	key, err := s.lookup(nameOrPath)
+	if err != nil {
+		return nil, err
 	}
+	return s.mounts[key], nil
+}
 
-	for _, info := range s.mounts {
+// lookup finds the key of a mount by name, session ID or image path. An image
+// path that is mounted more than once is ambiguous.
+func (s *Storage) lookup(nameOrPath string) (string, error) {
+	if _, exists := s.mounts[nameOrPath]; exists {
+		return nameOrPath, nil
+	}
+
+	for k, info := range s.mounts {
+		if info.ID != "" && info.ID == nameOrPath {
+			return k, nil
+		}
+	}
+
+	var matches []string
+	for k, info := range s.mounts {
 		if info.ImagePath == nameOrPath {
-			return info, nil
+			matches = append(matches, k)
 		}
 	}
 
-	return nil, fmt.Errorf("mount not found: %s", nameOrPath)
+	// Fall back to the image file itself, so any path to it works
+	if len(matches) == 0 {
+		if img, err := ResolveImage(nameOrPath); err == nil {
+			for k, info := range s.mounts {
+				if info.SameImage(img) {
+					matches = append(matches, k)
+				}
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("mount not found: %s", nameOrPath)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%s is mounted %d times, use the name or ID of the mount instead", nameOrPath, len(matches))
+	}
 }
 
 func (s *Storage) ListMounts() []*MountInfo {
@@ -140,10 +374,6 @@ func (s *Storage) cleanupStaleMounts() {
 	for _, key := range toRemove {
 		delete(s.mounts, key)
 	}
-	
-	if len(toRemove) > 0 {
-		s.save()
-	}
 }
 
 func (s *Storage) isValidMount(info *MountInfo) bool {
@@ -152,9 +382,15 @@ func (s *Storage) isValidMount(info *MountInfo) bool {
 		return false
 	}
 	
-	// Check if it's actually mounted by looking for the metadata file
-	nbdFile := filepath.Join("/tmp/qimi/metadata", filepath.Base(info.MountPoint)+".nbd")
-	if _, err := os.Stat(nbdFile); err != nil {
+	// Check if the image is still attached to its NBD device, or served by
+	// qemu-storage-daemon for rootless mounts
+	if info.Rootless {
+		if !info.ExportRunning() {
+			return false
+		}
+	} else if info.Device == "" {
+		return false
+	} else if _, err := os.Stat(filepath.Join("/sys/block", filepath.Base(info.Device), "pid")); err != nil {
 		return false
 	}
 	
@@ -168,9 +404,8 @@ func (s *Storage) isValidMount(info *MountInfo) bool {
 }
 
 func (s *Storage) CleanupStaleMounts() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	s.cleanupStaleMounts()
-	return nil
+	return s.update(func() error {
+		s.cleanupStaleMounts()
+		return nil
+	})
 }
\ No newline at end of file
@@ -1,6 +1,17 @@
 package utils
 
-import "os"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxSymlinks mirrors the kernel's limit on symlinks followed during a single lookup
+const maxSymlinks = 40
 
 func Map[T, U any](arr []T, function func(T) U) []U {
 	if arr == nil {
@@ -19,3 +30,76 @@ func Map[T, U any](arr []T, function func(T) U) []U {
 func IsRoot() bool {
 	return os.Getuid() == 0
 }
+
+// SecureJoin joins unsafePath onto root, resolving symlinks as if root were the
+// filesystem root, so the result never points outside of root. This must be used
+// for any guest-controlled path (fstab entries, symlinks inside the image) before
+// mounting onto it or writing to it from the host.
+// Components that don't exist are appended as-is.
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = filepath.Clean(root)
+	current := "/"
+	parts := strings.Split(unsafePath, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s in %s", unsafePath, root)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(root, current), nil
+}
+
+// InvokingUID returns the UID of the user who ran qimi, looking through sudo
+func InvokingUID() int {
+	if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		return uid
+	}
+	return os.Getuid()
+}
+
+// RandomID returns a random hex string of n bytes
+func RandomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}